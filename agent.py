@@ -15,9 +15,11 @@ from minisweagent.utils.log import logger
 from minisweagent.utils.serialize import UNSET, recursive_merge
 from pprint import pprint
 import subprocess
-import time
+import socket
 import json
 
+PROTOCOL_VERSION = 1
+
 DEFAULT_OUTPUT_FILE = global_config_dir / "last_swebench_single_run.traj.json"
 DEFAULT_CONFIG_FILE = builtin_config_dir / "benchmarks" / "swebench.yaml"
 
@@ -39,78 +41,22 @@ Examples:
 [bold green]-c swebench.yaml -c agent.mode=yolo[/bold green]
 """
 
-userPrompt = """
-<pr_description>
-Consider the following PR description:
-{task}
-</pr_description>
-
-<instructions>
-# Task Instructions
-
-## Overview
-
-You'll be helping implement necessary changes to meet requirements in the above PR description.
-Your task is specifically to make changes to non-test files in the current directory in order to fix the issue described in the above PR description in a way that is general and consistent with the codebase.
-<IMPORTANT>This is an interactive process where you will think and issue AT LEAST ONE command, see the result, then think and issue your next command(s).</important>
-
-## Important Boundaries
-
-- MODIFY: Regular source code files in /testbed (this is the working directory for all your subsequent commands)
-- DO NOT MODIFY: Tests, configuration files (pyproject.toml, setup.cfg, etc.)
-
-**CRITICAL REQUIREMENTS:**
-
-- Directory or environment variable changes are not persistent. Every action is executed in a new subshell.
-- However, you can prefix any action with `MY_ENV_VAR=MY_VALUE cd /path/to/working/dir && ...` or write/load environment variables from files
-
-## Environment Details
-
-- You have a full Linux shell environment
-- Always use non-interactive flags (-y, -f) for commands
-- Avoid interactive tools like vi, nano, or any that require user input
-- You can use bash commands or invoke any tool that is available in the environment
-- You can also create new tools or scripts to help you with the task
-- If a tool isn't available, you can also install it
-
-## Submission
+# the agent and the prompt renderer are built next to this script:
+#   go build -o main . && go build -o renderPrompt ./cmds/renderPrompt
+BIN_DIR = Path(__file__).resolve().parent
+AGENT_BIN = BIN_DIR / "main"
+RENDER_PROMPT_BIN = BIN_DIR / "renderPrompt"
 
-When you've completed your work, you MUST submit your changes as a git patch.
-Follow these steps IN ORDER, with SEPARATE commands:
 
-Step 1: Create the patch file
-Run `git diff -- path/to/file1 path/to/file2 > patch.txt` listing only the source files you modified.
-Do NOT commit your changes.
-
-<IMPORTANT>
-The patch must only contain changes to the specific source files you modified to fix the issue.
-Do not submit file creations or changes to any of the following files:
-
-- test and reproduction files
-- helper scripts, tests, or tools that you created
-- installation, build, packaging, configuration, or setup scripts unless they are directly part of the issue you were fixing (you can assume that the environment is already set up for your client)
-- binary or compiled files
-</IMPORTANT>
-
-Step 2: Verify your patch
-Inspect patch.txt to confirm it only contains your intended changes and headers show `--- a/` and `+++ b/` paths.
-
-Step 3: Submit (EXACT command required)
-You MUST use this EXACT command to submit:
-
-```bash
-echo COMPLETE_TASK_AND_SUBMIT_FINAL_OUTPUT && cat patch.txt
-```
-
-If the command fails (nonzero exit status), it will not submit.
-
-<CRITICAL>
-- Creating/viewing the patch and submitting it MUST be separate commands (not combined with &&).
-- If you modify patch.txt after verifying, you SHOULD verify again before submitting.
-- You CANNOT continue working (reading, editing, testing) in any way on this task after submitting.
-</CRITICAL>
-</instructions>
-"""
+def load_user_prompt(problem_statement: str, prompt_dir: Path | None) -> str:
+    """Render swebench.tmpl with the Go prompt library, a template in prompt_dir overrides the built-in one."""
+    args = [str(RENDER_PROMPT_BIN), "-role", "swebench"]
+    if prompt_dir:
+        args += ["-prompts", str(prompt_dir.resolve())]
+    res = subprocess.run(args, input=problem_statement, capture_output=True, text=True)
+    if res.returncode != 0:
+        raise RuntimeError(f"render swebench.tmpl failed: {res.stderr.strip()}")
+    return res.stdout
 
 # fmt: off
 @app.command()
@@ -127,6 +73,7 @@ def main(
     config_spec: list[str] = typer.Option([str(DEFAULT_CONFIG_FILE)], "-c", "--config", help=_CONFIG_SPEC_HELP_TEXT, rich_help_panel="Basic"),
     exit_immediately: bool = typer.Option(False, "--exit-immediately", help="Exit immediately when the agent wants to finish instead of prompting.", rich_help_panel="Advanced"),
     output: Path | None = typer.Option(DEFAULT_OUTPUT_FILE, "-o", "--output", help="Output trajectory file", rich_help_panel="Basic"),
+    prompt_dir: Path | None = typer.Option(None, "--prompts", help="Directory with prompt templates overriding the built-in ones, also passed to the agent", rich_help_panel="Advanced"),
 ) -> None:
     # fmt: on
     """Run on a single SWE-Bench instance."""
@@ -161,40 +108,64 @@ def main(
     config = recursive_merge(*configs)
 
     env = get_sb_environment(config, instance)
-    prompt = userPrompt.format(task=instance["problem_statement"])
-    print(prompt)
-    process = subprocess.Popen(
-        ["./main"],
-        stdin=subprocess.PIPE,
-        stdout=subprocess.PIPE,
-        stderr=subprocess.STDOUT,
-        text=True,
-        bufsize=1 # Line buffered
-    )
-    inputStr = json.dumps({
-        "Task":userPrompt
-    })
-    print(inputStr)
-    process.stdin.write(inputStr + "\n")
-    process.stdin.flush()
-    print("input")
-    
-
-    while(True):
-        output = process.stdout.readline().strip()
-        if output == "DONE":
+    prompt = load_user_prompt(instance["problem_statement"], prompt_dir)
+    # the protocol runs on its own socket, the agent's stdout stays free for logs
+    sock, child = socket.socketpair()
+    # the agent records its events next to the .traj.json it exports for the run
+    args = [str(AGENT_BIN), "-proto", f"fd:{child.fileno()}"]
+    if prompt_dir:
+        args += ["-prompts", str(prompt_dir.resolve())]
+    if output:
+        output.parent.mkdir(parents=True, exist_ok=True)
+        args += ["-trajectory", str(output.with_suffix(".jsonl")), "-traj-json", str(output)]
+    process = subprocess.Popen(args, pass_fds=[child.fileno()])
+    child.close()
+    conn = sock.makefile("rw", encoding="utf-8", newline="\n")
+    next_id = 0
+
+    def send(msg_type, payload, reply_to=""):
+        nonlocal next_id
+        next_id += 1
+        frame = {"version": PROTOCOL_VERSION, "type": msg_type, "id": f"d{next_id}", "payload": payload}
+        if reply_to:
+            frame["reply_to"] = reply_to
+        conn.write(json.dumps(frame) + "\n")
+        conn.flush()
+        return frame["id"]
+
+    task_id = send("task", {"task": prompt})
+    result = None
+    for line in conn:
+        try:
+            frame = json.loads(line)
+        except json.JSONDecodeError:
+            logger.warning(f"skip invalid frame: {line.strip()}")
+            continue
+        msg_type = frame.get("type")
+        if msg_type == "bash":
+            args = frame["payload"]
+            try:
+                res = env.execute(action={"command": args["command"]}, cwd=args.get("cwd") or "")
+            except Exception as e:
+                send("error", {"code": "failed", "message": str(e)}, reply_to=frame["id"])
+                continue
+            send("bash_result", {"code": res["returncode"], "output": res["output"]}, reply_to=frame["id"])
+        elif msg_type == "result" and frame.get("reply_to") == task_id:
+            result = frame["payload"]
             break
-        print(output.strip())
-        args = json.loads(output)
-        res = env.execute(action={
-            "command": args["Command"]
-        }, cwd=args["Cwd"])
-        print(res)
-        inputStr = json.dumps({
-            "Code":res["returncode"],
-            "Output":res["output"]
-        })
-        process.stdin.write(inputStr + "\n")
+        elif msg_type == "error" and frame.get("reply_to") == task_id:
+            logger.error(f"agent failed: {frame['payload']}")
+            break
+        elif msg_type == "plan":
+            # batch runs have nobody to ask, every plan is approved as written
+            send("plan_result", {"approved": True}, reply_to=frame["id"])
+        elif msg_type == "hello":
+            send("hello", {"name": "agent.py", "versions": [PROTOCOL_VERSION]}, reply_to=frame["id"])
+    conn.close()
+    sock.close()
+    process.wait()
+    pprint(result)
+
 
 if __name__ == "__main__":
     app()
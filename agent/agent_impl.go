@@ -1,124 +1,83 @@
 package agent
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"multi-agent/config"
+	"multi-agent/prompts"
+	"multi-agent/service"
+	"multi-agent/trajectory"
+	"slices"
+
+	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
 )
 
-func (w *Workflow) OrchestratorAgent() (string, error) {
-	instruct := `
-You are the **Task Orchestrator** agent. You decompose the User Primary Goal into atomic tasks of specific types.
-
-## Task Types
-
-You have access to four task creation tools. Choose the appropriate type based on the task's nature:
-
-### 1. Explore Task ('create_explore_task')
-**Purpose**: Investigate and gather specific information from the codebase using function call results.
-
-**When to use**:
-- First step when working with unfamiliar code
-- Need to understand codebase structure
-- Gathering evidence for analysis
-- Finding specific files/functions/patterns
-
-**How to define**:
-- **Task**: Clear, specific exploration goal
-  - Good: "Find all HTTP handlers in the codebase"
-  - Bad: "Look at the code"
-- **ExpectOutput**: EXACTLY what context to gather - be specific
-  - Specify what information to collect
-  - Indicate how many items/locations to find
-  - Include details needed for each result
-  - Example: "Gather 3 context items: 1) list of handlers with routes, 2) function definitions, 3) file locations"
-
-### 2. Reason Task ('create_reason_task')
-**Purpose**: Analyze information and draw conclusions based on gathered data.
-
-**When to use**:
-- After exploration to analyze findings
-- Understanding architecture patterns
-- Identifying problems or issues
-- Formulating solutions based on evidence
-
-**How to define**:
-- **Task**: The specific problem/question to solve
-  - Good: "Analyze the authentication flow and identify security issues"
-  - Bad: "Think about authentication"
-- **ExpectOutput**: Format of the conclusion you want
-  - Be specific about what the conclusion should contain
-  - Example: "List of security issues with severity levels and recommended fixes"
-  - Example: "Explanation of the caching strategy and its performance implications"
-
-### 3. Build Task ('create_build_task')
-**Purpose**: Make modifications or additions to the codebase.
-
-**When to use**:
-- Implementing new features
-- Fixing bugs or issues found in analysis
-- Refactoring existing code
-- Adding tests or documentation
-
-**How to define**:
-- **Task**: Precise description of what to build/modify
-  - Include exact changes needed
-  - Specify files/locations to modify
-  - Mention any requirements or constraints
-  - Good: "Add error handling to GET /api/users endpoint in src/handlers/userHandler.js"
-  - Bad: "Make the API better"
-- **No ExpectOutput**: The worker will return context items showing changes made
-
-### 4. Verify Task ('create_verify_task')
-**Purpose**: Test and validate implementations or conclusions.
-
-**When to use**:
-- Testing if implementations work correctly
-- Verifying fixes address identified issues
-- Checking if conclusions are accurate
-- Validating builds/tests pass
-
-**How to define**:
-- **Task**: Clear verification target
-  - For implementation testing: "Test that the error handling catches all expected error cases"
-  - For conclusion verification: "Verify that the database queries use indexes (check for slow queries)"
-  - For build validation: "Run the test suite to ensure all tests pass"
-- **No ExpectOutput**: The worker will return success/failure with supporting evidence
-
-## Task Definition Best Practices
-
-1. **Start with Explore**: Always explore unfamiliar code before building
-2. **Be specific**: Vague tasks lead to poor results
-4. **Atomic tasks**: One task = one goal
-5. **Clear outputs**: Define what you expect from each task type
-
-## Workflow
-
-Analyze the Task History against the User Primary Goal. Choose one of two paths:
-
-### PATH A: GOAL NOT COMPLETED (DECOMPOSE & CREATE TASK)
-If information is missing or work remains:
-1. **Identify the gap**: What information is needed or what work must be done next?
-2. **Choose task type**: Select the appropriate tool (Explore, Reason, Build, or Verify)
-3. **Create atomic task**: Define a single, focused task with ONLY ONE goal
-4. **Keep expectations focused**: Request only 1-3 most essential outputs
+// agentInput is what an agent starts with, RenderPrompt shows it without running the agent.
+type agentInput struct {
+	role   string
+	system string
+	user   string
+	tools  *service.ToolDispatcher
+}
 
-### PATH B: GOAL COMPLETED (FINALIZE)
-If the User Primary Goal is completed, return the final response.
+func (w *Workflow) newAgent(input *agentInput) *BaseAgent {
+	return NewBaseAgent(input.system, input.user, input.tools, w.taskMgr.GetAllTaskToolCallMessages())
+}
 
-## Critical Rules
+// render renders the system prompt of the template, task is the task of a worker or of the context agent.
+func (w *Workflow) render(name string, role string, task service.Task, tools *service.ToolDispatcher, subtasks []service.ToolEndPoint) (string, error) {
+	data := prompts.Data{
+		Role:      role,
+		UserGoal:  w.taskMgr.UserGoal,
+		Task:      task,
+		Tools:     trajectory.ToolNames(tools.GetTools()),
+		Repo:      w.config.Executor,
+		Budget:    w.config.BudgetFor(role),
+		RunBudget: w.config.RunBudget,
+		Rules:     w.taskMgr.Rules,
+		FixCycles: max(w.taskMgr.MaxFixCycles, 0),
+		Plan:      w.taskMgr.GetPlan(),
+		Usage:     w.usage.Total(),
+	}
+	for _, tool := range subtasks {
+		data.Subtasks = append(data.Subtasks, tool.Name)
+	}
+	for _, def := range w.taskMgr.TaskDefs() {
+		if !slices.Contains(prompts.BuiltinTaskTypes, def.Name) {
+			data.TaskTypes = append(data.TaskTypes, prompts.TaskType{Name: def.Name, Description: def.CreateTool().Def.Description})
+		}
+	}
+	return w.prompts.Render(name, data)
+}
 
-- **NEVER create tasks with multiple goals** - decompose complex goals into the smallest atomic units
-- **NEVER skip exploration** - always use Explore tasks before Build tasks when working with unfamiliar code
-- **ALWAYS verify** - after Build tasks, create Verify tasks to confirm changes work
-- **Keep ExpectOutput focused** - request only the 1-2 most critical facts, not "everything"
-- **Use Reason tasks** between Explore and Build to analyze findings and plan implementation
-`
+func (w *Workflow) orchestratorInput() (*agentInput, error) {
+	tools := service.NewToolDispatcher(w.toolLog)
+	tools.RegisterToolEndpoint(w.taskMgr.CreateTaskTools()...)
+	tools.RegisterToolEndpoint(w.taskMgr.CancelTaskTool(), w.taskMgr.RetryTaskTool())
+	if w.taskMgr.GetPlan() != nil {
+		tools.RegisterToolEndpoint(w.taskMgr.PlanTools()...)
+	}
+	tools.RegisterToolEndpoint(w.taskMgr.ViewToolLogTool())
+	system, err := w.render(config.RoleOrchestrator, config.RoleOrchestrator, nil, tools, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &agentInput{
+		role:   config.RoleOrchestrator,
+		system: system,
+		user:   w.taskMgr.GetTaskContextPrompt(nil) + w.usage.BudgetPrompt(w.config.RunBudget),
+		tools:  tools,
+	}, nil
+}
 
-	tools := w.toolDispatcher
-	tools.ResetTools()
-	tools.RegisterToolEndpoint(w.taskMgr.CreateExploreTaskTool(), w.taskMgr.CreateReasonTaskTool(), w.taskMgr.CreateBuildTaskTool(), w.taskMgr.CreateVerifyTaskTool())
-	userInput := w.taskMgr.GetTaskContextPrompt()
-	prevToolMessages := w.taskMgr.GetAllTaskToolCallMessages()
-	agent := NewBaseAgent(instruct, userInput, tools, prevToolMessages)
+func (w *Workflow) OrchestratorAgent(ctx context.Context) (string, error) {
+	input, err := w.orchestratorInput()
+	if err != nil {
+		return "", err
+	}
+	agent := w.newAgent(input)
 
 	var final_msg string = ""
 
@@ -129,380 +88,213 @@ If the User Primary Goal is completed, return the final response.
 		return true
 	}
 
-	err := agent.Run(w.client, "glm-5", outputFunc)
+	err = w.runAgent(ctx, input.role, nil, agent, outputFunc)
 	if err != nil {
 		return "", err
 	}
 	return final_msg, err
 }
 
-func (w *Workflow) WorkerAgent() error {
-	// Get the current task type to determine which specialized agent to use
-	currentTaskType := w.taskMgr.GetCurrentTaskType()
-	var err error
-
-	switch currentTaskType {
-	case "explore":
-		err = w.ExploreWorkerAgent()
-	case "reason":
-		err = w.ReasonWorkerAgent()
-	case "build":
-		err = w.BuildWorkerAgent()
-	case "verify":
-		err = w.VerifyWorkerAgent()
-	default:
-		// Fallback to explore if type is unknown
-		err = w.ExploreWorkerAgent()
+// plannerInput is the orchestrator writing the plan, feedback is why the driver rejected the last plan.
+func (w *Workflow) plannerInput(feedback string) (*agentInput, error) {
+	tools := service.NewToolDispatcher(w.toolLog)
+	tools.RegisterToolEndpoint(w.taskMgr.SetPlanTool(), w.taskMgr.ViewToolLogTool())
+	system, err := w.render(config.PlanPrompt, config.RoleOrchestrator, nil, tools, nil)
+	if err != nil {
+		return nil, err
+	}
+	user := w.taskMgr.GetTaskContextPrompt(nil)
+	if feedback != "" {
+		user += fmt.Sprintf("### PLAN FEEDBACK\nThe plan was rejected: %s\nWrite a new plan addressing the feedback.\n", feedback)
 	}
+	return &agentInput{
+		role:   config.RoleOrchestrator,
+		system: system,
+		user:   user,
+		tools:  tools,
+	}, nil
+}
 
+// PlannerAgent runs the orchestrator until it wrote a new plan of the user goal.
+func (w *Workflow) PlannerAgent(ctx context.Context, feedback string) error {
+	input, err := w.plannerInput(feedback)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (w *Workflow) ExploreWorkerAgent() error {
-	instruct := `
-You are the **Explore Worker Agent**. Your ONLY goal is to gather specific context based on the task's Expected Output.
-
-## Your Mission
-- Read and understand the "Expected Output" requirement for this task
-- Use available tools to gather ALL information needed to meet this requirement
-- Collect context items where each item represents a function call result that provides relevant information
-
-## Understanding Expected Output
-The task includes an "Expected Output" that tells you exactly what context to gather:
-- This is NOT a general exploration - it's focused on gathering specific information
-- Every tool execution that provides relevant information should be recorded as a context item
-- The description should clearly state what information this tool result provides
-
-## Gathering Strategy
-1. **First, understand what's needed**:
-   - Read the Expected Output carefully
-   - Identify what information, files, or code you need to find
-
-2. **Execute tool calls**:
-   - Each tool call should provide part of the required information
-   - For every relevant result, record it as a context item
-
-3. **Record context items**:
-   - ID: The tool log ID (automatically assigned)
-   - Desc: Clear description of what this result provides
-     - Example: "123: Found all HTTP handlers in api/server.go"
-     - Example: "456: Definition of authenticateUser function"
-     - Example: "789: All usages of database connection"
-
-## Critical Rules
-- ONLY return context items that directly contribute to the Expected Output
-- AFTER gathering ALL required information, IMMEDIATELY call finish_explore_task
-- DO NOT include irrelevant tool results
-- DO NOT analyze or summarize - just collect the raw context
-- If the Expected Output is impossible to achieve with available tools, note this in the context
-`
-
-	tools := w.toolDispatcher
-	tools.ResetTools()
-	tools.RegisterToolEndpoint(w.taskMgr.FinishExploreTaskTool(), w.taskMgr.BashTool())
-	userInput := w.taskMgr.GetTaskContextPrompt()
-	prevToolMessages := w.taskMgr.GetAllTaskToolCallMessages()
-	agent := NewBaseAgent(instruct, userInput, tools, prevToolMessages)
+	agent := w.newAgent(input)
 
+	revision := 0
+	if plan := w.taskMgr.GetPlan(); plan != nil {
+		revision = plan.Revision
+	}
 	outputFunc := func(msg openai.ChatCompletionMessage) bool {
-		if len(msg.ToolCalls) != 0 {
-			for _, call := range msg.ToolCalls {
-				if call.Function.Name == "finish_explore_task" {
-					return true
-				}
-			}
-		}
-		return false
+		// a rejected set_plan call, e.g. with an unknown task type, does not stop the planner
+		plan := w.taskMgr.GetPlan()
+		return plan != nil && plan.Revision > revision
 	}
 
-	err := agent.Run(w.client, "glm-5", outputFunc)
+	err = w.runAgent(ctx, input.role, nil, agent, outputFunc)
 	if err != nil {
 		return err
 	}
+	if plan := w.taskMgr.GetPlan(); plan == nil || plan.Revision == revision {
+		return fmt.Errorf("the orchestrator stopped without writing a plan")
+	}
 	return nil
 }
 
-func (w *Workflow) ReasonWorkerAgent() error {
-	instruct := `
-You are the **Reason Worker Agent**. Your ONLY goal is to analyze information and draw conclusions.
-
-## Task Understanding
-- **Task field**: Tells you what you need to figure out (the problem/question)
-- **Expected Output field**: Tells you what conclusion you should return (the answer)
-
-## Your Mission
-- Analyze the context from previous tasks to understand the problem
-- Perform additional exploration if needed to strengthen your reasoning
-- Draw well-reasoned conclusions based on evidence
-- Return ONLY the conclusion as plain text
-
-## Analysis Process
-1. **Understand the problem**:
-   - Read the Task field carefully - this is what you need to figure out
-   - Review all context items from previous tasks
-   - Identify what information is already available
-
-2. **Explore if necessary**:
-   - Use avaliable tools to gather infomation.
-   - Only explore if it directly helps solve the problem defined in Task
-
-3. **Draw the conclusion**:
-   - Base conclusions ONLY on verified information from tools or context
-   - Don't make assumptions or invent facts
-   - The conclusion should directly address what was asked in the Task field
-   - Follow the format described in Expected Output field
-
-4. **Return plain text conclusion**:
-   - The output is ONLY the conclusion - no additional formatting
-   - Make it clear, specific, and directly answer the question
-   - Include reasoning only if helpful and requested in Expected Output
-
-## Example
-- Task: "Analyze the authentication flow and identify security issues"
-- Expected Output: "List of security issues found with recommended fixes"
-- Conclusion: "Three security issues found: 1) SQL injection in login, 2) No rate limiting, 3) Weak password storage..."
-
-## Critical Rules
-- AFTER reaching your conclusion, IMMEDIATELY call finish_reason_task
-- DO NOT continue to other tasks after calling finish_task
-- The Conclusion parameter should contain ONLY the plain text conclusion
-- Never return analysis or working - only the final conclusion
-`
-
-	tools := w.toolDispatcher
-	tools.ResetTools()
-	tools.RegisterToolEndpoint(w.taskMgr.FinishReasonTaskTool(), w.taskMgr.BashTool())
-	userInput := w.taskMgr.GetTaskContextPrompt()
-	prevToolMessages := w.taskMgr.GetAllTaskToolCallMessages()
-	agent := NewBaseAgent(instruct, userInput, tools, prevToolMessages)
-
-	outputFunc := func(msg openai.ChatCompletionMessage) bool {
-		if len(msg.ToolCalls) != 0 {
-			for _, call := range msg.ToolCalls {
-				if call.Function.Name == "finish_reason_task" {
-					return true
-				}
-			}
-		}
-		return false
+// workerInput registers the tools of the task's worker in tools, mgr is the task manager of the task.
+func (w *Workflow) workerInput(ctx context.Context, mgr *service.TaskMgr, task service.Task, tools *service.ToolDispatcher) (*agentInput, error) {
+	taskType := service.TaskType(task)
+	def, ok := mgr.LookupTaskDef(taskType)
+	if !ok {
+		return nil, fmt.Errorf("task #%d has unknown type %q", task.Base().ID, taskType)
 	}
-
-	err := agent.Run(w.client, "glm-5", outputFunc)
+	workerTools, err := w.workerTools(ctx, def)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	subtasks, err := mgr.SubtaskTools(def, task)
+	if err != nil {
+		return nil, err
+	}
+	tools.RegisterToolEndpoint(workerTools...)
+	tools.RegisterToolEndpoint(subtasks...)
+	tools.RegisterToolEndpoint(mgr.FinishTaskTool(def, task))
+	system, err := w.render(def.Name, def.Role, task, tools, subtasks)
+	if err != nil {
+		return nil, err
+	}
+	return &agentInput{
+		role:   def.Role,
+		system: system,
+		user:   mgr.GetTaskContextPrompt(task),
+		tools:  tools,
+	}, nil
 }
 
-func (w *Workflow) BuildWorkerAgent() error {
-	instruct := `
-You are the **Build Worker Agent**. Your ONLY goal is to implement changes to the codebase and return context items that record those changes.
-
-## Understanding Build Tasks
-- **Task field**: Clearly describes what to build/modify (e.g., "Implement error handling in API handlers")
-- **Your job**: Make the minimal necessary changes and record every change
-
-## Your Mission
-- Implement the exact changes described in the Build Task
-- Make minimal, focused modifications to accomplish the goal
-- Record every change as context items that track what was modified
-- Return context items showing the changes made
-
-## Build Process
-1. **Understand the requirements**:
-   - Read the Task field carefully - this tells you exactly what to build
-   - Review any previous reasoning or context that informs the build
-   - Check existing code patterns and conventions
-
-2. **Plan your changes**:
-   - Identify which files need to be modified
-   - Understand the scope of changes needed
-   - Plan minimal implementation
-
-3. **Implement changes**:
-   - Make the smallest possible changes to achieve the goal
-   - Follow existing code style and conventions
-   - Don't over-engineer - implement only what's requested
-   - Test if needed to verify changes work
-
-4. **Record changes as context items**:
-   - Each context item represents a tool execution that made changes
-   - Description should clearly state what change was made:
-     - Example: "123: Created new file src/auth/middleware.go with authentication logic"
-     - Example: "456: Modified src/api/handler.go to add error handling for GET /users"
-     - Example: "789: Updated package.json to add bcrypt dependency"
-   - Include file paths, what was changed, and brief why if helpful
-
-## Change Log vs Context Items
-- **Change Log**: Summary string describing all changes made
-- **Context Items**: Individual tool executions that performed the changes
+// WorkerAgent runs the worker for the task, tools records the tool calls of the worker.
+func (w *Workflow) WorkerAgent(ctx context.Context, task service.Task, tools *service.ToolDispatcher) error {
+	return w.workerAgent(ctx, w.taskMgr, task, tools)
+}
 
-## Critical Rules
-- AFTER implementing changes, IMMEDIATELY call finish_build_task
-- DO NOT continue to other tasks after calling finish_task
-- Make minimal changes - implement only what's requested in the Task field
-- Always create context items for every tool that made changes
-- The Context array should contain all tool logs that performed modifications
-`
+// runSubtask runs the worker of a subtask delegated by another worker.
+func (w *Workflow) runSubtask(ctx context.Context, mgr *service.TaskMgr, task service.Task) error {
+	return w.workerAgent(ctx, mgr, task, service.NewToolDispatcher(w.toolLog))
+}
 
-	tools := w.toolDispatcher
-	tools.ResetTools()
-	tools.RegisterToolEndpoint(w.taskMgr.FinishBuildTaskTool(), w.taskMgr.BashTool())
-	userInput := w.taskMgr.GetTaskContextPrompt()
-	prevToolMessages := w.taskMgr.GetAllTaskToolCallMessages()
-	agent := NewBaseAgent(instruct, userInput, tools, prevToolMessages)
+func (w *Workflow) workerAgent(ctx context.Context, mgr *service.TaskMgr, task service.Task, tools *service.ToolDispatcher) error {
+	input, err := w.workerInput(ctx, mgr, task, tools)
+	if err != nil {
+		return err
+	}
+	agent := w.newAgent(input)
 
 	outputFunc := func(msg openai.ChatCompletionMessage) bool {
-		if len(msg.ToolCalls) != 0 {
-			for _, call := range msg.ToolCalls {
-				if call.Function.Name == "finish_build_task" {
-					return true
-				}
-			}
-		}
-		return false
+		// a rejected finish call, e.g. with an invalid tool log ID, does not stop the worker
+		return mgr.IsFinished(task)
 	}
 
-	err := agent.Run(w.client, "glm-5", outputFunc)
+	err = w.runAgent(ctx, input.role, task, agent, outputFunc)
+	var budgetErr *BudgetError
+	if errors.As(err, &budgetErr) {
+		// force finish the task, the orchestrator sees the failure in the task history
+		log.Warn().Err(err).Any("task", service.TaskType(task)).Any("id", task.Base().ID).Msg("worker budget exhausted")
+		return mgr.FailTask(task, budgetErr.Error())
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (w *Workflow) VerifyWorkerAgent() error {
-	instruct := `
-You are the **Verify Worker Agent**. Your ONLY goal is to verify implementations OR conclusions based on the task description.
-
-## Understanding Verify Tasks
-Verify tasks can be used for two purposes:
-1. **Implementation Verification**: Test if code/features work correctly
-2. **Conclusion Verification**: Verify if a conclusion is accurate when you're not sure
-
-- **Task field**: Describes what needs to be verified (implementation or conclusion)
-- **Conclusion**: MUST contain verification result AND reason if failed/uncertain
-- **Context**: Items that support your conclusion (evidence)
-
-## Your Mission
-- Based on the task, determine if you're verifying an implementation or a conclusion
-- Perform appropriate verification checks
-- Return conclusion with supporting evidence
-
-## Verification Types
-
-### Type 1: Implementation Verification
-When verifying code/features:
-1. **Understand the implementation**:
-   - Read the Task field to know what to test
-   - Examine the code/feature to understand how it works
-   - Identify expected behavior
-
-2. **Perform verification**:
-   - Run tests if available
-   - Manual testing if no tests exist
-   - Check build/runtime errors
-   - Test edge cases and normal scenarios
-
-3. **Format conclusion**:
-   - Success: "success" (optionally add brief explanation)
-   - Failed: "failed: [specific detailed reason]"
-
-### Type 2: Conclusion Verification
-When verifying a conclusion you're not sure about:
-1. **Understand the conclusion**:
-   - The task will ask you to verify a specific conclusion
-   - You need to gather evidence to support or refute it
-   - Be objective and thorough
-
-2. **Gather evidence**:
-   - Use LSP tools to examine code definitions and patterns
-   - Use file tools to check implementation details
-   - Use bash tools to search for supporting evidence
-   - Look for facts that prove or disprove the conclusion
-
-3. **Format conclusion**:
-   - Verified: "verified: [conclusion is accurate based on evidence]"
-   - Not verified: "not verified: [conclusion appears incorrect/incomplete, reasons]"
-   - Partially verified: "partially verified: [conclusion is partially correct, details]"
-
-## Conclusion Format Examples
-**Implementation Verification**:
-- Success: "success" or "success: All tests passed without issues"
-- Failed: "failed: Unit test failed with 'Cannot read property 'user' of undefined'"
-
-**Conclusion Verification**:
-- Verified: "verified: The authentication system correctly validates JWT tokens"
-- Not verified: "not verified: The database uses indexed queries (found full table scans instead)"
-- Partially verified: "partially verified: The API returns correct data but lacks proper error handling"
-
-## Context Items
-Record evidence supporting your conclusion:
-- Code snippets that prove/disprove the point
-- Test results and outputs
-- Error messages
-- Code analysis results
-- Any tool executions that provide evidence
-
-## Critical Rules
-- AFTER completing verification, IMMEDIATELY call finish_verify_task
-- DO NOT continue to other tasks after calling finish_task
-- Be objective and thorough in your verification
-- Context items should provide clear evidence for your conclusion
-- Never fake results - report findings honestly with detailed reasoning
-`
-
-	tools := w.toolDispatcher
-	tools.ResetTools()
-	tools.RegisterToolEndpoint(w.taskMgr.FinishVerifyTaskTool(), w.taskMgr.BashTool())
-	userInput := w.taskMgr.GetTaskContextPrompt()
-	prevToolMessages := w.taskMgr.GetAllTaskToolCallMessages()
-	agent := NewBaseAgent(instruct, userInput, tools, prevToolMessages)
-
-	outputFunc := func(msg openai.ChatCompletionMessage) bool {
-		if len(msg.ToolCalls) != 0 {
-			for _, call := range msg.ToolCalls {
-				if call.Function.Name == "finish_verify_task" {
-					return true
-				}
-			}
+// workerTools returns the tools the task type allows besides its finish tool.
+func (w *Workflow) workerTools(ctx context.Context, def *service.TaskDef) ([]service.ToolEndPoint, error) {
+	// outputs truncated to fit the context window point to the tool log
+	available := []service.ToolEndPoint{w.taskMgr.ViewToolLogTool(), w.taskMgr.BashTool()}
+	if def.Tools == nil {
+		return available, nil
+	}
+	if w.mcpclient != nil {
+		mcpTool, err := w.mcpclient.LoadAllTools(ctx)
+		if err != nil {
+			return nil, err
+		}
+		available = append(available, mcpTool...)
+	}
+	var tools []service.ToolEndPoint
+	for _, name := range def.Tools {
+		i := slices.IndexFunc(available, func(tool service.ToolEndPoint) bool { return tool.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("task type %s allows unknown tool %q", def.Name, name)
 		}
-		return false
+		tools = append(tools, available[i])
 	}
+	return tools, nil
+}
 
-	err := agent.Run(w.client, "glm-5", outputFunc)
+func (w *Workflow) contextInput(ctx context.Context, task service.Task) (*agentInput, error) {
+	tools := service.NewToolDispatcher(w.toolLog)
+	tools.RegisterToolEndpoint(w.taskMgr.RefineContextTool(task), w.taskMgr.DropContextTool(task), w.taskMgr.ViewToolLogTool(), w.taskMgr.BashTool())
+	if w.mcpclient != nil {
+		mcpTool, err := w.mcpclient.LoadAllTools(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tools.RegisterToolEndpoint(mcpTool...)
+	}
+	system, err := w.render(config.RoleContext, config.RoleContext, task, tools, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return &agentInput{
+		role:   config.RoleContext,
+		system: system,
+		user:   w.taskMgr.GetRefineContextPrompt(task),
+		tools:  tools,
+	}, nil
 }
-func (w *Workflow) ContextAgent() error {
-	instruct := `
-You are the **Context Refine Agent**. Your goal is to refine the context, make the context short and concise, reduce the unnecessary infomation.
-
-You are given the previous 'Task History', each task has the 'Exprected Output', the output has two kinds, the 'Conclusions Requirements:' and 'Background Context Requirements'.
-- ** Conclusions Requirements **: These are the direct facts and conclusions to extract as the output of the task.
-- ** Background Context Requirements **: background context to observe and record,
 
-Your job is to refine the context output, make the context output short and concise, reduce unnecessary context.
-`
-	tools := w.toolDispatcher
-	tools.ResetTools()
-	mcpTool, err := w.mcpclient.LoadAllTools()
+// ContextAgent refines the context items of the finished task, the refined items are what the later
+// agents see of the task.
+func (w *Workflow) ContextAgent(ctx context.Context, task service.Task) error {
+	input, err := w.contextInput(ctx, task)
 	if err != nil {
 		return err
 	}
-	tools.RegisterToolEndpoint(w.taskMgr.RefineContextTool())
-	tools.RegisterToolEndpoint(mcpTool...)
-	userInput := w.taskMgr.GetInputForRefineContext()
-	prevToolMessages := w.taskMgr.GetAllTaskToolCallMessages()
-	agent := NewBaseAgent(instruct, userInput, tools, prevToolMessages)
+	return w.runAgent(ctx, input.role, task, w.newAgent(input), nil)
+}
 
-	err = agent.Run(w.client, "glm-5", nil)
+// RenderPrompt returns the messages and the tool names an agent would start with in the current state
+// of the task manager. role is "orchestrator", "plan" for the orchestrator writing the plan, "context"
+// for the context agent of the finished task taskID, or "worker" for the worker of the task taskID.
+func (w *Workflow) RenderPrompt(ctx context.Context, role string, taskID int) ([]openai.ChatCompletionMessage, []string, error) {
+	var input *agentInput
+	var err error
+	switch role {
+	case config.RoleOrchestrator:
+		input, err = w.orchestratorInput()
+	case config.PlanPrompt:
+		input, err = w.plannerInput("")
+	case config.RoleContext:
+		i := slices.IndexFunc(w.taskMgr.PreTasks, func(task service.Task) bool { return task.Base().ID == taskID })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("no finished task #%d", taskID)
+		}
+		input, err = w.contextInput(ctx, w.taskMgr.PreTasks[i])
+	case "worker":
+		tasks := append(append([]service.Task{}, w.taskMgr.Pending...), w.taskMgr.PreTasks...)
+		i := slices.IndexFunc(tasks, func(task service.Task) bool { return task.Base().ID == taskID })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("no task #%d", taskID)
+		}
+		input, err = w.workerInput(ctx, w.taskMgr, tasks[i], service.NewToolDispatcher(w.toolLog))
+	default:
+		return nil, nil, fmt.Errorf("unknown agent %q, expect orchestrator, plan, context or worker", role)
+	}
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	return nil
+	agent := w.newAgent(input)
+	return agent.input, trajectory.ToolNames(input.tools.GetTools()), nil
 }
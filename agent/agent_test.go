@@ -2,9 +2,18 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"multi-agent/config"
+	fakellm "multi-agent/fake-llm"
+	"multi-agent/service"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
@@ -39,3 +48,344 @@ func TestReactAgent_chat(t *testing.T) {
 		fmt.Printf("resp: %v\n", resp.Choices[0].Message.Content)
 	})
 }
+
+func TestBaseAgent_budget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"noop","arguments":"{}"}}]}}],"usage":{"prompt_tokens":100,"completion_tokens":10,"total_tokens":110}}`)
+	}))
+	defer server.Close()
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = server.URL
+	client := openai.NewClientWithConfig(clientConfig)
+
+	tests := []struct {
+		name   string
+		budget config.Budget
+		turns  int
+	}{
+		{name: "max turns", budget: config.Budget{MaxTurns: 3}, turns: 3},
+		{name: "max tool calls", budget: config.Budget{MaxToolCalls: 2}, turns: 2},
+		{name: "max prompt tokens", budget: config.Budget{MaxPromptTokens: 450}, turns: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := NewBaseAgent("system", "user", service.NewToolDispatcher(nil), nil)
+			agent.SetBudget(tt.budget)
+			err := agent.Run(context.Background(), client, "test-model", nil)
+			if !errors.Is(err, ErrBudgetExhausted) {
+				t.Fatalf("expect budget exhausted, got %v", err)
+			}
+			if agent.stats.turns != tt.turns {
+				t.Errorf("expect %d turns, got %d", tt.turns, agent.stats.turns)
+			}
+		})
+	}
+}
+
+func TestBaseAgent_toolCallBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		toolCalls := []string{}
+		for i := range 3 {
+			toolCalls = append(toolCalls, fmt.Sprintf(`{"id":"call_%d","type":"function","function":{"name":"noop","arguments":"{}"}}`, i))
+		}
+		fmt.Fprintf(w, `{"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","tool_calls":[%s]}}]}`, strings.Join(toolCalls, ","))
+	}))
+	defer server.Close()
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = server.URL
+	client := openai.NewClientWithConfig(clientConfig)
+
+	calls := 0
+	tools := service.NewToolDispatcher(nil)
+	tools.RegisterToolEndpoint(service.ToolEndPoint{
+		Name: "noop",
+		Def:  openai.FunctionDefinition{Name: "noop"},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			calls++
+			return "ok", nil
+		},
+	})
+	agent := NewBaseAgent("system", "user", tools, nil)
+	agent.SetBudget(config.Budget{MaxToolCalls: 2})
+	err := agent.Run(context.Background(), client, "test-model", nil)
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("expect budget exhausted, got %v", err)
+	}
+	if calls != 2 || agent.stats.turns != 1 {
+		t.Errorf("expect 2 tool calls in 1 turn, got %d in %d", calls, agent.stats.turns)
+	}
+	// every tool call of the turn has a result, the skipped one tells why
+	if len(agent.actionStack) != 4 || !strings.Contains(agent.actionStack[3].Content, "did not run, budget exhausted") {
+		t.Errorf("unexpected messages %+v", agent.actionStack)
+	}
+}
+
+func TestBaseAgent_noChoices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer server.Close()
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = server.URL
+	client := openai.NewClientWithConfig(clientConfig)
+
+	agent := NewBaseAgent("system", "user", service.NewToolDispatcher(nil), nil)
+	err := agent.Run(context.Background(), client, "test-model", nil)
+	if err == nil || !strings.Contains(err.Error(), "no choices") {
+		t.Fatalf("expect no choices error, got %v", err)
+	}
+}
+
+func TestBaseAgent_retry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.Header.Get("Authorization"), "too-long"):
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"This model's maximum context length is 8192 tokens","type":"invalid_request_error","code":"context_length_exceeded"}}`)
+		case calls == 1:
+			// capped by MaxDelay, the test would wait an hour otherwise
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"rate limited","type":"rate_limit"}}`)
+		case calls == 2:
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, `{"error":{"message":"bad gateway","type":"server_error"}}`)
+		default:
+			fmt.Fprint(w, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"done"}}]}`)
+		}
+	}))
+	defer server.Close()
+	newClient := func(key string) *openai.Client {
+		clientConfig := openai.DefaultConfig(key)
+		clientConfig.BaseURL = server.URL
+		clientConfig.HTTPClient = &http.Client{Transport: &RetryAfterTransport{}}
+		return openai.NewClientWithConfig(clientConfig)
+	}
+	policy := config.Retry{MaxAttempts: 3, BaseDelay: config.Duration(time.Millisecond), MaxDelay: config.Duration(10 * time.Millisecond)}
+
+	t.Run("retry transient errors", func(t *testing.T) {
+		agent := NewBaseAgent("system", "user", service.NewToolDispatcher(nil), nil)
+		agent.SetRetry(policy)
+		err := agent.Run(context.Background(), newClient("test"), "test-model", nil)
+		if err != nil {
+			t.Fatalf("expect success after retries, got %v", err)
+		}
+		if calls != 3 {
+			t.Errorf("expect 3 calls, got %d", calls)
+		}
+	})
+	t.Run("context length is not retried", func(t *testing.T) {
+		calls = 0
+		agent := NewBaseAgent("system", "user", service.NewToolDispatcher(nil), nil)
+		agent.SetRetry(policy)
+		err := agent.Run(context.Background(), newClient("too-long"), "test-model", nil)
+		if !IsContextLength(err) {
+			t.Fatalf("expect context length error, got %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("expect 1 call, got %d", calls)
+		}
+	})
+	t.Run("no max delay", func(t *testing.T) {
+		unset := config.Retry{MaxAttempts: 3, BaseDelay: config.Duration(time.Second)}
+		if delay := retryDelay(unset, 1, time.Hour); delay != time.Hour {
+			t.Errorf("expect the Retry-After without MaxDelay, got %s", delay)
+		}
+		if delay := retryDelay(policy, 1, time.Hour); delay != 10*time.Millisecond {
+			t.Errorf("expect the Retry-After capped by MaxDelay, got %s", delay)
+		}
+		if delay := retryDelay(unset, 3, 0); delay < 2*time.Second || delay > 4*time.Second {
+			t.Errorf("expect an uncapped backoff of 2s to 4s, got %s", delay)
+		}
+	})
+}
+
+func TestBaseAgent_parallelTools(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls > 1 {
+			fmt.Fprint(w, `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"done"}}]}`)
+			return
+		}
+		toolCalls := []string{}
+		for i, name := range []string{"read", "read", "read", "write", "read"} {
+			toolCalls = append(toolCalls, fmt.Sprintf(`{"id":"call_%d","type":"function","function":{"name":"%s","arguments":"{}"}}`, i, name))
+		}
+		fmt.Fprintf(w, `{"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","tool_calls":[%s]}}]}`, strings.Join(toolCalls, ","))
+	}))
+	defer server.Close()
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = server.URL
+	client := openai.NewClientWithConfig(clientConfig)
+
+	var running, maxRunning atomic.Int32
+	var writeOverlap atomic.Bool
+	tools := service.NewToolDispatcher(nil)
+	tools.RegisterToolEndpoint(service.ToolEndPoint{
+		Name:     "read",
+		Def:      openai.FunctionDefinition{Name: "read"},
+		ReadOnly: true,
+		Handler: func(ctx context.Context, args string) (string, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				old := maxRunning.Load()
+				if n <= old || maxRunning.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return "read", nil
+		},
+	}, service.ToolEndPoint{
+		Name: "write",
+		Def:  openai.FunctionDefinition{Name: "write"},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			if running.Load() != 0 {
+				writeOverlap.Store(true)
+			}
+			return "write", nil
+		},
+	})
+
+	agent := NewBaseAgent("system", "user", tools, nil)
+	agent.SetParallelTools(2)
+	err := agent.Run(context.Background(), client, "test-model", nil)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if maxRunning.Load() != 2 {
+		t.Errorf("expect 2 read calls at the same time, got %d", maxRunning.Load())
+	}
+	if writeOverlap.Load() {
+		t.Errorf("write ran while read calls were running")
+	}
+	toolMsgs := agent.actionStack[1:6]
+	for i, msg := range toolMsgs {
+		if msg.ToolCallID != fmt.Sprintf("call_%d", i) {
+			t.Errorf("tool message %d answers %s", i, msg.ToolCallID)
+		}
+	}
+}
+
+func TestBaseAgent_termination(t *testing.T) {
+	server := fakellm.New()
+	defer server.Close()
+	server.On(fakellm.Contains("stop")).Reply(fakellm.Text("done"))
+	server.On(fakellm.Contains("output")).Reply(fakellm.ToolCall("noop", "{}")).Always()
+
+	newAgent := func(input string) *BaseAgent {
+		tools := service.NewToolDispatcher(nil)
+		tools.RegisterToolEndpoint(service.ToolEndPoint{
+			Name: "noop",
+			Def:  openai.FunctionDefinition{Name: "noop"},
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return "ok", nil
+			},
+		})
+		return NewBaseAgent("system", input, tools, nil)
+	}
+
+	t.Run("finish reason stop", func(t *testing.T) {
+		agent := newAgent("stop")
+		err := agent.Run(context.Background(), server.Client(), "test-model", func(msg openai.ChatCompletionMessage) bool { return false })
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if agent.stats.turns != 1 {
+			t.Errorf("expect 1 turn, got %d", agent.stats.turns)
+		}
+	})
+	t.Run("output func", func(t *testing.T) {
+		agent := newAgent("output")
+		outputs := 0
+		err := agent.Run(context.Background(), server.Client(), "test-model", func(msg openai.ChatCompletionMessage) bool {
+			outputs++
+			return outputs == 3
+		})
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if agent.stats.turns != 3 || agent.stats.toolCalls != 3 {
+			t.Errorf("expect 3 turns and tool calls, got %d and %d", agent.stats.turns, agent.stats.toolCalls)
+		}
+		if agent.Usage().TotalTokens != 45 {
+			t.Errorf("expect 45 tokens, got %d", agent.Usage().TotalTokens)
+		}
+	})
+	t.Run("api error", func(t *testing.T) {
+		agent := newAgent("unscripted")
+		err := agent.Run(context.Background(), server.Client(), "test-model", nil)
+		var llmErr *LLMError
+		if !errors.As(err, &llmErr) || llmErr.Class != ErrorFatal {
+			t.Fatalf("expect fatal llm error, got %v", err)
+		}
+	})
+}
+
+func TestBaseAgent_contextWindow(t *testing.T) {
+	server := fakellm.New()
+	defer server.Close()
+	server.On().Reply(fakellm.ToolCall("big", "{}")).Always()
+
+	run := func(window int, cfg config.Context) ([]openai.ChatCompletionRequest, error) {
+		before := len(server.Requests())
+		tools := service.NewToolDispatcher(nil)
+		tools.RegisterToolEndpoint(service.ToolEndPoint{
+			Name: "big",
+			Def:  openai.FunctionDefinition{Name: "big"},
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return strings.Repeat("line of output\n", 200), nil
+			},
+		})
+		agent := NewBaseAgent("system", "user", tools, nil)
+		agent.SetContext(window, cfg)
+		turns := 0
+		err := agent.Run(context.Background(), server.Client(), "test-model", func(msg openai.ChatCompletionMessage) bool {
+			turns++
+			return turns == 3
+		})
+		return server.Requests()[before:], err
+	}
+
+	t.Run("truncate tool output", func(t *testing.T) {
+		requests, err := run(0, config.Context{MaxToolOutput: 100})
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		content := requests[1].Messages[3].Content
+		if !strings.Contains(content, "tokens truncated, call view_tool_log with ID 0") || len(content) > 600 {
+			t.Errorf("tool output not truncated: %q", content)
+		}
+	})
+	t.Run("drop old tool outputs", func(t *testing.T) {
+		requests, err := run(1000, config.Context{Reserve: 100})
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		msgs := requests[2].Messages
+		if !strings.HasPrefix(msgs[3].Content, "[output dropped to fit the context window, call view_tool_log with ID 0") {
+			t.Errorf("oldest output not dropped: %q", msgs[3].Content[:50])
+		}
+		if !strings.HasPrefix(msgs[5].Content, "<ToolLogID>1</ToolLogID>") {
+			t.Errorf("latest output dropped: %q", msgs[5].Content)
+		}
+	})
+	t.Run("prompt too long", func(t *testing.T) {
+		requests, err := run(100, config.Context{Reserve: 90})
+		if !IsContextLength(err) {
+			t.Fatalf("expect context length error, got %v", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("expect no request, got %d", len(requests))
+		}
+	})
+}
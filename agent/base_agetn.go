@@ -1,11 +1,14 @@
 package agent
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"multi-agent/config"
 	"multi-agent/service"
-	"os"
+	"multi-agent/trajectory"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
@@ -17,13 +20,30 @@ type BaseAgent struct {
 	actionStack  []openai.ChatCompletionMessage
 	input        []openai.ChatCompletionMessage
 	toolDispatch *service.ToolDispatcher
+
+	stream StreamHandler
+	cancel context.CancelFunc
+
+	turnTimeout time.Duration
+	toolTimeout time.Duration
+
+	budget config.Budget
+	stats  runStats
+	retry  config.Retry
+	price  config.Price
+
+	parallelTools int
+
+	window  int
+	context config.Context
+
+	trajectory *trajectory.Recorder
+	name       string
+	role       string
 }
 
 func NewBaseAgent(instruct string, userInput string, tools *service.ToolDispatcher, prevToolMessages []openai.ChatCompletionMessage) *BaseAgent {
 	// Build input messages with system prompt, user input, and previous tool logs
-	for _, msg := range prevToolMessages {
-		fmt.Printf("msg.Content: %v\n", msg.Content)
-	}
 	messages := []openai.ChatCompletionMessage{
 		{Role: openai.ChatMessageRoleSystem, Content: instruct},
 		{Role: openai.ChatMessageRoleUser, Content: userInput},
@@ -40,57 +60,224 @@ func NewBaseAgent(instruct string, userInput string, tools *service.ToolDispatch
 	}
 }
 
-func (a *BaseAgent) chat(client *openai.Client, model string) (*openai.ChatCompletionChoice, error) {
+// SetStream switches the agent to streaming chat completions, the handler gets the incremental output.
+func (a *BaseAgent) SetStream(handler StreamHandler) {
+	a.stream = handler
+}
+
+// SetTimeouts bounds every chat completion and every tool call, zero means no limit.
+func (a *BaseAgent) SetTimeouts(turn time.Duration, tool time.Duration) {
+	a.turnTimeout = turn
+	a.toolTimeout = tool
+}
+
+// SetBudget limits the turns, tokens, wall time and tool calls of a single Run.
+func (a *BaseAgent) SetBudget(budget config.Budget) {
+	a.budget = budget
+}
+
+// SetTrajectory records the run of the agent, name tells the agent apart from the others of the same role.
+func (a *BaseAgent) SetTrajectory(recorder *trajectory.Recorder, name string, role string) {
+	a.trajectory = recorder
+	a.name = name
+	a.role = role
+}
+
+func (a *BaseAgent) record(event trajectory.Event) {
+	event.Agent = a.name
+	a.trajectory.Record(event)
+}
+
+// SetParallelTools runs up to n read-only tool calls of a turn at the same time, 0 or 1 runs them sequentially.
+func (a *BaseAgent) SetParallelTools(n int) {
+	a.parallelTools = n
+}
+
+// SetPrice prices the usage recorded in the trajectory.
+func (a *BaseAgent) SetPrice(price config.Price) {
+	a.price = price
+}
+
+// SetRetry retries transient chat completion failures with exponential backoff.
+func (a *BaseAgent) SetRetry(retry config.Retry) {
+	a.retry = retry
+}
+
+// Usage returns the token usage of the last Run.
+func (a *BaseAgent) Usage() openai.Usage {
+	return a.stats.usage
+}
+
+// Cancel aborts the running agent, a streaming turn stops in the middle of the generation.
+func (a *BaseAgent) Cancel() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+func (a *BaseAgent) chat(ctx context.Context, client *openai.Client, model string) (*openai.ChatCompletionChoice, error) {
 	msgs := []openai.ChatCompletionMessage{}
 	msgs = append(msgs, a.input...)
 	msgs = append(msgs, a.actionStack...)
+	tools := a.toolDispatch.GetTools()
+	msgs, err := a.fitContext(msgs, tools)
+	if err != nil {
+		return nil, err
+	}
 	req := openai.ChatCompletionRequest{
 		Model:    model,
 		Messages: msgs,
-		Tools:    a.toolDispatch.GetTools(),
+		Tools:    tools,
 	}
-	response, err := client.CreateChatCompletion(context.Background(), req)
+	if a.turnTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.turnTimeout)
+		defer cancel()
+	}
+	if a.stream != nil {
+		return a.chatStream(ctx, client, req)
+	}
+	response, err := client.CreateChatCompletion(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	return &response.Choices[0], err
+	a.stats.addUsage(response.Usage)
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("chat completion returned no choices")
+	}
+	return &response.Choices[0], nil
 }
 
-func (a *BaseAgent) handleToolCall(toolCalls []openai.ToolCall) {
-	for _, call := range toolCalls {
-		res := a.toolDispatch.Run(call)
-		a.actionStack = append(a.actionStack, res)
-		Writer.WriteString("<TOOL CALL>\n")
-		Writer.WriteString(fmt.Sprintf("tool name: %s\ntool args: %s\n", call.Function.Name, call.Function.Arguments))
-		Writer.WriteString(fmt.Sprintf("result:\n%s", res.Content))
-		Writer.WriteString("</TOOL CALL>\n")
+func (a *BaseAgent) runTool(ctx context.Context, call openai.ToolCall) openai.ChatCompletionMessage {
+	if a.toolTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.toolTimeout)
+		defer cancel()
 	}
+	a.record(trajectory.Event{Type: trajectory.EventToolCall, ToolCall: &call})
+	start := time.Now()
+	res := a.toolDispatch.Run(ctx, call)
+	a.record(trajectory.Event{
+		Type:       trajectory.EventToolResult,
+		ToolCall:   &call,
+		Content:    res.Content,
+		DurationMs: trajectory.Since(start),
+	})
+	return res
 }
-func (a *BaseAgent) Run(client *openai.Client, model string, outputFunc OutputFunc) error {
-	f, err := os.OpenFile("agent_log.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		panic(err)
+
+// handleToolCall runs the tool calls of a turn. Consecutive read-only calls run on a pool of
+// parallelTools workers, any other call runs alone after the calls before it. The results are
+// appended in call order, every tool message must follow the assistant message in that order. The
+// calls beyond MaxToolCalls do not run, their result is the returned BudgetError.
+func (a *BaseAgent) handleToolCall(ctx context.Context, toolCalls []openai.ToolCall) error {
+	results := make([]openai.ChatCompletionMessage, len(toolCalls))
+	run := len(toolCalls)
+	var budgetErr error
+	if limit := a.budget.MaxToolCalls; limit > 0 && a.stats.toolCalls+run > limit {
+		run = max(limit-a.stats.toolCalls, 0)
+		budgetErr = &BudgetError{Reason: fmt.Sprintf("reached max tool calls %d", limit)}
+	}
+	for start := 0; start < run; {
+		end := start + 1
+		if a.parallelTools > 1 && a.toolDispatch.IsReadOnly(toolCalls[start].Function.Name) {
+			for end < run && a.toolDispatch.IsReadOnly(toolCalls[end].Function.Name) {
+				end++
+			}
+		}
+		a.runTools(ctx, toolCalls[start:end], results[start:end])
+		start = end
+	}
+	a.stats.toolCalls += run
+	for i := run; i < len(toolCalls); i++ {
+		results[i] = openai.ChatCompletionMessage{
+			Role:       openai.ChatMessageRoleTool,
+			ToolCallID: toolCalls[i].ID,
+			Content:    fmt.Sprintf("Error: the tool call did not run, %s", budgetErr),
+		}
+		a.record(trajectory.Event{Type: trajectory.EventToolResult, ToolCall: &toolCalls[i], Content: results[i].Content})
+	}
+	a.actionStack = append(a.actionStack, results...)
+	return budgetErr
+}
+
+func (a *BaseAgent) runTools(ctx context.Context, calls []openai.ToolCall, results []openai.ChatCompletionMessage) {
+	if len(calls) == 1 {
+		results[0] = a.runTool(ctx, calls[0])
+		return
 	}
-	defer f.Close()
-	Writer = bufio.NewWriter(f)
+	pool := make(chan struct{}, a.parallelTools)
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		pool <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = a.runTool(ctx, call)
+			<-pool
+		}()
+	}
+	wg.Wait()
+}
 
-	Writer.WriteString(fmt.Sprintf("SYSTEM PROMPT: %s\n", a.input[0].Content))
-	Writer.WriteString(fmt.Sprintf("%s\n\n", a.input[1].Content))
+// Run loops until the model stops or outputFunc reports the agent finished, cancelling ctx aborts
+// the running chat completion or tool call.
+func (a *BaseAgent) Run(ctx context.Context, client *openai.Client, model string, outputFunc OutputFunc) (err error) {
+	var cancel context.CancelFunc
+	if a.budget.MaxWallTime > 0 {
+		wallTime := time.Duration(a.budget.MaxWallTime)
+		ctx, cancel = context.WithTimeoutCause(ctx, wallTime, &BudgetError{Reason: fmt.Sprintf("ran longer than %s", wallTime)})
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	a.cancel = cancel
+
+	// a replay backend looks up the recorded responses by agent name
+	ctx = trajectory.WithAgent(ctx, a.name)
 
 	a.actionStack = nil
+	a.stats = runStats{start: time.Now()}
+	a.record(trajectory.Event{Type: trajectory.EventAgentStart, Role: a.role, Model: model})
+	defer func() {
+		event := trajectory.Event{
+			Type:       trajectory.EventAgentEnd,
+			Turn:       a.stats.turns,
+			Usage:      &a.stats.usage,
+			Cost:       a.cost(a.stats.usage),
+			DurationMs: trajectory.Since(a.stats.start),
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		a.record(event)
+	}()
 	for {
-		resp, err := a.chat(client, model)
+		a.record(a.requestEvent(model))
+		start := time.Now()
+		usage := a.stats.usage
+		resp, err := a.chatWithRetry(ctx, client, model)
 		if err != nil {
 			log.Error().Err(err).Msg("chat failed")
-			return err
+			return budgetCause(ctx, err)
 		}
+		a.stats.turns++
 		a.actionStack = append(a.actionStack, resp.Message)
-		Writer.WriteString("<MSG> clean thinking\n")
-		Writer.WriteString(fmt.Sprintf("Role: %s\n", resp.Message.Role))
-		Writer.WriteString(fmt.Sprintf("content:\n%s\n", resp.Message.Content))
-		Writer.WriteString("</MSG>\n")
+		turnUsage := usageSince(usage, a.stats.usage)
+		a.record(trajectory.Event{
+			Type:         trajectory.EventResponse,
+			Turn:         a.stats.turns,
+			Message:      &resp.Message,
+			FinishReason: string(resp.FinishReason),
+			Usage:        turnUsage,
+			Cost:         a.cost(*turnUsage),
+			DurationMs:   trajectory.Since(start),
+		})
 
-		a.handleToolCall(resp.Message.ToolCalls)
+		budgetErr := a.handleToolCall(ctx, resp.Message.ToolCalls)
+		if ctx.Err() != nil {
+			return budgetCause(ctx, ctx.Err())
+		}
 
 		if outputFunc != nil {
 			finished := outputFunc(resp.Message)
@@ -98,12 +285,60 @@ func (a *BaseAgent) Run(client *openai.Client, model string, outputFunc OutputFu
 				break
 			}
 		}
+		if budgetErr != nil {
+			log.Warn().Err(budgetErr).Msg("agent budget exhausted")
+			return budgetErr
+		}
 		if resp.FinishReason == openai.FinishReasonStop {
 			break
 		}
+		err = a.stats.check(a.budget)
+		if err != nil {
+			log.Warn().Err(err).Msg("agent budget exhausted")
+			return err
+		}
 	}
-	Writer.Flush()
 	return nil
 }
 
-var Writer *bufio.Writer
+// requestEvent records the input messages with the first request, the later requests only add
+// messages that are recorded as response and tool result events.
+func (a *BaseAgent) requestEvent(model string) trajectory.Event {
+	event := trajectory.Event{
+		Type:         trajectory.EventRequest,
+		Turn:         a.stats.turns + 1,
+		Model:        model,
+		MessageCount: len(a.input) + len(a.actionStack),
+	}
+	if a.stats.turns == 0 {
+		event.Messages = a.input
+		event.Tools = trajectory.ToolNames(a.toolDispatch.GetTools())
+	}
+	return event
+}
+
+func usageSince(before openai.Usage, after openai.Usage) *openai.Usage {
+	return &openai.Usage{
+		PromptTokens:     after.PromptTokens - before.PromptTokens,
+		CompletionTokens: after.CompletionTokens - before.CompletionTokens,
+		TotalTokens:      after.TotalTokens - before.TotalTokens,
+	}
+}
+
+// Cost returns the price of the usage of the last Run in USD.
+func (a *BaseAgent) Cost() float64 {
+	return a.cost(a.stats.usage)
+}
+
+func (a *BaseAgent) cost(usage openai.Usage) float64 {
+	return a.price.Cost(usage.PromptTokens, usage.CompletionTokens)
+}
+
+// budgetCause reports the budget error instead of a plain deadline error when the wall time budget ran out.
+func budgetCause(ctx context.Context, err error) error {
+	cause := context.Cause(ctx)
+	if errors.Is(cause, ErrBudgetExhausted) {
+		return cause
+	}
+	return err
+}
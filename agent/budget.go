@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"multi-agent/config"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+var ErrBudgetExhausted = errors.New("budget exhausted")
+
+// BudgetError is returned by BaseAgent.Run when the agent used up its budget before finishing.
+type BudgetError struct {
+	Reason string
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrBudgetExhausted, e.Reason)
+}
+
+func (e *BudgetError) Unwrap() error {
+	return ErrBudgetExhausted
+}
+
+// runStats is what the agent used during a single Run.
+type runStats struct {
+	start     time.Time
+	turns     int
+	toolCalls int
+	usage     openai.Usage
+}
+
+func (s *runStats) addUsage(usage openai.Usage) {
+	s.usage.PromptTokens += usage.PromptTokens
+	s.usage.CompletionTokens += usage.CompletionTokens
+	s.usage.TotalTokens += usage.TotalTokens
+}
+
+// check returns a BudgetError for the first exhausted limit.
+func (s *runStats) check(budget config.Budget) error {
+	switch {
+	case budget.MaxTurns > 0 && s.turns >= budget.MaxTurns:
+		return &BudgetError{Reason: fmt.Sprintf("reached max turns %d", budget.MaxTurns)}
+	case budget.MaxToolCalls > 0 && s.toolCalls >= budget.MaxToolCalls:
+		return &BudgetError{Reason: fmt.Sprintf("reached max tool calls %d", budget.MaxToolCalls)}
+	case budget.MaxPromptTokens > 0 && s.usage.PromptTokens >= budget.MaxPromptTokens:
+		return &BudgetError{Reason: fmt.Sprintf("used %d prompt tokens, max %d", s.usage.PromptTokens, budget.MaxPromptTokens)}
+	case budget.MaxCompletionTokens > 0 && s.usage.CompletionTokens >= budget.MaxCompletionTokens:
+		return &BudgetError{Reason: fmt.Sprintf("used %d completion tokens, max %d", s.usage.CompletionTokens, budget.MaxCompletionTokens)}
+	case budget.MaxWallTime > 0 && time.Since(s.start) >= time.Duration(budget.MaxWallTime):
+		return &BudgetError{Reason: fmt.Sprintf("ran longer than %s", time.Duration(budget.MaxWallTime))}
+	}
+	return nil
+}
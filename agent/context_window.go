@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"multi-agent/config"
+	"multi-agent/service"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// ErrContextWindow is returned by chat when the prompt does not fit the context window even after compaction,
+// it is classified like a context length error of the api without sending the request.
+var ErrContextWindow = errors.New("prompt exceeds the context window")
+
+// messageOverhead approximates the tokens of the role and the framing of a message.
+const messageOverhead = 4
+
+func messageTokens(msg openai.ChatCompletionMessage) int {
+	tokens := messageOverhead + service.EstimateTokens(msg.Content) + service.EstimateTokens(msg.ReasoningContent)
+	for _, call := range msg.ToolCalls {
+		tokens += messageOverhead + service.EstimateTokens(call.Function.Name) + service.EstimateTokens(call.Function.Arguments)
+	}
+	return tokens
+}
+
+func toolsTokens(tools []openai.Tool) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	data, _ := json.Marshal(tools)
+	return service.EstimateTokens(string(data))
+}
+
+var toolLogIDPattern = regexp.MustCompile(`^<ToolLogID>(\d+)</ToolLogID>`)
+
+// toolLogPointer tells the model where to find the full output of a tool message.
+func toolLogPointer(content string) string {
+	match := toolLogIDPattern.FindStringSubmatch(content)
+	if match == nil {
+		return "the full output is not available"
+	}
+	return fmt.Sprintf("call view_tool_log with ID %s to read the full output", match[1])
+}
+
+// truncateOutput keeps the head and the tail of a tool output longer than maxTokens.
+func truncateOutput(content string, maxTokens int) string {
+	maxBytes := maxTokens * 4
+	if len(content) <= maxBytes {
+		return content
+	}
+	head := service.TruncateUTF8(content, maxBytes*2/3)
+	tail := service.TruncateUTF8Tail(content, maxBytes/3)
+	omitted := service.EstimateTokens(content[len(head) : len(content)-len(tail)])
+	return fmt.Sprintf("%s\n... [%d tokens truncated, %s] ...\n%s", head, omitted, toolLogPointer(content), tail)
+}
+
+// SetContext keeps the prompt inside the window of the model, a window of 0 only truncates the tool outputs.
+func (a *BaseAgent) SetContext(window int, cfg config.Context) {
+	a.window = window
+	a.context = cfg
+}
+
+// fitContext compacts the messages before a chat completion: tool outputs longer than MaxToolOutput
+// are truncated, then the oldest tool outputs are dropped until the prompt fits the window. The
+// outputs after the last assistant message are kept, the model has not seen them yet. Dropped and
+// truncated outputs point to their tool log, the full outputs stay in the tool log.
+func (a *BaseAgent) fitContext(msgs []openai.ChatCompletionMessage, tools []openai.Tool) ([]openai.ChatCompletionMessage, error) {
+	if a.context.MaxToolOutput > 0 {
+		for i, msg := range msgs {
+			if msg.Role == openai.ChatMessageRoleTool {
+				msgs[i].Content = truncateOutput(msg.Content, a.context.MaxToolOutput)
+			}
+		}
+	}
+	if a.window <= 0 {
+		return msgs, nil
+	}
+	limit := a.window - a.context.Reserve - toolsTokens(tools)
+	total := 0
+	lastAssistant := 0
+	for i, msg := range msgs {
+		total += messageTokens(msg)
+		if msg.Role == openai.ChatMessageRoleAssistant {
+			lastAssistant = i
+		}
+	}
+	dropped := 0
+	for i := 0; i < lastAssistant && total > limit; i++ {
+		if msgs[i].Role != openai.ChatMessageRoleTool {
+			continue
+		}
+		stub := fmt.Sprintf("[output dropped to fit the context window, %s]", toolLogPointer(msgs[i].Content))
+		if len(stub) >= len(msgs[i].Content) {
+			continue
+		}
+		total -= service.EstimateTokens(msgs[i].Content) - service.EstimateTokens(stub)
+		msgs[i].Content = stub
+		dropped++
+	}
+	if dropped != 0 {
+		log.Warn().Any("agent", a.name).Any("dropped", dropped).Any("tokens", total).Msg("drop old tool outputs to fit the context window")
+	}
+	if total > limit {
+		return nil, fmt.Errorf("%w: the prompt needs about %d tokens, %d are available", ErrContextWindow, total, limit)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"multi-agent/config"
+	"multi-agent/trajectory"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+type ErrorClass int
+
+const (
+	// ErrorFatal is not worth retrying, e.g. a bad request or an invalid api key.
+	ErrorFatal ErrorClass = iota
+	// ErrorTransient covers 5xx responses, timeouts and dropped connections.
+	ErrorTransient
+	// ErrorRateLimit is a 429 response, the server may tell how long to wait.
+	ErrorRateLimit
+	// ErrorContextLength means the prompt does not fit the model, retrying the same request is useless.
+	ErrorContextLength
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorTransient:
+		return "transient"
+	case ErrorRateLimit:
+		return "rate limit"
+	case ErrorContextLength:
+		return "context length exceeded"
+	default:
+		return "fatal"
+	}
+}
+
+// LLMError is returned by BaseAgent.Run when a chat completion failed for good.
+type LLMError struct {
+	Class    ErrorClass
+	Attempts int
+	Err      error
+}
+
+func (e *LLMError) Error() string {
+	return fmt.Sprintf("chat completion failed (%s) after %d attempts: %s", e.Class, e.Attempts, e.Err)
+}
+
+func (e *LLMError) Unwrap() error {
+	return e.Err
+}
+
+// IsContextLength reports whether err is a chat completion rejected for exceeding the context window.
+func IsContextLength(err error) bool {
+	var llmErr *LLMError
+	return errors.As(err, &llmErr) && llmErr.Class == ErrorContextLength
+}
+
+var contextLengthHints = []string{
+	"context_length_exceeded",
+	"context length",
+	"maximum context",
+	"prompt is too long",
+	"too many tokens",
+	"input is too long",
+}
+
+func isContextLengthMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, hint := range contextLengthHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyStatus(code int, msg string) ErrorClass {
+	switch {
+	case code == http.StatusTooManyRequests:
+		if strings.Contains(msg, "insufficient_quota") {
+			return ErrorFatal
+		}
+		return ErrorRateLimit
+	case code == http.StatusRequestTimeout || code >= 500:
+		return ErrorTransient
+	case isContextLengthMessage(msg):
+		return ErrorContextLength
+	default:
+		return ErrorFatal
+	}
+}
+
+// ClassifyError decides whether a chat completion error is worth retrying.
+func ClassifyError(err error) ErrorClass {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return classifyStatus(apiErr.HTTPStatusCode, fmt.Sprintf("%v %s %s", apiErr.Code, apiErr.Type, apiErr.Message))
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return classifyStatus(reqErr.HTTPStatusCode, string(reqErr.Body))
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrContextWindow):
+		return ErrorContextLength
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTransient
+	case errors.As(err, &netErr):
+		return ErrorTransient
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorTransient
+	}
+	return ErrorFatal
+}
+
+// backoff returns the delay before the given retry attempt (starting from 1), exponential with jitter.
+// A MaxDelay of 0 does not cap the delay.
+func backoff(policy config.Retry, attempt int) time.Duration {
+	delay := time.Duration(policy.BaseDelay) << (attempt - 1)
+	if maxDelay := time.Duration(policy.MaxDelay); maxDelay > 0 && (delay <= 0 || delay > maxDelay) {
+		delay = maxDelay
+	}
+	half := max(delay/2, 0)
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryDelay returns the delay before the retry attempt, after is the Retry-After of the server. The
+// server knows best, but a far Retry-After must not park the agent beyond a MaxDelay above 0.
+func retryDelay(policy config.Retry, attempt int, after time.Duration) time.Duration {
+	if after <= 0 {
+		return backoff(policy, attempt)
+	}
+	if maxDelay := time.Duration(policy.MaxDelay); maxDelay > 0 {
+		return min(after, maxDelay)
+	}
+	return after
+}
+
+type retryAfterKey struct{}
+
+// retryHint carries the Retry-After header of the last response back to the retry loop.
+type retryHint struct {
+	after time.Duration
+}
+
+// RetryAfterTransport records the Retry-After header of 429 and 503 responses for the retry loop,
+// go-openai does not expose the response headers in its errors.
+type RetryAfterTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *RetryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	hint, ok := req.Context().Value(retryAfterKey{}).(*retryHint)
+	if ok && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		hint.after = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, nil
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// chatWithRetry retries transient and rate limit errors of chat, other errors are returned as LLMError at once.
+func (a *BaseAgent) chatWithRetry(ctx context.Context, client *openai.Client, model string) (*openai.ChatCompletionChoice, error) {
+	policy := a.retry
+	for attempt := 1; ; attempt++ {
+		hint := &retryHint{}
+		resp, err := a.chat(context.WithValue(ctx, retryAfterKey{}, hint), client, model)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// cancelled by the caller, not a failure of the api
+			return nil, err
+		}
+		class := ClassifyError(err)
+		a.record(trajectory.Event{Type: trajectory.EventError, Turn: a.stats.turns + 1, Error: fmt.Sprintf("attempt %d (%s): %s", attempt, class, err)})
+		if (class != ErrorTransient && class != ErrorRateLimit) || attempt >= policy.MaxAttempts {
+			return nil, &LLMError{Class: class, Attempts: attempt, Err: err}
+		}
+		delay := retryDelay(policy, attempt, hint.after)
+		log.Warn().Err(err).Any("class", class.String()).Any("attempt", attempt).Any("delay", delay).Msg("chat failed, retry")
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
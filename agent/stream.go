@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// StreamHandler receives the incremental output of a streaming chat turn.
+type StreamHandler interface {
+	OnContent(delta string)
+	OnReasoning(delta string)
+	// OnToolCall is called once a tool call name is known and again for every arguments delta.
+	OnToolCall(index int, name string, argsDelta string)
+	// OnMessage is called with the assembled message at the end of the turn.
+	OnMessage(msg openai.ChatCompletionMessage)
+}
+
+// chatStream is the streaming version of chat, the returned choice is assembled from all the deltas.
+func (a *BaseAgent) chatStream(ctx context.Context, client *openai.Client, req openai.ChatCompletionRequest) (*openai.ChatCompletionChoice, error) {
+	req.Stream = true
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	stream, err := client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	acc := newStreamAccumulator(a.stream)
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Usage != nil {
+			a.stats.addUsage(*chunk.Usage)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+			acc.add(choice)
+		}
+	}
+	choice := acc.choice()
+	if a.stream != nil {
+		a.stream.OnMessage(choice.Message)
+	}
+	return choice, nil
+}
+
+type streamAccumulator struct {
+	handler      StreamHandler
+	content      strings.Builder
+	reasoning    strings.Builder
+	toolCalls    []openai.ToolCall
+	finishReason openai.FinishReason
+}
+
+func newStreamAccumulator(handler StreamHandler) *streamAccumulator {
+	return &streamAccumulator{handler: handler}
+}
+
+func (acc *streamAccumulator) add(choice openai.ChatCompletionStreamChoice) {
+	delta := choice.Delta
+	if delta.Content != "" {
+		acc.content.WriteString(delta.Content)
+		if acc.handler != nil {
+			acc.handler.OnContent(delta.Content)
+		}
+	}
+	if delta.ReasoningContent != "" {
+		acc.reasoning.WriteString(delta.ReasoningContent)
+		if acc.handler != nil {
+			acc.handler.OnReasoning(delta.ReasoningContent)
+		}
+	}
+	for _, call := range delta.ToolCalls {
+		acc.addToolCall(call)
+	}
+	if choice.FinishReason != "" {
+		acc.finishReason = choice.FinishReason
+	}
+}
+
+// addToolCall merges a tool call delta, the first delta of a call carries the id and name
+// and the following ones only carry pieces of the arguments.
+func (acc *streamAccumulator) addToolCall(delta openai.ToolCall) {
+	index := len(acc.toolCalls) - 1
+	if delta.Index != nil {
+		index = *delta.Index
+	} else if delta.ID != "" || index < 0 {
+		index = len(acc.toolCalls)
+	}
+	for len(acc.toolCalls) <= index {
+		acc.toolCalls = append(acc.toolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+	}
+	call := &acc.toolCalls[index]
+	if delta.ID != "" {
+		call.ID = delta.ID
+	}
+	if delta.Type != "" {
+		call.Type = delta.Type
+	}
+	if delta.Function.Name != "" && call.Function.Name == "" {
+		call.Function.Name = delta.Function.Name
+	}
+	call.Function.Arguments += delta.Function.Arguments
+	if acc.handler != nil && (delta.Function.Name != "" || delta.Function.Arguments != "") {
+		acc.handler.OnToolCall(index, call.Function.Name, delta.Function.Arguments)
+	}
+}
+
+func (acc *streamAccumulator) choice() *openai.ChatCompletionChoice {
+	msg := openai.ChatCompletionMessage{
+		Role:             openai.ChatMessageRoleAssistant,
+		Content:          acc.content.String(),
+		ReasoningContent: acc.reasoning.String(),
+	}
+	for i, call := range acc.toolCalls {
+		if call.ID == "" {
+			call.ID = fmt.Sprintf("call_%d", i)
+		}
+		// the index only orders the deltas, the message is sent back with the next request
+		call.Index = nil
+		msg.ToolCalls = append(msg.ToolCalls, call)
+	}
+	return &openai.ChatCompletionChoice{
+		Index:        0,
+		Message:      msg,
+		FinishReason: acc.finishReason,
+	}
+}
+
+// terminalMu serialises the lines of the agents sharing a terminal.
+var terminalMu sync.Mutex
+
+// TerminalStream prints the streamed output of an agent to a terminal. The output is buffered until
+// the end of a line and every line is prefixed with the agent name, the lines of parallel agents
+// sharing the terminal do not mix.
+type TerminalStream struct {
+	mu       sync.Mutex
+	out      io.Writer
+	prefix   string
+	line     strings.Builder
+	lastCall int
+}
+
+func NewTerminalStream(out io.Writer, prefix string) *TerminalStream {
+	return &TerminalStream{
+		out:      out,
+		prefix:   prefix,
+		lastCall: -1,
+	}
+}
+
+// write buffers the text and prints the lines it completes, called with mu held.
+func (s *TerminalStream) write(text string) {
+	for {
+		before, after, found := strings.Cut(text, "\n")
+		s.line.WriteString(before)
+		if !found {
+			return
+		}
+		s.flush()
+		text = after
+	}
+}
+
+// flush prints the buffered line, called with mu held.
+func (s *TerminalStream) flush() {
+	if s.line.Len() == 0 {
+		return
+	}
+	terminalMu.Lock()
+	fmt.Fprintf(s.out, "[%s] %s\n", s.prefix, s.line.String())
+	terminalMu.Unlock()
+	s.line.Reset()
+}
+
+func (s *TerminalStream) OnContent(delta string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(delta)
+}
+
+func (s *TerminalStream) OnReasoning(delta string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(delta)
+}
+
+func (s *TerminalStream) OnToolCall(index int, name string, argsDelta string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index != s.lastCall {
+		s.lastCall = index
+		s.flush()
+		s.line.WriteString(fmt.Sprintf("tool call %s: ", name))
+	}
+	s.write(argsDelta)
+}
+
+func (s *TerminalStream) OnMessage(msg openai.ChatCompletionMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCall = -1
+	s.flush()
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"multi-agent/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+type recordStream struct {
+	content  strings.Builder
+	toolArgs strings.Builder
+	messages int
+}
+
+func (r *recordStream) OnContent(delta string)   { r.content.WriteString(delta) }
+func (r *recordStream) OnReasoning(delta string) {}
+func (r *recordStream) OnToolCall(index int, name string, argsDelta string) {
+	r.toolArgs.WriteString(argsDelta)
+}
+func (r *recordStream) OnMessage(msg openai.ChatCompletionMessage) { r.messages++ }
+
+func TestBaseAgent_chatStream(t *testing.T) {
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","content":"Let me "}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"look."}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"bash","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"Command\":"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"finish_explore_task","arguments":"{}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"ls\"}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = server.URL
+	client := openai.NewClientWithConfig(clientConfig)
+
+	agent := NewBaseAgent("system", "user", service.NewToolDispatcher(nil), nil)
+	handler := &recordStream{}
+	agent.SetStream(handler)
+	choice, err := agent.chat(context.Background(), client, "test-model")
+	if err != nil {
+		t.Fatalf("chat stream failed: %v", err)
+	}
+	msg := choice.Message
+	if msg.Content != "Let me look." || handler.content.String() != msg.Content {
+		t.Errorf("unexpected content %q, streamed %q", msg.Content, handler.content.String())
+	}
+	if len(msg.ToolCalls) != 2 {
+		t.Fatalf("expect 2 tool calls, got %d", len(msg.ToolCalls))
+	}
+	if msg.ToolCalls[0].ID != "call_a" || msg.ToolCalls[0].Function.Name != "bash" || msg.ToolCalls[0].Function.Arguments != `{"Command":"ls"}` {
+		t.Errorf("unexpected first tool call %+v", msg.ToolCalls[0])
+	}
+	if msg.ToolCalls[1].Function.Name != "finish_explore_task" {
+		t.Errorf("unexpected second tool call %+v", msg.ToolCalls[1])
+	}
+	for _, call := range msg.ToolCalls {
+		if call.Index != nil {
+			t.Errorf("expect no stream index in the assembled tool call %s", call.ID)
+		}
+	}
+	if choice.FinishReason != openai.FinishReasonToolCalls || handler.messages != 1 {
+		t.Errorf("unexpected finish reason %s or message count %d", choice.FinishReason, handler.messages)
+	}
+}
+
+func TestTerminalStream(t *testing.T) {
+	var out strings.Builder
+	explore := NewTerminalStream(&out, "explore#1")
+	build := NewTerminalStream(&out, "build#2")
+	explore.OnContent("Let me ")
+	build.OnContent("Editing\nmain")
+	explore.OnContent("look.\n")
+	build.OnToolCall(0, "bash", `{"Command":`)
+	build.OnToolCall(0, "bash", `"ls"}`)
+	explore.OnReasoning("done")
+	explore.OnMessage(openai.ChatCompletionMessage{})
+	build.OnMessage(openai.ChatCompletionMessage{})
+	want := "[build#2] Editing\n" +
+		"[explore#1] Let me look.\n" +
+		"[build#2] main\n" +
+		"[explore#1] done\n" +
+		"[build#2] tool call bash: {\"Command\":\"ls\"}\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
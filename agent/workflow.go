@@ -1,12 +1,20 @@
 package agent
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"multi-agent/config"
 	mcpclient "multi-agent/mcp-client"
+	"multi-agent/prompts"
+	"multi-agent/protocol"
 	"multi-agent/service"
+	"multi-agent/trajectory"
+	"multi-agent/usage"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
@@ -14,25 +22,90 @@ import (
 
 type Workflow struct {
 	mcpclient *mcpclient.ClientMgr
-	client    *openai.Client
+	config    *config.Config
+	clients   map[string]*openai.Client
 
-	toolDispatcher *service.ToolDispatcher
+	// toolLog records the tool calls of all agents, each agent has its own tool dispatcher on top of it
+	toolLog *service.ToolLog
 
 	taskMgr *service.TaskMgr
+	// prompts renders the system prompts, Prepare adds the override directory and the config task types
+	prompts *prompts.Library
+	// usage collects the usage of the agents of the running user task
+	usage *usage.Tracker
+
+	mu         sync.Mutex
+	cancelTask context.CancelFunc
+
+	resumed bool
+	conn    *protocol.Conn
+
+	trajectory *trajectory.Recorder
+	trajPath   string
+	// trajJSON is written in the mini-swe-agent format after every user task when set.
+	trajJSON string
 }
 
-func NewWorkFlow() *Workflow {
+// NewWorkFlow creates a workflow serving the driver on the other end of conn.
+func NewWorkFlow(cfg *config.Config, conn *protocol.Conn) *Workflow {
 	w := &Workflow{
-		toolDispatcher: &service.ToolDispatcher{},
+		config:  cfg,
+		clients: map[string]*openai.Client{},
+		toolLog: service.NewToolLog(),
+		prompts: prompts.Embedded(),
+		usage:   usage.NewTracker(),
+		conn:    conn,
 	}
 	w.taskMgr = &service.TaskMgr{
-		ToolDispatcher: w.toolDispatcher,
+		ToolLog:       w.toolLog,
+		HistoryTokens: cfg.Context.History,
+		MaxFixCycles:  cfg.MaxFixCycles,
+		MaxDepth:      max(cfg.MaxTaskDepth, 0),
 	}
+	w.taskMgr.RunSubtask = w.runSubtask
 	return w
 }
 
+// SetTrajectory appends the events of the agents and the task transitions to the JSONL file at path.
+// When trajJSON is set every user task is also exported there in the mini-swe-agent format.
+func (w *Workflow) SetTrajectory(path string, trajJSON string) error {
+	recorder, err := trajectory.Create(path)
+	if err != nil {
+		return err
+	}
+	w.trajectory = recorder
+	w.taskMgr.Trajectory = recorder
+	w.trajPath = path
+	w.trajJSON = trajJSON
+	return nil
+}
+
+// SetCheckpoint makes the task manager write its state to path after every task transition.
+func (w *Workflow) SetCheckpoint(path string) {
+	w.taskMgr.CheckpointPath = path
+}
+
+// Resume restores the task manager from the checkpoint, Run continues the restored user goal
+// before reading new tasks.
+func (w *Workflow) Resume(path string) error {
+	err := w.taskMgr.LoadCheckpoint(path)
+	if err != nil {
+		return fmt.Errorf("resume from checkpoint %s failed: %w", path, err)
+	}
+	w.resumed = true
+	log.Info().Any("checkpoint", path).Any("finished tasks", len(w.taskMgr.PreTasks)).Msg("resume workflow")
+	return nil
+}
+
 func (w *Workflow) Close() error {
-	err := w.mcpclient.Close()
+	err := w.trajectory.Close()
+	if err != nil {
+		return err
+	}
+	if w.mcpclient == nil {
+		return nil
+	}
+	err = w.mcpclient.Close()
 	if err != nil {
 		return err
 	}
@@ -40,66 +113,451 @@ func (w *Workflow) Close() error {
 }
 
 func (w *Workflow) Init() error {
-	apiKey := os.Getenv("API_KEY")
-	if apiKey == "" {
-		return fmt.Errorf("api key API_KEY not set")
+	err := w.config.Validate()
+	if err != nil {
+		return err
+	}
+	for _, role := range w.config.AgentRoles() {
+		_, _, err := w.llm(role)
+		if err != nil {
+			return err
+		}
 	}
-	config := openai.DefaultConfig(apiKey)
-	config.BaseURL = "https://open.bigmodel.cn/api/paas/v4"
-	w.client = openai.NewClientWithConfig(config)
 	log.Info().Msg("create openai client success")
+	err = w.Prepare()
+	if err != nil {
+		return err
+	}
 
-	// w.mcpclient = mcpclient.NewclientMgr()
-	// err := w.mcpclient.NewMCPClient("uv", nil, "run", "/root/multi-agent/cmds/lsp-mcp.py")
-	// if err != nil {
-	// 	return err
-	// }
-	// log.Info().Any("server", "lsp-mcp").Msg("create mcp client success")
-
-	// err = w.mcpclient.NewMCPClient("/root/multi-agent/bin/mcpserver", nil)
-	// if err != nil {
-	// 	return err
-	// }
-	// log.Info().Any("server", "mcpserver").Msg("create mcp client success")
+	executor, err := w.newExecutor()
+	if err != nil {
+		return err
+	}
+	w.taskMgr.Executor = executor
+	log.Info().Any("executor", w.config.Executor.Type).Msg("create bash executor success")
 	return nil
 }
 
-func (w *Workflow) Run() error {
+// Prepare registers the task types of the config and loads the prompt templates, Init calls it.
+// A prepared workflow renders prompts with RenderPrompt without any client or executor.
+func (w *Workflow) Prepare() error {
+	for _, taskType := range w.config.TaskTypes {
+		def, err := service.NewConfigTaskDef(taskType)
+		if err != nil {
+			return err
+		}
+		err = w.taskMgr.RegisterTaskDef(def)
+		if err != nil {
+			return err
+		}
+	}
+	w.taskMgr.Rules = nil
+	for _, name := range w.config.TaskRules {
+		rule, ok := service.LookupTaskRule(name)
+		if !ok {
+			return fmt.Errorf("unknown task rule %q", name)
+		}
+		w.taskMgr.Rules = append(w.taskMgr.Rules, rule)
+	}
+	for _, def := range w.taskMgr.TaskDefs() {
+		for _, name := range def.Subtasks {
+			if _, ok := w.taskMgr.LookupTaskDef(name); !ok {
+				return fmt.Errorf("task type %s delegates to unknown task type %q", def.Name, name)
+			}
+		}
+	}
+	lib, err := prompts.Load(w.config.PromptDir)
+	if err != nil {
+		return err
+	}
+	for _, def := range w.taskMgr.TaskDefs() {
+		if def.Prompt == "" {
+			continue
+		}
+		err = lib.SetDefault(def.Name, def.Prompt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range lib.Names() {
+		log.Debug().Any("prompt", name).Any("source", lib.Source(name)).Any("version", lib.Version(name)).Msg("load prompt")
+	}
+	w.prompts = lib
+	return nil
+}
+
+func (w *Workflow) newExecutor() (service.BashExecutor, error) {
+	cfg := w.config.Executor
+	switch cfg.Type {
+	case config.ExecutorLocal:
+		return service.NewLocalExecutor(cfg.RepoPath)
+	case config.ExecutorMCP:
+		if w.mcpclient == nil {
+			w.mcpclient = mcpclient.NewclientMgr()
+		}
+		err := w.mcpclient.NewMCPClient(context.Background(), cfg.MCPCommand, nil, cfg.MCPArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("start mcp server %s failed: %w", cfg.MCPCommand, err)
+		}
+		return mcpclient.NewBashExecutor(w.mcpclient, cfg.MCPServer), nil
+	default:
+		return service.NewRemoteExecutor(w.conn), nil
+	}
+}
+
+// llm returns the client and model name configured for the role, clients are shared per provider.
+func (w *Workflow) llm(role string) (*openai.Client, string, error) {
+	model, provider, err := w.config.Resolve(role)
+	if err != nil {
+		return nil, "", err
+	}
+	client, exist := w.clients[model.Provider]
+	if !exist {
+		key, err := provider.Key()
+		if err != nil {
+			return nil, "", err
+		}
+		clientConfig := openai.DefaultConfig(key)
+		clientConfig.BaseURL = provider.BaseURL
+		clientConfig.HTTPClient = &http.Client{Transport: &RetryAfterTransport{}}
+		if provider.Replay != "" {
+			replayer, err := trajectory.LoadReplayer(provider.Replay)
+			if err != nil {
+				return nil, "", err
+			}
+			if provider.BaseURL == "" {
+				clientConfig.BaseURL = "http://replay/v1"
+			}
+			clientConfig.HTTPClient = &http.Client{Transport: replayer}
+		}
+		client = openai.NewClientWithConfig(clientConfig)
+		w.clients[model.Provider] = client
+		log.Info().Any("provider", model.Provider).Any("base url", clientConfig.BaseURL).Any("replay", provider.Replay).Msg("create openai client")
+	}
+	return client, model.Model, nil
+}
+
+// runAgent runs the agent with the model configured for the role, task is the task of a worker.
+func (w *Workflow) runAgent(ctx context.Context, role string, task service.Task, agent *BaseAgent, outputFunc OutputFunc) error {
+	client, model, err := w.llm(role)
+	if err != nil {
+		return err
+	}
+	spec, _, _ := w.config.Resolve(role)
+	agent.SetTimeouts(time.Duration(w.config.Timeouts.Turn), time.Duration(w.config.Timeouts.Tool))
+	agent.SetBudget(w.config.BudgetFor(role))
+	agent.SetRetry(w.config.Retry)
+	agent.SetParallelTools(w.config.ParallelTools)
+	agent.SetPrice(w.config.PriceFor(spec))
+	agent.SetContext(w.config.WindowFor(spec), w.config.Context)
+	record := usage.Record{Agent: role, Role: role, Model: spec.Provider + "/" + model}
+	if task != nil {
+		record.Agent = fmt.Sprintf("%s#%d", role, task.Base().ID)
+		record.Task = task.Base().ID
+		record.TaskType = service.TaskType(task)
+	}
+	if spec.Streams() {
+		// parallel workers share the terminal, the agent name tells their lines apart
+		agent.SetStream(NewTerminalStream(os.Stderr, record.Agent))
+	}
+	agent.SetTrajectory(w.trajectory, record.Agent, role)
+	err = agent.Run(ctx, client, model, outputFunc)
+	record.Usage = agent.Usage()
+	record.Cost = agent.Cost()
+	record.Calls = agent.stats.turns
+	w.usage.Add(record)
+	return err
+}
+
+// Interrupt aborts the running user task, the workflow then waits for the next task.
+// It returns false if no task is running.
+func (w *Workflow) Interrupt() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancelTask == nil {
+		return false
+	}
+	w.cancelTask()
+	return true
+}
+
+func (w *Workflow) taskContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if w.config.Timeouts.Task > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(w.config.Timeouts.Task))
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	w.mu.Lock()
+	w.cancelTask = cancel
+	w.mu.Unlock()
+	return ctx, func() {
+		w.mu.Lock()
+		w.cancelTask = nil
+		w.mu.Unlock()
+		cancel()
+	}
+}
+
+// Run serves the tasks of the driver until the connection is closed or ctx is done.
+func (w *Workflow) Run(ctx context.Context) error {
+	if w.resumed {
+		w.resumed = false
+		result := w.runUserTask(ctx)
+		// nobody asked for the resumed task, the result is sent without reply_to
+		_, err := w.conn.Send(protocol.TypeResult, result)
+		if err != nil {
+			return err
+		}
+	}
 	for {
-		scanner := bufio.NewScanner(os.Stdin)
-		var input struct {
-			Task string
+		env, err := w.conn.Receive(ctx)
+		if err != nil {
+			return fmt.Errorf("receive from driver failed: %w", err)
 		}
-		if !scanner.Scan() {
-			return fmt.Errorf("can not read from stdin")
+		switch env.Type {
+		case protocol.TypeHello:
+			err = w.conn.Reply(env, protocol.TypeHello, protocol.Hello{Name: "multi-agent", Versions: []int{protocol.Version}})
+		case protocol.TypeTask:
+			var input protocol.Task
+			err = env.Decode(&input)
+			if err != nil {
+				log.Error().Err(err).Msg("parse input task failed")
+				err = w.conn.ReplyError(env, protocol.CodeBadRequest, err)
+				break
+			}
+			w.taskMgr.Reset(input.Task)
+			result := w.runUserTask(ctx)
+			err = w.conn.Reply(env, protocol.TypeResult, result)
+		default:
+			err = w.conn.ReplyError(env, protocol.CodeUnsupported, fmt.Errorf("agent does not handle %s messages", env.Type))
+		}
+		if err != nil {
+			return fmt.Errorf("send to driver failed: %w", err)
 		}
-		line := scanner.Text() // Automatically trims the newline
-		err := json.Unmarshal([]byte(line), &input)
+	}
+}
+
+func (w *Workflow) runUserTask(ctx context.Context) protocol.Result {
+	log.Info().Msg("agent start running")
+	start := time.Now()
+	w.trajectory.SetRun(start.UTC().Format("20060102T150405.000"))
+	w.trajectory.Record(trajectory.Event{Type: trajectory.EventRunStart, Goal: w.taskMgr.UserGoal})
+	w.usage.Reset()
+
+	result := w.runTaskResult(ctx)
+
+	total := w.usage.Total()
+	w.trajectory.Record(trajectory.Event{
+		Type:       trajectory.EventRunEnd,
+		Result:     &trajectory.RunResult{Status: result.Status, Response: result.Response, Error: result.Error},
+		Usage:      &total.Usage,
+		Cost:       total.Cost,
+		DurationMs: trajectory.Since(start),
+	})
+	// stdout may be the protocol connection, the summary goes next to the log
+	fmt.Fprint(os.Stderr, w.usage.Summary())
+	if w.trajJSON != "" {
+		err := trajectory.WriteMiniSWE(w.trajPath, w.trajJSON, "")
+		if err != nil {
+			log.Error().Err(err).Any("path", w.trajJSON).Msg("export trajectory failed")
+		}
+	}
+	log.Info().Msg("agent finish running")
+	return result
+}
+
+func (w *Workflow) runTaskResult(ctx context.Context) protocol.Result {
+	taskCtx, cancel := w.taskContext(ctx)
+	defer cancel()
+	res, err := w.runTask(taskCtx)
+	switch {
+	case taskCtx.Err() != nil:
+		return protocol.Result{Status: protocol.StatusCancelled, Error: taskCtx.Err().Error()}
+	case err != nil:
+		return protocol.Result{Status: protocol.StatusFailed, Error: err.Error()}
+	default:
+		return protocol.Result{Status: protocol.StatusDone, Response: res}
+	}
+}
+
+// maxPlanRounds bounds the plans the orchestrator writes for a driver rejecting them.
+const maxPlanRounds = 3
+
+// planTask lets the orchestrator write the plan of the user goal before the first task when the plan
+// mode is on, with ApprovePlan the driver approves, edits or rejects it before any task runs. A task
+// resumed with an approved plan keeps it.
+func (w *Workflow) planTask(ctx context.Context) error {
+	if !w.config.Plan && !w.config.ApprovePlan {
+		return nil
+	}
+	feedback := ""
+	for round := 1; ; round++ {
+		plan := w.taskMgr.GetPlan()
+		if plan == nil || feedback != "" {
+			err := w.PlannerAgent(ctx, feedback)
+			if err != nil {
+				return err
+			}
+			plan = w.taskMgr.GetPlan()
+		}
+		if !w.config.ApprovePlan || plan.Approved {
+			return nil
+		}
+		decision, err := w.approvePlan(ctx, plan)
 		if err != nil {
-			log.Error().Err(err).Msg("parse input task failed")
 			return err
 		}
-		w.taskMgr.Reset(input.Task)
+		if decision.Approved {
+			var steps []service.PlanStep
+			for _, step := range decision.Steps {
+				steps = append(steps, service.PlanStep{Type: step.Type, Goal: step.Goal, ExpectOutput: step.ExpectOutput})
+			}
+			return w.taskMgr.ApprovePlan(steps)
+		}
+		feedback = decision.Feedback
+		if feedback == "" {
+			feedback = "no reason given"
+		}
+		log.Info().Any("round", round).Any("feedback", feedback).Msg("plan rejected")
+		if round >= maxPlanRounds {
+			return fmt.Errorf("the driver rejected %d plans, the last one with: %s", round, feedback)
+		}
+	}
+}
 
-		log.Info().Msg("agent start running")
-		for {
-			res, err := w.OrchestratorAgent()
+// approvePlan asks the driver about the plan, a driver that does not handle plans approves it.
+func (w *Workflow) approvePlan(ctx context.Context, plan *service.Plan) (protocol.PlanDecision, error) {
+	if w.conn == nil {
+		return protocol.PlanDecision{Approved: true}, nil
+	}
+	req := protocol.PlanRequest{Task: w.taskMgr.UserGoal, Revision: plan.Revision}
+	for _, step := range plan.Steps {
+		req.Steps = append(req.Steps, protocol.PlanStep{Type: step.Type, Goal: step.Goal, ExpectOutput: step.ExpectOutput})
+	}
+	reply, err := w.conn.Call(ctx, protocol.TypePlan, req)
+	var remoteErr *protocol.RemoteError
+	if errors.As(err, &remoteErr) && remoteErr.Code == protocol.CodeUnsupported {
+		log.Warn().Err(err).Msg("the driver does not approve plans, run the plan as written")
+		return protocol.PlanDecision{Approved: true}, nil
+	}
+	if err != nil {
+		return protocol.PlanDecision{}, fmt.Errorf("ask the driver to approve the plan failed: %w", err)
+	}
+	var decision protocol.PlanDecision
+	err = reply.Decode(&decision)
+	return decision, err
+}
+
+// runTask alternates the orchestrator and the workers until the orchestrator returns the final response.
+func (w *Workflow) runTask(ctx context.Context) (string, error) {
+	err := w.planTask(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("plan the user task failed")
+		return "", err
+	}
+	for {
+		err := w.usage.Check(w.config.RunBudget)
+		if err != nil {
+			return "", &BudgetError{Reason: err.Error()}
+		}
+		// a resumed task may stop with pending tasks, finish them before asking the orchestrator
+		if len(w.taskMgr.Pending) == 0 {
+			res, err := w.OrchestratorAgent(ctx)
 			if err != nil {
 				log.Error().Err(err).Msg("run orchestrator agent failed")
-				break
+				return "", err
 			}
 			if res != "" {
-				println("DONE")
-				// fmt.Printf("Final Response:\n%s\n", res)
-				break
+				return res, nil
+			}
+		}
+		err = w.runPending(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the workers were aborted, their tasks are merged as abandoned
+				w.taskMgr.AbortPending()
+			}
+			log.Error().Err(err).Msg("run worker agent failed")
+			return "", err
+		}
+	}
+}
+
+// runPending runs the pending tasks in waves: the ready tasks run in parallel, each worker with its own
+// tool dispatcher on the shared tool log, then their results are merged in ID order, which is a dependency order.
+func (w *Workflow) runPending(ctx context.Context) error {
+	for len(w.taskMgr.Pending) != 0 {
+		ready := w.taskMgr.ReadyTasks()
+		if len(ready) == 0 {
+			// unreachable as long as tasks only depend on earlier tasks, fail them instead of looping forever
+			for _, task := range w.taskMgr.Pending {
+				w.taskMgr.FailTask(task, "the dependencies of the task can not be satisfied")
+				w.taskMgr.MergeTask(task)
 			}
-			err = w.WorkerAgent()
+			return nil
+		}
+		log.Info().Any("tasks", len(ready)).Msg("run ready tasks")
+
+		// start all tasks before the first worker, a failed start leaves no worker running
+		for _, task := range ready {
+			err := w.taskMgr.StartTask(task)
 			if err != nil {
-				log.Error().Err(err).Msg("run worker agent failed")
-				break
+				return err
+			}
+		}
+		dispatchers := make([]*service.ToolDispatcher, len(ready))
+		errs := make([]error, len(ready))
+		var wg sync.WaitGroup
+		for i, task := range ready {
+			dispatchers[i] = service.NewToolDispatcher(w.toolLog)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = w.WorkerAgent(ctx, task, dispatchers[i])
+			}()
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			// the workers may have returned in time, the error makes runTask abandon their tasks
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+
+		for i, task := range ready {
+			err := errs[i]
+			if IsContextLength(err) {
+				// the task does not fit the model, let the orchestrator split it instead of giving up
+				log.Warn().Err(err).Any("task", task.Base().ID).Msg("worker exceeded the context window")
+				err = w.taskMgr.FailTask(task, "the task context exceeded the model context window, create narrower tasks")
+			} else if err != nil {
+				// the orchestrator sees the error in the task history and may retry the task
+				log.Warn().Err(err).Any("task", task.Base().ID).Msg("worker failed")
+				err = nil
+				if !w.taskMgr.IsFinished(task) {
+					err = w.taskMgr.FailTask(task, fmt.Sprintf("the worker failed: %s", errs[i]))
+				}
 			}
-			// w.ContextAgent()
+			if err != nil {
+				return fmt.Errorf("worker of task #%d failed: %w", task.Base().ID, err)
+			}
+			err = w.taskMgr.MergeTask(task)
+			if err != nil {
+				return err
+			}
+			w.refineContext(ctx, task)
 		}
-		log.Info().Msg("agent finish running")
+	}
+	return nil
+}
+
+// refineContext runs the context agent on the merged task when enabled, a failed refinement
+// only keeps the context as the worker left it.
+func (w *Workflow) refineContext(ctx context.Context, task service.Task) {
+	if !w.config.RefineContext || len(service.TaskContext(task)) == 0 {
+		return
+	}
+	err := w.ContextAgent(ctx, task)
+	if err != nil {
+		log.Warn().Err(err).Any("task", task.Base().ID).Msg("refine context failed")
 	}
 }
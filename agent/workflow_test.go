@@ -1,7 +1,19 @@
 package agent
 
 import (
+	"context"
+	"io"
+	"multi-agent/config"
+	fakellm "multi-agent/fake-llm"
+	"multi-agent/protocol"
+	"multi-agent/service"
+	"multi-agent/trajectory"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/sashabaranov/go-openai"
 )
 
 func TestWorkflow_SingleAgent(t *testing.T) {
@@ -9,3 +21,339 @@ func TestWorkflow_SingleAgent(t *testing.T) {
 
 	})
 }
+
+func toolCallMessage(name string, args string) *openai.ChatCompletionMessage {
+	return &openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{{
+			ID:       "call_" + name,
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: name, Arguments: args},
+		}},
+	}
+}
+
+func writeEvents(t *testing.T, path string, events []trajectory.Event) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := trajectory.NewRecorder(file)
+	for _, event := range events {
+		recorder.Record(event)
+	}
+	recorder.Close()
+}
+
+func replayWorkflow(t *testing.T, replay string, record string, goal string) protocol.Result {
+	cfg := config.Default()
+	cfg.SetReplay(replay)
+	w := NewWorkFlow(cfg, nil)
+	if record != "" {
+		err := w.SetTrajectory(record, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+	}
+	w.taskMgr.Reset(goal)
+	return w.runUserTask(context.Background())
+}
+
+func TestWorkflow_replay(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.jsonl")
+	record := filepath.Join(dir, "record.jsonl")
+	// a hand written script only has the responses, the recording of the first run has the requests too
+	writeEvents(t, script, []trajectory.Event{
+		{Type: trajectory.EventResponse, Agent: "orchestrator", Message: toolCallMessage("create_explore_task", `{"Task":"find the entry point","ExpectOutput":"the main file"}`), FinishReason: "tool_calls"},
+		{Type: trajectory.EventResponse, Agent: "explore#1", Message: toolCallMessage("finish_explore_task", `{"Context":[]}`), FinishReason: "tool_calls"},
+		{Type: trajectory.EventResponse, Agent: "orchestrator", Message: &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "main.go"}, FinishReason: "stop"},
+	})
+
+	result := replayWorkflow(t, script, record, "where is main")
+	if result.Status != protocol.StatusDone || result.Response != "main.go" {
+		t.Fatalf("script run: %+v", result)
+	}
+
+	result = replayWorkflow(t, record, "", "where is main")
+	if result.Status != protocol.StatusDone || result.Response != "main.go" {
+		t.Fatalf("replay of the recording: %+v", result)
+	}
+
+	// a different prompt no longer matches the recording
+	result = replayWorkflow(t, record, "", "where is the config")
+	if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, "replay mismatch") {
+		t.Fatalf("changed goal: %+v", result)
+	}
+}
+
+// TestWorkflow_fakeLLM runs a user task through the driver protocol: the explore worker first finishes
+// with an invalid tool log ID, then runs a command on the driver and finishes with its result, which
+// the context agent describes better.
+func TestWorkflow_fakeLLM(t *testing.T) {
+	server := fakellm.New()
+	defer server.Close()
+	server.On(fakellm.HasTool("create_explore_task"), fakellm.Contains("hello from bash")).Reply(fakellm.Text("found the greeting"))
+	server.On(fakellm.HasTool("create_explore_task")).Reply(fakellm.ToolCall("create_explore_task", `{"Task":"find the greeting","ExpectOutput":"the greeting"}`))
+	server.On(fakellm.HasTool("finish_explore_task"), fakellm.LastToolResult("invalid tool log ID 99")).Reply(fakellm.ToolCall("bash", `{"Command":"echo hello from bash","Cwd":""}`))
+	// tool log: 0 create_explore_task, 1 the failed finish_explore_task, 2 bash
+	server.On(fakellm.HasTool("finish_explore_task"), fakellm.LastToolResult("hello from bash")).Reply(fakellm.ToolCall("finish_explore_task", `{"Context":[{"ID":2,"Desc":"the greeting"}]}`))
+	server.On(fakellm.HasTool("finish_explore_task")).Reply(fakellm.ToolCall("finish_explore_task", `{"Context":[{"ID":99,"Desc":"missing"}]}`))
+	server.On(fakellm.HasTool("refine_context")).Reply(fakellm.ToolCall("refine_context", `{"OldID":2,"NewID":2,"Desc":"the greeting printed by echo"}`), fakellm.Text("refined"))
+
+	cfg := config.Default()
+	cfg.Providers["fake"] = server.Provider()
+	cfg.Default.Provider = "fake"
+	cfg.Prices["fake/glm-5"] = config.Price{Input: 1000, Output: 2000}
+	cfg.RefineContext = true
+	agentIn, driverOut := io.Pipe()
+	driverIn, agentOut := io.Pipe()
+	w := NewWorkFlow(cfg, protocol.NewConn(agentIn, agentOut, "a"))
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	var commands []string
+	driver := protocol.NewDriver(protocol.NewConn(driverIn, driverOut, "d"), func(ctx context.Context, req protocol.BashRequest) (protocol.BashResult, error) {
+		commands = append(commands, req.Command)
+		return protocol.BashResult{Output: "hello from bash\n"}, nil
+	})
+	result, err := driver.RunTask(ctx, "print the greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != protocol.StatusDone || result.Response != "found the greeting" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(commands) != 1 || commands[0] != "echo hello from bash" {
+		t.Errorf("unexpected commands %v", commands)
+	}
+	if len(w.taskMgr.PreTasks) != 1 {
+		t.Fatalf("expect 1 finished task, got %d", len(w.taskMgr.PreTasks))
+	}
+	if items := service.TaskContext(w.taskMgr.PreTasks[0]); len(items) != 1 || items[0].Desc != "the greeting printed by echo" {
+		t.Errorf("expect the refined context, got %+v", items)
+	}
+	if len(server.Requests()) != 7 {
+		t.Errorf("expect 7 requests, got %d", len(server.Requests()))
+	}
+	// every fake response uses 10 prompt and 5 completion tokens
+	if total := w.usage.Total(); total.Usage.TotalTokens != 105 {
+		t.Errorf("unexpected usage %+v", total)
+	}
+	if got := w.usage.ByTask()[1]; got.Calls != 5 || got.Runs != 2 {
+		t.Errorf("expect 5 calls of the explore worker and the context agent, got %+v", got)
+	}
+	if got := w.usage.ByRole()[config.RoleContext]; got.Cost < 0.0399 || got.Cost > 0.0401 {
+		t.Errorf("expect the context agent to cost $0.04, got %+v", got)
+	}
+}
+
+func TestWorkflow_configTaskType(t *testing.T) {
+	server := fakellm.New()
+	defer server.Close()
+	cfg := config.Default()
+	cfg.Providers["fake"] = server.Provider()
+	cfg.Default = config.Model{Provider: "fake", Model: "fake-model"}
+	cfg.TaskTypes = []config.TaskType{{
+		Name:         "review",
+		Description:  "Creates a code review task",
+		CreateSchema: []byte(`{"properties":{"Task":{"type":"string"}},"required":["Task"]}`),
+		FinishSchema: []byte(`{"properties":{"Verdict":{"type":"string"}},"required":["Verdict"]}`),
+		Prompt:       "You review code.",
+		Tools:        []string{"view_tool_log"},
+		Format:       "Review: {{.Args.Task}}\n{{with .Result}}Verdict: {{.Verdict}}{{end}}",
+	}}
+	w := NewWorkFlow(cfg, nil)
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.On(fakellm.HasTool("create_review_task"), fakellm.Not(fakellm.Contains("REVIEW TASK #1"))).
+		Reply(fakellm.ToolCall("create_review_task", `{"Task":"review main.go"}`))
+	server.On(fakellm.HasTool("finish_review_task")).Reply(fakellm.ToolCall("finish_review_task", `{"Verdict":"approve"}`))
+	server.On(fakellm.HasTool("create_review_task")).Reply(fakellm.Text("approved"))
+	w.taskMgr.Reset("review main.go")
+	res := w.runUserTask(context.Background())
+	if res.Status != protocol.StatusDone || res.Response != "approved" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	worker := server.Requests()[1]
+	tools := trajectory.ToolNames(worker.Tools)
+	if worker.Messages[0].Content != "You review code." || strings.Join(tools, ",") != "finish_review_task,view_tool_log" {
+		t.Errorf("unexpected worker prompt %q and tools %v", worker.Messages[0].Content, tools)
+	}
+	want := "--- REVIEW TASK #1 ---\nReview: review main.go\nVerdict: approve\n"
+	if got := w.taskMgr.PreTasks[0].FormatString(); got != want {
+		t.Errorf("got task\n%s\nwant\n%s", got, want)
+	}
+	if w.usage.ByRole()["review"].Runs != 1 {
+		t.Errorf("expect the worker to run as role review, got %v", w.usage.ByRole())
+	}
+}
+
+type catExecutor struct{}
+
+func (catExecutor) Exec(ctx context.Context, cmd string, cwd string) (*service.BashRes, error) {
+	return &service.BashRes{Output: "func main() {}\n"}, nil
+}
+
+// TestWorkflow_subtask runs a reason worker that delegates the exploration of main.go to a child agent.
+func TestWorkflow_subtask(t *testing.T) {
+	server := fakellm.New()
+	defer server.Close()
+	cfg := config.Default()
+	cfg.Providers["fake"] = server.Provider()
+	cfg.Default = config.Model{Provider: "fake", Model: "fake-model"}
+	w := NewWorkFlow(cfg, nil)
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.taskMgr.Executor = catExecutor{}
+
+	server.On(fakellm.HasTool("create_reason_task"), fakellm.Not(fakellm.Contains("REASON TASK #1"))).
+		Reply(fakellm.ToolCall("create_reason_task", `{"Task":"why does it crash","ExpectOutput":"the root cause"}`))
+	server.On(fakellm.HasTool("create_reason_task")).Reply(fakellm.Text("main is empty"))
+	server.On(fakellm.HasTool("finish_reason_task"), fakellm.LastToolResult("EXPLORE TASK #2")).
+		Reply(fakellm.ToolCall("finish_reason_task", `{"Conclusion":"main is empty"}`))
+	server.On(fakellm.HasTool("finish_reason_task")).
+		Reply(fakellm.ToolCall("create_explore_task", `{"Task":"read main.go","ExpectOutput":"the main function"}`))
+	// tool log: 0 create_reason_task, 1 bash of the child agent
+	server.On(fakellm.HasTool("finish_explore_task"), fakellm.LastToolResult("func main")).
+		Reply(fakellm.ToolCall("finish_explore_task", `{"Context":[{"ID":1,"Desc":"main.go"}]}`))
+	server.On(fakellm.HasTool("finish_explore_task")).Reply(fakellm.ToolCall("bash", `{"Command":"cat main.go","Cwd":""}`))
+	w.taskMgr.Reset("why does it crash")
+	res := w.runUserTask(context.Background())
+	if res.Status != protocol.StatusDone || res.Response != "main is empty" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	child := server.Requests()[2]
+	if tools := trajectory.ToolNames(child.Tools); strings.Join(tools, ",") != "bash,finish_explore_task,view_tool_log" {
+		t.Errorf("expect the child agent at the depth limit to have no subtask tools, got %v", tools)
+	}
+	if !strings.Contains(child.Messages[1].Content, "** Parent Task **") {
+		t.Errorf("expect the parent task in the prompt of the child agent, got %q", child.Messages[1].Content)
+	}
+	reason := w.taskMgr.PreTasks[0]
+	if len(w.taskMgr.PreTasks) != 1 || len(reason.Base().Subtasks) != 1 || reason.Base().Subtasks[0].Base().ParentID != 1 {
+		t.Fatalf("expect the explore task to be a subtask of the reason task")
+	}
+	got := reason.FormatString()
+	for _, want := range []string{"Subtasks:\n  --- EXPLORE TASK #2 ---\n  Goal: read main.go\n", "#1: subtask #2: main.go"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expect %q in the task\n%s", want, got)
+		}
+	}
+}
+
+// TestWorkflow_plan runs the plan mode against a driver rejecting the first plan and editing the second.
+func TestWorkflow_plan(t *testing.T) {
+	server := fakellm.New()
+	defer server.Close()
+	server.On(fakellm.HasTool("set_plan"), fakellm.Contains("PLAN FEEDBACK")).
+		Reply(fakellm.ToolCall("set_plan", `{"Steps":[{"Type":"explore","Goal":"read main.go","ExpectOutput":"main"},{"Type":"reason","Goal":"why does it crash","ExpectOutput":"the root cause"}]}`))
+	server.On(fakellm.HasTool("set_plan")).Reply(fakellm.ToolCall("set_plan", `{"Steps":[{"Type":"build","Goal":"rewrite main.go","ExpectOutput":"a new main"}]}`))
+	server.On(fakellm.HasTool("insert_plan_step"), fakellm.Contains("EXPLORE TASK #1")).Reply(fakellm.Text("main is empty"))
+	server.On(fakellm.HasTool("insert_plan_step")).Reply(fakellm.ToolCall("create_explore_task", `{"Task":"read main.go","ExpectOutput":"the main function"}`))
+	server.On(fakellm.HasTool("finish_explore_task")).Reply(fakellm.ToolCall("finish_explore_task", `{"Context":[]}`))
+
+	cfg := config.Default()
+	cfg.Providers["fake"] = server.Provider()
+	cfg.Default = config.Model{Provider: "fake", Model: "fake-model"}
+	cfg.ApprovePlan = true
+	agentIn, driverOut := io.Pipe()
+	driverIn, agentOut := io.Pipe()
+	w := NewWorkFlow(cfg, protocol.NewConn(agentIn, agentOut, "a"))
+	err := w.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	var plans []protocol.PlanRequest
+	driver := protocol.NewDriver(protocol.NewConn(driverIn, driverOut, "d"), nil)
+	driver.SetPlanHandler(func(ctx context.Context, req protocol.PlanRequest) (protocol.PlanDecision, error) {
+		plans = append(plans, req)
+		if len(plans) == 1 {
+			return protocol.PlanDecision{Feedback: "explore the code first"}, nil
+		}
+		return protocol.PlanDecision{Approved: true, Steps: req.Steps[:1]}, nil
+	})
+	result, err := driver.RunTask(ctx, "why does it crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != protocol.StatusDone || result.Response != "main is empty" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(plans) != 2 || plans[0].Steps[0].Type != "build" || plans[1].Revision != 2 || len(plans[1].Steps) != 2 {
+		t.Fatalf("unexpected plans %+v", plans)
+	}
+
+	requests := server.Requests()
+	if tools := trajectory.ToolNames(requests[0].Tools); strings.Join(tools, ",") != "set_plan,view_tool_log" {
+		t.Errorf("unexpected planner tools %v", tools)
+	}
+	if !strings.Contains(requests[1].Messages[1].Content, "The plan was rejected: explore the code first") {
+		t.Errorf("expect the feedback in the prompt of the second plan, got %q", requests[1].Messages[1].Content)
+	}
+	want := "### PLAN (revision 3, approved)\n1. [explore] read main.go -> expect: main (task #1, running)\n"
+	if worker := requests[3].Messages[1].Content; !strings.Contains(worker, want) {
+		t.Errorf("expect the approved plan in the worker prompt, got\n%s", worker)
+	}
+	if plan := w.taskMgr.GetPlan(); len(plan.Steps) != 1 || plan.Steps[0].Task != 1 {
+		t.Errorf("expect the edited plan linked to the explore task, got %+v", plan)
+	}
+}
+
+func TestWorkflow_renderPrompt(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "reason.tmpl"), []byte("Reason about {{.Task.GetTask}} for {{.UserGoal}}.\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.PromptDir = dir
+	w := NewWorkFlow(cfg, nil)
+	if err := w.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	w.taskMgr.Reset("find the bug")
+	tools := service.NewToolDispatcher(w.toolLog)
+	tools.RegisterToolEndpoint(w.taskMgr.CreateTaskTools()...)
+	tools.Run(context.Background(), openai.ToolCall{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{
+		Name: "create_reason_task", Arguments: `{"Task":"why does it crash","ExpectOutput":"the root cause"}`,
+	}})
+
+	msgs, toolNames, err := w.RenderPrompt(context.Background(), "worker", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].Content != "Reason about why does it crash for find the bug." || !strings.Contains(msgs[1].Content, "--- REASON TASK #1 ---") {
+		t.Errorf("unexpected worker prompt %v", msgs)
+	}
+	if strings.Join(toolNames, ",") != "bash,create_explore_task,finish_reason_task,view_tool_log" {
+		t.Errorf("unexpected worker tools %v", toolNames)
+	}
+	msgs, _, err = w.RenderPrompt(context.Background(), config.RoleOrchestrator, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msgs[0].Content, "You are the **Task Orchestrator** agent") {
+		t.Errorf("expect the embedded orchestrator prompt, got %q", msgs[0].Content)
+	}
+	if _, _, err := w.RenderPrompt(context.Background(), config.RoleContext, 1); err == nil {
+		t.Errorf("expect rendering the context agent of a pending task to fail")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"multi-agent/agent"
+	"multi-agent/config"
+	"multi-agent/prompts"
+	"os"
+	"strings"
+)
+
+// renderPrompt prints the messages and tools an agent would start with in the state of a checkpoint
+// written with -checkpoint. With -role swebench it prints the user prompt of a SWE-bench instance
+// instead, the problem statement is read from stdin.
+func main() {
+	configPath := flag.String("config", os.Getenv("MA_CONFIG"), "path to the json config file")
+	checkpoint := flag.String("checkpoint", "", "checkpoint file of the task state, empty renders an empty task state")
+	promptDir := flag.String("prompts", "", "directory with prompt templates replacing the built-in ones of the same name")
+	role := flag.String("role", "orchestrator", "agent to render: orchestrator, plan, worker or context, or swebench for the task prompt of agent.py")
+	task := flag.Int("task", 0, "task ID of the worker or of the task the context agent refines")
+	flag.Parse()
+
+	err := render(*configPath, *checkpoint, *promptDir, *role, *task)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func render(configPath string, checkpoint string, promptDir string, role string, task int) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	if promptDir != "" {
+		cfg.PromptDir = promptDir
+	}
+	if role == swebenchPrompt {
+		return renderSWEBench(cfg)
+	}
+	workflow := agent.NewWorkFlow(cfg, nil)
+	err = workflow.Prepare()
+	if err != nil {
+		return err
+	}
+	if checkpoint != "" {
+		err = workflow.Resume(checkpoint)
+		if err != nil {
+			return err
+		}
+	}
+	msgs, tools, err := workflow.RenderPrompt(context.Background(), role, task)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("=== tools: %s\n", strings.Join(tools, ", "))
+	for _, msg := range msgs {
+		switch {
+		case len(msg.ToolCalls) != 0:
+			for _, call := range msg.ToolCalls {
+				fmt.Printf("=== %s: %s(%s)\n", msg.Role, call.Function.Name, call.Function.Arguments)
+			}
+		default:
+			fmt.Printf("=== %s\n%s\n", msg.Role, msg.Content)
+		}
+	}
+	return nil
+}
+
+// swebenchPrompt is the template of the task agent.py sends for a SWE-bench instance.
+const swebenchPrompt = "swebench"
+
+// renderSWEBench prints the swebench template with the problem statement of stdin as the user goal.
+func renderSWEBench(cfg *config.Config) error {
+	goal, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	lib, err := prompts.Load(cfg.PromptDir)
+	if err != nil {
+		return err
+	}
+	text, err := lib.Render(swebenchPrompt, prompts.Data{UserGoal: string(goal), Repo: cfg.Executor})
+	if err != nil {
+		return err
+	}
+	fmt.Print(text)
+	return nil
+}
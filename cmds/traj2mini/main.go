@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"multi-agent/trajectory"
+	"os"
+)
+
+// traj2mini converts a run of a trajectory file written with -trajectory to the mini-swe-agent .traj.json format.
+func main() {
+	in := flag.String("in", "trajectory.jsonl", "trajectory file")
+	out := flag.String("out", "run.traj.json", "output .traj.json file")
+	run := flag.String("run", "", "run ID to convert, defaults to the last run")
+	flag.Parse()
+
+	err := trajectory.WriteMiniSWE(*in, *out, *run)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
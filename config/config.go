@@ -0,0 +1,606 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Agent roles that can be mapped to their own provider and model.
+const (
+	RoleOrchestrator = "orchestrator"
+	RoleExplore      = "explore"
+	RoleReason       = "reason"
+	RoleBuild        = "build"
+	RoleVerify       = "verify"
+	RoleContext      = "context"
+)
+
+// ProviderReplay is the provider set by SetReplay.
+const ProviderReplay = "replay"
+
+var AllRoles = []string{RoleOrchestrator, RoleExplore, RoleReason, RoleBuild, RoleVerify, RoleContext}
+
+// PlanPrompt is the prompt template of the orchestrator writing the plan, the planner runs in the
+// orchestrator role.
+const PlanPrompt = "plan"
+
+// Provider is an OpenAI-compatible endpoint.
+type Provider struct {
+	BaseURL string
+	// APIKey is used as is, otherwise the key is read from the APIKeyEnv variable.
+	APIKey    string
+	APIKeyEnv string
+	// NoAuth allows local servers that do not check the key.
+	NoAuth bool
+	// Replay is a trajectory file recorded with -trajectory, the recorded responses are returned
+	// instead of calling the api. BaseURL and the key are not needed.
+	Replay string `json:",omitempty"`
+}
+
+// Model selects a provider and a model name, the zero value fields fall back to Config.Default.
+type Model struct {
+	Provider string
+	Model    string
+	// Stream prints the output of the agent to the terminal while it is generated, nil keeps the
+	// setting of Config.Default so a role can switch it off again.
+	Stream *bool `json:",omitempty"`
+	// ContextWindow is the number of tokens the model accepts, 0 takes Context.Window.
+	ContextWindow int `json:",omitempty"`
+}
+
+// Duration is a time.Duration written as "30s" or "10m" in the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	value, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Timeouts bound the agent loop, zero means no limit.
+type Timeouts struct {
+	// Turn bounds a single chat completion call.
+	Turn Duration
+	// Tool bounds a single tool call, e.g. a hung 'go test'.
+	Tool Duration
+	// Task bounds the whole user task read from the driver.
+	Task Duration
+}
+
+// Retry controls how failed chat completions are retried.
+type Retry struct {
+	// MaxAttempts counts the first call, 1 disables retries.
+	MaxAttempts int
+	BaseDelay   Duration
+	// MaxDelay caps the backoff and the Retry-After of the server, 0 means no cap.
+	MaxDelay Duration
+}
+
+// Budget bounds a single agent run, zero fields mean no limit.
+type Budget struct {
+	MaxTurns            int
+	MaxPromptTokens     int
+	MaxCompletionTokens int
+	MaxWallTime         Duration
+	MaxToolCalls        int
+}
+
+func mergeBudget(base Budget, over Budget) Budget {
+	if over.MaxTurns != 0 {
+		base.MaxTurns = over.MaxTurns
+	}
+	if over.MaxPromptTokens != 0 {
+		base.MaxPromptTokens = over.MaxPromptTokens
+	}
+	if over.MaxCompletionTokens != 0 {
+		base.MaxCompletionTokens = over.MaxCompletionTokens
+	}
+	if over.MaxWallTime != 0 {
+		base.MaxWallTime = over.MaxWallTime
+	}
+	if over.MaxToolCalls != 0 {
+		base.MaxToolCalls = over.MaxToolCalls
+	}
+	return base
+}
+
+// RunBudget bounds a whole user task over all agents, zero fields mean no limit.
+// The orchestrator is told how much of it remains.
+type RunBudget struct {
+	MaxTokens int
+	// MaxCost is in USD, priced with Config.Prices.
+	MaxCost float64
+}
+
+// Price is the cost of a model in USD per million tokens.
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// Cost returns the cost of the tokens in USD.
+func (p Price) Cost(promptTokens int, completionTokens int) float64 {
+	return (float64(promptTokens)*p.Input + float64(completionTokens)*p.Output) / 1e6
+}
+
+// Context keeps the prompts inside the context window, token counts are estimates.
+type Context struct {
+	// Window is the context window of the models without their own ContextWindow, 0 means no limit.
+	Window int
+	// Reserve is the part of the window kept free for the completion.
+	Reserve int
+	// MaxToolOutput truncates a single tool output, the model can read the rest with view_tool_log.
+	MaxToolOutput int
+	// History bounds the task history prompt, older tasks are summarised beyond it.
+	History int
+}
+
+// TaskType declares a task type besides the built-in explore, reason, build and verify types.
+type TaskType struct {
+	Name string
+	// Description tells the orchestrator what the tasks of the type are for.
+	Description string
+	// CreateSchema and FinishSchema are the JSON schemas of the tool parameters, an object without
+	// properties by default. The create tool also gets DependsOn, a Context property of the finish
+	// tool holds context items like the one of the built-in types.
+	CreateSchema json.RawMessage `json:",omitempty"`
+	FinishSchema json.RawMessage `json:",omitempty"`
+	// Prompt is the system prompt of the worker.
+	Prompt string
+	// Role is the role whose model and budget the worker uses, the name of the type by default.
+	Role string `json:",omitempty"`
+	// Tools are the tools of the worker besides the finish tool, bash and view_tool_log by default.
+	Tools []string `json:",omitempty"`
+	// Subtasks are the task types the worker can delegate to child agents.
+	Subtasks []string `json:",omitempty"`
+	// Format is a text/template rendering a task in the task history below its header, the task's Args
+	// are the arguments of the create tool and its Result the ones of the finish tool.
+	Format string `json:",omitempty"`
+}
+
+// AgentRole returns the role running the tasks of the type.
+func (t TaskType) AgentRole() string {
+	if t.Role != "" {
+		return t.Role
+	}
+	return t.Name
+}
+
+var taskTypeName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// Executor selects where the workers' bash commands run.
+type Executor struct {
+	// Type is one of "remote" (the driver over stdin/stdout), "local" or "mcp".
+	Type string
+	// RepoPath is the repository the local executor tracks file changes in.
+	RepoPath string
+	// MCPCommand starts the mcp server with the bash tool, MCPServer is its server name.
+	MCPCommand string
+	MCPArgs    []string
+	MCPServer  string
+}
+
+const (
+	ExecutorRemote = "remote"
+	ExecutorLocal  = "local"
+	ExecutorMCP    = "mcp"
+)
+
+type Config struct {
+	Providers map[string]Provider
+	Default   Model
+	Roles     map[string]Model
+	Timeouts  Timeouts
+	Retry     Retry
+	// Budget applies to every role, Budgets overrides it per role.
+	Budget   Budget
+	Budgets  map[string]Budget
+	Executor Executor
+	// ParallelTools is the number of read-only tool calls of a turn that run at the same time,
+	// 0 or 1 runs every tool call sequentially.
+	ParallelTools int
+	// Prices are keyed by "provider/model" or by the model name, unknown models cost nothing.
+	Prices    map[string]Price
+	RunBudget RunBudget
+	Context   Context
+	// RefineContext runs the context agent on every finished task with context items.
+	RefineContext bool
+	// MaxFixCycles bounds the build and verify tasks created after a failed verification of a build
+	// task before the orchestrator takes over, a negative value disables the fix cycles.
+	MaxFixCycles int
+	// TaskRules name the rules checked when the orchestrator creates a task, see service.TaskRules. An
+	// empty list disables them.
+	TaskRules []string
+	// MaxTaskDepth bounds the nesting of the subtasks workers delegate to child agents, a negative
+	// value disables subtasks.
+	MaxTaskDepth int
+	// Plan makes the orchestrator write a plan of the user goal before the first task.
+	Plan bool
+	// ApprovePlan sends the plan to the driver and waits for its approval, it implies Plan.
+	ApprovePlan bool
+	TaskTypes   []TaskType
+	// PromptDir holds prompt templates replacing the built-in ones of the same name.
+	PromptDir string
+}
+
+// Default keeps the original behaviour, every role runs glm-5 on bigmodel.cn.
+func Default() *Config {
+	return &Config{
+		Providers: map[string]Provider{
+			"bigmodel": {
+				BaseURL:   "https://open.bigmodel.cn/api/paas/v4",
+				APIKeyEnv: "API_KEY",
+			},
+			"minimax": {
+				BaseURL:   "https://api.minimaxi.com/v1",
+				APIKeyEnv: "MINIMAX_API_KEY",
+			},
+			"local": {
+				BaseURL:   "http://localhost:8000/v1",
+				APIKeyEnv: "LOCAL_API_KEY",
+				NoAuth:    true,
+			},
+		},
+		Default: Model{Provider: "bigmodel", Model: "glm-5"},
+		Roles:   map[string]Model{},
+		Timeouts: Timeouts{
+			Turn: Duration(10 * time.Minute),
+			Tool: Duration(10 * time.Minute),
+		},
+		Retry: Retry{
+			MaxAttempts: 5,
+			BaseDelay:   Duration(time.Second),
+			MaxDelay:    Duration(time.Minute),
+		},
+		Budget: Budget{
+			MaxTurns:     100,
+			MaxToolCalls: 200,
+		},
+		Budgets: map[string]Budget{},
+		Prices:  map[string]Price{},
+		Context: Context{
+			Window:        128000,
+			Reserve:       8192,
+			MaxToolOutput: 8000,
+			History:       16000,
+		},
+		MaxFixCycles: 2,
+		TaskRules:    []string{"explore-before-build", "observed-files"},
+		MaxTaskDepth: 1,
+		Executor: Executor{
+			Type:       ExecutorRemote,
+			RepoPath:   ".",
+			MCPCommand: "bin/mcpserver",
+			MCPServer:  "file editing and bash",
+		},
+	}
+}
+
+// Load reads the json config file at path and merges it on top of Default.
+// An empty path only returns the defaults.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s failed: %w", path, err)
+	}
+	var file Config
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s failed: %w", path, err)
+	}
+	cfg.merge(&file)
+	return cfg, nil
+}
+
+func (cfg *Config) merge(other *Config) {
+	for name, provider := range other.Providers {
+		cfg.Providers[name] = provider
+	}
+	cfg.Default = mergeModel(cfg.Default, other.Default)
+	for role, model := range other.Roles {
+		cfg.Roles[role] = mergeModel(cfg.Roles[role], model)
+	}
+	if other.Timeouts.Turn != 0 {
+		cfg.Timeouts.Turn = other.Timeouts.Turn
+	}
+	if other.Timeouts.Tool != 0 {
+		cfg.Timeouts.Tool = other.Timeouts.Tool
+	}
+	if other.Timeouts.Task != 0 {
+		cfg.Timeouts.Task = other.Timeouts.Task
+	}
+	if other.Retry.MaxAttempts != 0 {
+		cfg.Retry.MaxAttempts = other.Retry.MaxAttempts
+	}
+	if other.Retry.BaseDelay != 0 {
+		cfg.Retry.BaseDelay = other.Retry.BaseDelay
+	}
+	if other.Retry.MaxDelay != 0 {
+		cfg.Retry.MaxDelay = other.Retry.MaxDelay
+	}
+	if other.Executor.Type != "" {
+		cfg.Executor.Type = other.Executor.Type
+	}
+	if other.Executor.RepoPath != "" {
+		cfg.Executor.RepoPath = other.Executor.RepoPath
+	}
+	if other.Executor.MCPCommand != "" {
+		cfg.Executor.MCPCommand = other.Executor.MCPCommand
+		cfg.Executor.MCPArgs = other.Executor.MCPArgs
+	}
+	if other.Executor.MCPServer != "" {
+		cfg.Executor.MCPServer = other.Executor.MCPServer
+	}
+	if other.ParallelTools != 0 {
+		cfg.ParallelTools = other.ParallelTools
+	}
+	cfg.Budget = mergeBudget(cfg.Budget, other.Budget)
+	for role, budget := range other.Budgets {
+		cfg.Budgets[role] = mergeBudget(cfg.Budgets[role], budget)
+	}
+	for model, price := range other.Prices {
+		cfg.Prices[model] = price
+	}
+	if other.RunBudget.MaxTokens != 0 {
+		cfg.RunBudget.MaxTokens = other.RunBudget.MaxTokens
+	}
+	if other.RunBudget.MaxCost != 0 {
+		cfg.RunBudget.MaxCost = other.RunBudget.MaxCost
+	}
+	if other.Context.Window != 0 {
+		cfg.Context.Window = other.Context.Window
+	}
+	if other.Context.Reserve != 0 {
+		cfg.Context.Reserve = other.Context.Reserve
+	}
+	if other.Context.MaxToolOutput != 0 {
+		cfg.Context.MaxToolOutput = other.Context.MaxToolOutput
+	}
+	if other.Context.History != 0 {
+		cfg.Context.History = other.Context.History
+	}
+	if other.RefineContext {
+		cfg.RefineContext = true
+	}
+	if other.MaxFixCycles != 0 {
+		cfg.MaxFixCycles = other.MaxFixCycles
+	}
+	if other.TaskRules != nil {
+		cfg.TaskRules = other.TaskRules
+	}
+	if other.MaxTaskDepth != 0 {
+		cfg.MaxTaskDepth = other.MaxTaskDepth
+	}
+	if other.Plan {
+		cfg.Plan = true
+	}
+	if other.ApprovePlan {
+		cfg.ApprovePlan = true
+	}
+	cfg.TaskTypes = append(cfg.TaskTypes, other.TaskTypes...)
+	if other.PromptDir != "" {
+		cfg.PromptDir = other.PromptDir
+	}
+}
+
+// AgentRoles returns AllRoles followed by the roles of the custom task types.
+func (cfg *Config) AgentRoles() []string {
+	roles := append([]string{}, AllRoles...)
+	for _, taskType := range cfg.TaskTypes {
+		if !slices.Contains(roles, taskType.AgentRole()) {
+			roles = append(roles, taskType.AgentRole())
+		}
+	}
+	return roles
+}
+
+// WindowFor returns the context window of the model.
+func (cfg *Config) WindowFor(model Model) int {
+	if model.ContextWindow != 0 {
+		return model.ContextWindow
+	}
+	return cfg.Context.Window
+}
+
+// PriceFor returns the price of the model, "provider/model" takes precedence over the model name.
+func (cfg *Config) PriceFor(model Model) Price {
+	if price, exist := cfg.Prices[model.Provider+"/"+model.Model]; exist {
+		return price
+	}
+	return cfg.Prices[model.Model]
+}
+
+// BudgetFor returns the budget of the role.
+func (cfg *Config) BudgetFor(role string) Budget {
+	return mergeBudget(cfg.Budget, cfg.Budgets[role])
+}
+
+func mergeModel(base Model, over Model) Model {
+	if over.Provider != "" {
+		base.Provider = over.Provider
+	}
+	if over.Model != "" {
+		base.Model = over.Model
+	}
+	if over.Stream != nil {
+		base.Stream = over.Stream
+	}
+	if over.ContextWindow != 0 {
+		base.ContextWindow = over.ContextWindow
+	}
+	return base
+}
+
+// ApplyEnv applies the MA_PROVIDER / MA_MODEL / MA_STREAM and MA_<ROLE>_PROVIDER / MA_<ROLE>_MODEL / MA_<ROLE>_STREAM overrides.
+func (cfg *Config) ApplyEnv() {
+	cfg.Default = mergeModel(cfg.Default, Model{
+		Provider: os.Getenv("MA_PROVIDER"),
+		Model:    os.Getenv("MA_MODEL"),
+		Stream:   envBool("MA_STREAM"),
+	})
+	for _, role := range cfg.AgentRoles() {
+		prefix := "MA_" + strings.ToUpper(role)
+		model := Model{
+			Provider: os.Getenv(prefix + "_PROVIDER"),
+			Model:    os.Getenv(prefix + "_MODEL"),
+			Stream:   envBool(prefix + "_STREAM"),
+		}
+		if model != (Model{}) {
+			cfg.Roles[role] = mergeModel(cfg.Roles[role], model)
+		}
+	}
+}
+
+// envBool parses the boolean environment variable, nil when it is not set or invalid.
+func envBool(name string) *bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+// Streams reports whether the output of the model is streamed to the terminal.
+func (m Model) Streams() bool {
+	return m.Stream != nil && *m.Stream
+}
+
+// SetRole parses a "role=provider/model" or "role=model" flag value.
+func (cfg *Config) SetRole(value string) error {
+	role, spec, ok := strings.Cut(value, "=")
+	if !ok || role == "" || spec == "" {
+		return fmt.Errorf("invalid role spec %q, expect role=provider/model", value)
+	}
+	cfg.Roles[role] = mergeModel(cfg.Roles[role], cfg.ParseModel(spec))
+	return nil
+}
+
+// ParseModel parses "provider/model", a spec that does not start with a configured provider only
+// sets the model, e.g. "Qwen/Qwen3-Coder-480B".
+func (cfg *Config) ParseModel(spec string) Model {
+	provider, model, ok := strings.Cut(spec, "/")
+	if _, exist := cfg.Providers[provider]; !ok || !exist {
+		return Model{Model: spec}
+	}
+	return Model{Provider: provider, Model: model}
+}
+
+// SetReplay makes every role replay the trajectory file at path instead of calling its provider.
+func (cfg *Config) SetReplay(path string) {
+	cfg.Providers[ProviderReplay] = Provider{Replay: path}
+	cfg.Default.Provider = ProviderReplay
+	for role, model := range cfg.Roles {
+		model.Provider = ProviderReplay
+		cfg.Roles[role] = model
+	}
+}
+
+// Resolve returns the model and provider used by the given role.
+func (cfg *Config) Resolve(role string) (Model, Provider, error) {
+	model := mergeModel(cfg.Default, cfg.Roles[role])
+	if model.Model == "" {
+		return model, Provider{}, fmt.Errorf("no model configured for role %s", role)
+	}
+	provider, exist := cfg.Providers[model.Provider]
+	if !exist {
+		return model, Provider{}, fmt.Errorf("unknown provider %s for role %s", model.Provider, role)
+	}
+	return model, provider, nil
+}
+
+// Key returns the api key of the provider.
+func (p Provider) Key() (string, error) {
+	if p.APIKey != "" {
+		return p.APIKey, nil
+	}
+	if p.APIKeyEnv != "" {
+		if key := os.Getenv(p.APIKeyEnv); key != "" {
+			return key, nil
+		}
+	}
+	if p.NoAuth || p.Replay != "" {
+		return "EMPTY", nil
+	}
+	return "", fmt.Errorf("api key %s not set", p.APIKeyEnv)
+}
+
+// Validate checks that every role resolves to a known provider with an api key.
+func (cfg *Config) Validate() error {
+	var errs []string
+	roles := cfg.AgentRoles()
+	checkRoles := func(field string, keys iter.Seq[string]) {
+		for role := range keys {
+			if !slices.Contains(roles, role) {
+				// e.g. a typo in -role, the setting would never be used
+				errs = append(errs, fmt.Sprintf("unknown role %q in %s, expect one of %s", role, field, strings.Join(roles, ", ")))
+			}
+		}
+	}
+	checkRoles("Roles", maps.Keys(cfg.Roles))
+	checkRoles("Budgets", maps.Keys(cfg.Budgets))
+	for _, role := range roles {
+		_, provider, err := cfg.Resolve(role)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if provider.BaseURL == "" && provider.Replay == "" {
+			errs = append(errs, fmt.Sprintf("provider for role %s has no BaseURL", role))
+		}
+		if _, err := provider.Key(); err != nil {
+			errs = append(errs, fmt.Sprintf("role %s: %s", role, err))
+		}
+	}
+	switch cfg.Executor.Type {
+	case ExecutorRemote, ExecutorLocal, ExecutorMCP:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown executor type %q", cfg.Executor.Type))
+	}
+	names := map[string]bool{}
+	for _, taskType := range cfg.TaskTypes {
+		switch {
+		case !taskTypeName.MatchString(taskType.Name):
+			errs = append(errs, fmt.Sprintf("invalid task type name %q", taskType.Name))
+		case slices.Contains([]string{RoleExplore, RoleReason, RoleBuild, RoleVerify}, taskType.Name):
+			errs = append(errs, fmt.Sprintf("task type %s is built in", taskType.Name))
+		case taskType.Name == RoleOrchestrator || taskType.Name == RoleContext || taskType.Name == PlanPrompt:
+			// the prompt templates of the agents are named by their role
+			errs = append(errs, fmt.Sprintf("task type name %s is reserved", taskType.Name))
+		case names[taskType.Name]:
+			errs = append(errs, fmt.Sprintf("task type %s is declared twice", taskType.Name))
+		case taskType.Prompt == "":
+			errs = append(errs, fmt.Sprintf("task type %s has no prompt", taskType.Name))
+		}
+		names[taskType.Name] = true
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
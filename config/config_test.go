@@ -0,0 +1,122 @@
+package config_test
+
+import (
+	"multi-agent/config"
+	"strings"
+	"testing"
+)
+
+func TestConfigResolve(t *testing.T) {
+	t.Run("test example config", func(t *testing.T) {
+		t.Setenv("API_KEY", "bigmodel-key")
+		t.Setenv("MINIMAX_API_KEY", "minimax-key")
+		t.Setenv("MA_REASON_MODEL", "glm-4.6")
+		cfg, err := config.Load("example.json")
+		if err != nil {
+			t.Fatalf("load config failed: %v", err)
+		}
+		cfg.ApplyEnv()
+		err = cfg.SetRole("build=local/llama")
+		if err != nil {
+			t.Fatalf("set role failed: %v", err)
+		}
+		testCases := map[string]config.Model{
+			config.RoleOrchestrator: {Provider: "bigmodel", Model: "glm-5"},
+			config.RoleExplore:      {Provider: "minimax", Model: "MiniMax-M2.5"},
+			config.RoleReason:       {Provider: "bigmodel", Model: "glm-4.6"},
+			config.RoleBuild:        {Provider: "local", Model: "llama"},
+			config.RoleVerify:       {Provider: "vllm", Model: "qwen3-coder", ContextWindow: 32768},
+		}
+		for role, want := range testCases {
+			got, _, err := cfg.Resolve(role)
+			if err != nil {
+				t.Fatalf("resolve %s failed: %v", role, err)
+			}
+			if got != want {
+				t.Errorf("role %s got %v, want %v", role, got, want)
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("validate failed: %v", err)
+		}
+		prices := map[config.Model]float64{
+			{Provider: "bigmodel", Model: "glm-5"}:       4.2,
+			{Provider: "minimax", Model: "MiniMax-M2.5"}: 1.5,
+			{Provider: "local", Model: "llama"}:          0,
+		}
+		for model, want := range prices {
+			if got := cfg.PriceFor(model).Cost(1e6, 1e6); got != want {
+				t.Errorf("model %v costs %v, want %v", model, got, want)
+			}
+		}
+		if cfg.MaxFixCycles != 3 {
+			t.Errorf("expect 3 fix cycles, got %d", cfg.MaxFixCycles)
+		}
+		if !cfg.Plan || cfg.ApprovePlan {
+			t.Errorf("expect the plan mode without approval, got plan %v approve %v", cfg.Plan, cfg.ApprovePlan)
+		}
+	})
+	t.Run("test task types", func(t *testing.T) {
+		t.Setenv("API_KEY", "bigmodel-key")
+		t.Setenv("MINIMAX_API_KEY", "minimax-key")
+		cfg, err := config.Load("example.json")
+		if err != nil {
+			t.Fatalf("load config failed: %v", err)
+		}
+		if len(cfg.TaskTypes) != 1 || cfg.TaskTypes[0].AgentRole() != config.RoleVerify {
+			t.Fatalf("unexpected task types %+v", cfg.TaskTypes)
+		}
+		cfg.TaskTypes = append(cfg.TaskTypes, config.TaskType{Name: "doc", Prompt: "write docs"})
+		if roles := cfg.AgentRoles(); roles[len(roles)-1] != "doc" {
+			t.Errorf("expect role doc for the doc tasks, got %v", roles)
+		}
+		cfg.TaskTypes = append(cfg.TaskTypes, config.TaskType{Name: "build", Prompt: "build"}, config.TaskType{Name: "doc"})
+		err = cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), "task type build is built in") || !strings.Contains(err.Error(), "task type doc is declared twice") {
+			t.Errorf("unexpected validate error %v", err)
+		}
+	})
+	t.Run("test stream override", func(t *testing.T) {
+		t.Setenv("MA_STREAM", "1")
+		t.Setenv("MA_EXPLORE_STREAM", "0")
+		cfg := config.Default()
+		cfg.ApplyEnv()
+		orchestrator, _, _ := cfg.Resolve(config.RoleOrchestrator)
+		explore, _, _ := cfg.Resolve(config.RoleExplore)
+		if !orchestrator.Streams() || explore.Streams() {
+			t.Errorf("expect only the explore role to switch streaming off, got orchestrator %v explore %v", orchestrator.Streams(), explore.Streams())
+		}
+	})
+	t.Run("test unknown role", func(t *testing.T) {
+		t.Setenv("API_KEY", "bigmodel-key")
+		cfg := config.Default()
+		if err := cfg.SetRole("explor=local/llama"); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Budgets["bild"] = config.Budget{MaxTurns: 10}
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), `unknown role "explor" in Roles`) || !strings.Contains(err.Error(), `unknown role "bild" in Budgets`) {
+			t.Errorf("expect the unknown roles to be rejected, got %v", err)
+		}
+	})
+	t.Run("test model with slash", func(t *testing.T) {
+		cfg := config.Default()
+		testCases := map[string]config.Model{
+			"Qwen/Qwen3-Coder-480B":       {Model: "Qwen/Qwen3-Coder-480B"},
+			"local/Qwen/Qwen3-Coder-480B": {Provider: "local", Model: "Qwen/Qwen3-Coder-480B"},
+			"glm-5":                       {Model: "glm-5"},
+		}
+		for spec, want := range testCases {
+			if got := cfg.ParseModel(spec); got != want {
+				t.Errorf("%s: got %+v, want %+v", spec, got, want)
+			}
+		}
+	})
+	t.Run("test missing key", func(t *testing.T) {
+		t.Setenv("API_KEY", "")
+		cfg := config.Default()
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expect error when API_KEY not set")
+		}
+	})
+}
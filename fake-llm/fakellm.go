@@ -0,0 +1,262 @@
+// Package fakellm is an in-process OpenAI-compatible server for tests. The answers are scripted
+// with rules: the first rule matching a request that still has replies left answers it.
+//
+//	server := fakellm.New()
+//	defer server.Close()
+//	server.On(fakellm.HasTool("create_explore_task")).Reply(fakellm.ToolCall("create_explore_task", `{"Task":"..."}`))
+//	server.On(fakellm.HasTool("finish_explore_task")).Reply(fakellm.ToolCall("finish_explore_task", `{"Context":[]}`))
+package fakellm
+
+import (
+	"encoding/json"
+	"fmt"
+	"multi-agent/config"
+	"multi-agent/trajectory"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Matcher selects the requests a rule answers.
+type Matcher func(req openai.ChatCompletionRequest) bool
+
+// HasTool matches requests offering the tool.
+func HasTool(name string) Matcher {
+	return func(req openai.ChatCompletionRequest) bool {
+		for _, tool := range req.Tools {
+			if tool.Function != nil && tool.Function.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Contains matches requests with a message containing text.
+func Contains(text string) Matcher {
+	return func(req openai.ChatCompletionRequest) bool {
+		for _, msg := range req.Messages {
+			if strings.Contains(msg.Content, text) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// LastToolResult matches requests whose last message is a tool result containing text.
+func LastToolResult(text string) Matcher {
+	return func(req openai.ChatCompletionRequest) bool {
+		if len(req.Messages) == 0 {
+			return false
+		}
+		last := req.Messages[len(req.Messages)-1]
+		return last.Role == openai.ChatMessageRoleTool && strings.Contains(last.Content, text)
+	}
+}
+
+// Not inverts the matcher.
+func Not(matcher Matcher) Matcher {
+	return func(req openai.ChatCompletionRequest) bool {
+		return !matcher(req)
+	}
+}
+
+// Reply is one scripted answer, either a message or an error status.
+type Reply struct {
+	Message      openai.ChatCompletionMessage
+	FinishReason openai.FinishReason
+	Usage        openai.Usage
+	// Status other than 200 answers with an api error carrying ErrMsg.
+	Status int
+	ErrMsg string
+}
+
+var defaultUsage = openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+
+// Text answers with a final message.
+func Text(content string) Reply {
+	return Reply{
+		Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+		FinishReason: openai.FinishReasonStop,
+		Usage:        defaultUsage,
+	}
+}
+
+// ToolCall answers with a single tool call.
+func ToolCall(name string, args string) Reply {
+	return ToolCalls(openai.FunctionCall{Name: name, Arguments: args})
+}
+
+// ToolCalls answers with the tool calls in one message, the call IDs are filled in by the server.
+func ToolCalls(calls ...openai.FunctionCall) Reply {
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	for _, call := range calls {
+		msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{Type: openai.ToolTypeFunction, Function: call})
+	}
+	return Reply{Message: msg, FinishReason: openai.FinishReasonToolCalls, Usage: defaultUsage}
+}
+
+// Error answers with an api error.
+func Error(status int, msg string) Reply {
+	return Reply{Status: status, ErrMsg: msg}
+}
+
+// Rule answers the matching requests with its replies in order.
+type Rule struct {
+	matchers []Matcher
+	replies  []Reply
+	repeat   bool
+}
+
+// Reply appends the replies of the rule, each matching request takes the next one.
+func (r *Rule) Reply(replies ...Reply) *Rule {
+	r.replies = append(r.replies, replies...)
+	return r
+}
+
+// Always keeps answering with the last reply once the others are used up.
+func (r *Rule) Always() *Rule {
+	r.repeat = true
+	return r
+}
+
+func (r *Rule) match(req openai.ChatCompletionRequest) bool {
+	if len(r.replies) == 0 {
+		return false
+	}
+	for _, matcher := range r.matchers {
+		if !matcher(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) next() Reply {
+	reply := r.replies[0]
+	if len(r.replies) > 1 || !r.repeat {
+		r.replies = r.replies[1:]
+	}
+	return reply
+}
+
+type Server struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	rules    []*Rule
+	requests []openai.ChatCompletionRequest
+	calls    int
+}
+
+func New() *Server {
+	s := &Server{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// URL is the base URL of the api.
+func (s *Server) URL() string {
+	return s.server.URL + "/v1"
+}
+
+// Provider returns a config provider pointing at the server.
+func (s *Server) Provider() config.Provider {
+	return config.Provider{BaseURL: s.URL(), NoAuth: true}
+}
+
+func (s *Server) Client() *openai.Client {
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = s.URL()
+	return openai.NewClientWithConfig(clientConfig)
+}
+
+// On adds a rule matching the requests all matchers accept, no matcher matches every request.
+// Rules are tried in the order they were added.
+func (s *Server) On(matchers ...Matcher) *Rule {
+	rule := &Rule{matchers: matchers}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append(s.rules, rule)
+	return rule
+}
+
+// Requests returns the chat completion requests received so far.
+func (s *Server) Requests() []openai.ChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]openai.ChatCompletionRequest{}, s.requests...)
+}
+
+func (s *Server) reply(req openai.ChatCompletionRequest) (Reply, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	s.calls++
+	for _, rule := range s.rules {
+		if rule.match(req) {
+			return rule.next(), s.calls, true
+		}
+	}
+	return Reply{}, s.calls, false
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("fakellm only serves chat completions, got %s", r.URL.Path))
+		return
+	}
+	var req openai.ChatCompletionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid chat completion request: %s", err))
+		return
+	}
+	reply, call, ok := s.reply(req)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("fakellm: no rule matches request %d", call))
+		return
+	}
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		writeError(w, reply.Status, reply.ErrMsg)
+		return
+	}
+
+	msg := reply.Message
+	msg.ToolCalls = append([]openai.ToolCall{}, msg.ToolCalls...)
+	for i := range msg.ToolCalls {
+		if msg.ToolCalls[i].ID == "" {
+			msg.ToolCalls[i].ID = fmt.Sprintf("call_%d_%d", call, i)
+		}
+	}
+	id := fmt.Sprintf("fake-%d", call)
+	if req.Stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(trajectory.StreamBody(id, req.Model, &msg, reply.FinishReason, &reply.Usage))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Model:   req.Model,
+		Choices: []openai.ChatCompletionChoice{{Message: msg, FinishReason: reply.FinishReason}},
+		Usage:   reply.Usage,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"message": msg, "type": "fakellm_error"},
+	})
+}
@@ -1,22 +1,146 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"multi-agent/agent"
+	"multi-agent/config"
+	"multi-agent/protocol"
 	_ "multi-agent/shared"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/rs/zerolog/log"
 )
 
+type roleFlags []string
+
+func (r *roleFlags) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *roleFlags) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
 func main() {
-	workflow := agent.NewWorkFlow()
-	err := workflow.Init()
+	var roles roleFlags
+	configPath := flag.String("config", os.Getenv("MA_CONFIG"), "path to the json config file")
+	model := flag.String("model", "", "default model for all roles, as provider/model or model")
+	flag.Var(&roles, "role", "per role model as role=provider/model, can be repeated")
+	checkpoint := flag.String("checkpoint", "", "write the task state to this file after every task transition")
+	resume := flag.String("resume", "", "resume the task state from this checkpoint file")
+	proto := flag.String("proto", "stdio", "driver connection: stdio, fd:<n>, unix:<path> or tcp:<host:port>")
+	trajPath := flag.String("trajectory", "", "append the trajectory events as json lines to this file")
+	trajJSON := flag.String("traj-json", "", "export every user task to this file in the mini-swe-agent .traj.json format, needs -trajectory")
+	replay := flag.String("replay", "", "answer every chat completion with the responses recorded in this -trajectory file instead of calling the api")
+	promptDir := flag.String("prompts", "", "directory with prompt templates replacing the built-in ones of the same name")
+	plan := flag.Bool("plan", false, "let the orchestrator write a plan of the task before the first task")
+	approvePlan := flag.Bool("approve-plan", false, "send the plan to the driver for approval before any task runs, implies -plan")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, *model, roles)
+	if err != nil {
+		log.Error().Err(err).Msg("load config failed")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *replay != "" {
+		cfg.SetReplay(*replay)
+	}
+	if *promptDir != "" {
+		cfg.PromptDir = *promptDir
+	}
+	if *plan {
+		cfg.Plan = true
+	}
+	if *approvePlan {
+		cfg.ApprovePlan = true
+	}
+
+	conn, err := protocol.Dial(*proto, "a")
+	if err != nil {
+		log.Error().Err(err).Msg("connect to driver failed")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	workflow := agent.NewWorkFlow(cfg, conn)
+	err = workflow.Init()
 	if err != nil {
 		log.Error().Err(err).Msg("workflow init failed")
 		return
 	}
-	err = workflow.Run()
+	defer workflow.Close()
+	if *resume != "" {
+		err = workflow.Resume(*resume)
+		if err != nil {
+			log.Error().Err(err).Msg("resume workflow failed")
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if *checkpoint == "" {
+			*checkpoint = *resume
+		}
+	}
+	workflow.SetCheckpoint(*checkpoint)
+	if *trajPath != "" {
+		err = workflow.SetTrajectory(*trajPath, *trajJSON)
+		if err != nil {
+			log.Error().Err(err).Msg("open trajectory failed")
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	go handleInterrupt(workflow)
+
+	err = workflow.Run(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("run single agent failed")
 		return
 	}
 }
+
+// handleInterrupt makes SIGINT abort the running task instead of the process,
+// SIGINT while no task is running exits as usual.
+func handleInterrupt(workflow *agent.Workflow) {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	for range interrupts {
+		if workflow.Interrupt() {
+			log.Warn().Msg("interrupt, abort the running task")
+			continue
+		}
+		os.Exit(130)
+	}
+}
+
+// loadConfig applies the config file, then env overrides, then flags.
+func loadConfig(path string, model string, roles []string) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ApplyEnv()
+	if model != "" {
+		spec := cfg.ParseModel(model)
+		if spec.Provider != "" {
+			cfg.Default.Provider = spec.Provider
+		}
+		cfg.Default.Model = spec.Model
+	}
+	for _, role := range roles {
+		err = cfg.SetRole(role)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
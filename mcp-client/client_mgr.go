@@ -47,12 +47,12 @@ func (mgr *ClientMgr) Close() error {
 	return errors.Join(errList...)
 }
 
-func (mgr *ClientMgr) NewMCPClient(command string, env []string, args ...string) error {
+func (mgr *ClientMgr) NewMCPClient(ctx context.Context, command string, env []string, args ...string) error {
 	c, err := client.NewStdioMCPClient(command, env, args...)
 	if err != nil {
 		return err
 	}
-	res, err := c.Initialize(context.Background(), mcp.InitializeRequest{
+	res, err := c.Initialize(ctx, mcp.InitializeRequest{
 		Params: mcp.InitializeParams{
 			ProtocolVersion: mcp.LATEST_PROTOCOL_VERSION,
 			ClientInfo: mcp.Implementation{
@@ -73,11 +73,11 @@ func (mgr *ClientMgr) NewMCPClient(command string, env []string, args ...string)
 	return nil
 }
 
-func (mgr *ClientMgr) LoadAllTools() ([]service.ToolEndPoint, error) {
+func (mgr *ClientMgr) LoadAllTools(ctx context.Context) ([]service.ToolEndPoint, error) {
 	var endpoint []service.ToolEndPoint
 	var errorList []error
 	for _, c := range mgr.clientMap {
-		res, err := mgr.loadTools(c)
+		res, err := mgr.loadTools(ctx, c)
 		if err != nil {
 			errorList = append(errorList, err)
 		} else {
@@ -91,8 +91,8 @@ func (mgr *ClientMgr) LoadAllTools() ([]service.ToolEndPoint, error) {
 	return endpoint, nil
 }
 
-func (mgr *ClientMgr) loadTools(c *client.Client) ([]service.ToolEndPoint, error) {
-	res, err := c.ListTools(context.Background(), mcp.ListToolsRequest{})
+func (mgr *ClientMgr) loadTools(ctx context.Context, c *client.Client) ([]service.ToolEndPoint, error) {
+	res, err := c.ListTools(ctx, mcp.ListToolsRequest{})
 	if err != nil {
 		return nil, err
 	}
@@ -101,28 +101,45 @@ func (mgr *ClientMgr) loadTools(c *client.Client) ([]service.ToolEndPoint, error
 		endpoint := service.ToolEndPoint{
 			Name: tool.Name,
 			Def:  shared.ConvertToFunctionDefinition(tool),
-			Handler: func(args string) (string, error) {
-				res, err := c.CallTool(context.Background(), mcp.CallToolRequest{
-					Params: mcp.CallToolParams{
-						Name:      tool.Name,
-						Arguments: json.RawMessage(args),
-					},
-				})
-				if err != nil {
-					return "", err
-				}
-				var builder strings.Builder
-				for _, content := range res.Content {
-					text, ok := content.(mcp.TextContent)
-					if ok {
-						builder.WriteString(text.Text)
-						builder.WriteByte('\n')
-					}
-				}
-				return builder.String(), nil
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return callTool(ctx, c, tool.Name, args)
 			},
+			ReadOnly: tool.Annotations.ReadOnlyHint != nil && *tool.Annotations.ReadOnlyHint,
 		}
 		endpointList = append(endpointList, endpoint)
 	}
 	return endpointList, nil
 }
+
+// CallTool calls a tool of the named server and returns the text content of the result.
+func (mgr *ClientMgr) CallTool(ctx context.Context, server string, name string, args string) (string, error) {
+	c, exist := mgr.clientMap[server]
+	if !exist {
+		return "", fmt.Errorf("mcp server %s not exist", server)
+	}
+	return callTool(ctx, c, name, args)
+}
+
+func callTool(ctx context.Context, c *client.Client, name string, args string) (string, error) {
+	res, err := c.CallTool(ctx, mcp.CallToolRequest{
+		Params: mcp.CallToolParams{
+			Name:      name,
+			Arguments: json.RawMessage(args),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var builder strings.Builder
+	for _, content := range res.Content {
+		text, ok := content.(mcp.TextContent)
+		if ok {
+			builder.WriteString(text.Text)
+			builder.WriteByte('\n')
+		}
+	}
+	if res.IsError {
+		return "", fmt.Errorf("tool %s failed: %s", name, builder.String())
+	}
+	return builder.String(), nil
+}
@@ -1,6 +1,7 @@
 package mcpclient_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	mcpclient "multi-agent/mcp-client"
@@ -9,10 +10,11 @@ import (
 
 func TestClientMgr(t *testing.T) {
 	t.Run("test load tools", func(t *testing.T) {
+		ctx := context.Background()
 		mgr := mcpclient.NewclientMgr()
-		mgr.NewMCPClient("uv", nil, "run", "/root/multi-agent/cmds/lsp-mcp.py")
-		mgr.NewMCPClient("/root/multi-agent/bin/mcpserver", nil)
-		res, err := mgr.LoadAllTools()
+		mgr.NewMCPClient(ctx, "uv", nil, "run", "/root/multi-agent/cmds/lsp-mcp.py")
+		mgr.NewMCPClient(ctx, "/root/multi-agent/bin/mcpserver", nil)
+		res, err := mgr.LoadAllTools(ctx)
 		if err != nil {
 			fmt.Printf("err: %v\n", err)
 		}
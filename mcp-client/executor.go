@@ -0,0 +1,41 @@
+package mcpclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"multi-agent/service"
+)
+
+// BashExecutor runs the workers' bash commands with the bash tool of an mcp server, e.g. bin/mcpserver.
+type BashExecutor struct {
+	mgr    *ClientMgr
+	server string
+}
+
+func NewBashExecutor(mgr *ClientMgr, server string) *BashExecutor {
+	return &BashExecutor{
+		mgr:    mgr,
+		server: server,
+	}
+}
+
+func (e *BashExecutor) Exec(ctx context.Context, cmd string, cwd string) (*service.BashRes, error) {
+	args, err := json.Marshal(map[string]string{
+		"Cmd": cmd,
+		"Dir": cwd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	text, err := e.mgr.CallTool(ctx, e.server, "bash", string(args))
+	if err != nil {
+		return nil, err
+	}
+	var res service.BashRes
+	err = json.Unmarshal([]byte(text), &res)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bash result from mcp server %s: %w", e.server, err)
+	}
+	return &res, nil
+}
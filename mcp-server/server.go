@@ -4,6 +4,7 @@ import (
 	"multi-agent/service"
 	"multi-agent/shared"
 
+	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 	"github.com/sashabaranov/go-openai"
 )
@@ -29,12 +30,17 @@ func NewServer(projectRoot string) (*Server, error) {
 		s.createfileTool,
 		s.runbashTool,
 	}
+	// read-only tools may run in parallel on the client side
+	readOnly := map[string]bool{
+		"view_file": true,
+	}
 	for _, tool := range tools {
 		def, handle := tool()
 		temp, err := shared.ConvertToMcpTool(def)
 		if err != nil {
 			return nil, err
 		} else {
+			temp.Annotations.ReadOnlyHint = mcp.ToBoolPtr(readOnly[def.Name])
 			s.mcpServer.AddTool(temp, handle)
 		}
 	}
@@ -163,7 +163,7 @@ func (s *Server) runbashTool() (openai.FunctionDefinition, server.ToolHandlerFun
 		if args.Dir == "" {
 			args.Dir = s.projectRoot
 		}
-		res, err := s.bashTool.Run(args.Cmd, args.Dir)
+		res, err := s.bashTool.Run(ctx, args.Cmd, args.Dir)
 		if err != nil {
 			return nil, err
 		}
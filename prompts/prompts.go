@@ -0,0 +1,173 @@
+// Package prompts renders the system prompts of the agents from text/template files. The templates
+// are embedded from templates/, a <name>.tmpl file in the override directory replaces the embedded
+// template of the same name.
+package prompts
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"multi-agent/config"
+	"multi-agent/service"
+	"multi-agent/usage"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var embedded embed.FS
+
+// Data are the variables of a prompt template.
+type Data struct {
+	// Role is the config role of the agent.
+	Role     string
+	UserGoal string
+	// Task is the task of a worker or the task the context agent refines, nil for the orchestrator.
+	Task service.Task
+	// TaskTypes are the types the orchestrator can create besides explore, reason, build and verify.
+	TaskTypes []TaskType
+	// Tools are the tool names of the agent.
+	Tools []string
+	// Subtasks are the names of the tools delegating subtasks to child agents.
+	Subtasks  []string
+	Repo      config.Executor
+	Budget    config.Budget
+	RunBudget config.RunBudget
+	// Rules are checked when the orchestrator creates a task.
+	Rules []*service.TaskRule
+	// FixCycles is the number of fix cycles after a failed verification, 0 when they are disabled.
+	FixCycles int
+	// Plan is the plan of the user goal, nil before it is written or without the plan mode.
+	Plan *service.Plan
+	// Usage is the usage of the user task so far.
+	Usage usage.Total
+}
+
+type TaskType struct {
+	Name        string
+	Description string
+}
+
+// BuiltinTaskTypes are described by the orchestrator template itself.
+var BuiltinTaskTypes = []string{"explore", "reason", "build", "verify"}
+
+var funcs = template.FuncMap{
+	"join":     strings.Join,
+	"contains": slices.Contains[[]string, string],
+}
+
+// Library holds the templates, one per role or task type.
+type Library struct {
+	templates *template.Template
+	// sources are the embedded file, the override file or "config" per template name.
+	sources map[string]string
+	texts   map[string]string
+}
+
+// Load parses the embedded templates and the templates of dir on top, an empty dir only uses the
+// embedded ones.
+func Load(dir string) (*Library, error) {
+	lib := &Library{
+		templates: template.New("").Funcs(funcs),
+		sources:   map[string]string{},
+		texts:     map[string]string{},
+	}
+	err := lib.parseFS(embedded, "templates", "embedded")
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		err = lib.parseFS(os.DirFS(dir), ".", dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lib, nil
+}
+
+// Embedded returns the library of the embedded templates.
+func Embedded() *Library {
+	lib, err := Load("")
+	if err != nil {
+		// the embedded templates are parsed by the tests
+		panic(err)
+	}
+	return lib
+}
+
+func (lib *Library) parseFS(fsys fs.FS, dir string, source string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+		err = lib.parse(name, string(data), path.Join(source, path.Base(file)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lib *Library) parse(name string, text string, source string) error {
+	_, err := lib.templates.New(name).Parse(text)
+	if err != nil {
+		return fmt.Errorf("parse prompt %s failed: %w", source, err)
+	}
+	lib.sources[name] = source
+	lib.texts[name] = text
+	return nil
+}
+
+// SetDefault adds the template unless the override directory defines it, used for the prompts of
+// the task types declared in the config.
+func (lib *Library) SetDefault(name string, text string) error {
+	if _, exist := lib.sources[name]; exist {
+		return nil
+	}
+	return lib.parse(name, text, "config")
+}
+
+// Render executes the template of the name, the result is trimmed.
+func (lib *Library) Render(name string, data Data) (string, error) {
+	if _, exist := lib.sources[name]; !exist {
+		return "", fmt.Errorf("no prompt template %q", name)
+	}
+	var builder strings.Builder
+	err := lib.templates.ExecuteTemplate(&builder, name, data)
+	if err != nil {
+		return "", fmt.Errorf("render prompt %s failed: %w", name, err)
+	}
+	return strings.TrimSpace(builder.String()), nil
+}
+
+// Source returns where the template was loaded from.
+func (lib *Library) Source(name string) string {
+	return lib.sources[name]
+}
+
+// Version identifies the text of the template, it changes with every edit of the template.
+func (lib *Library) Version(name string) string {
+	sum := sha256.Sum256([]byte(lib.texts[name]))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Names returns the template names in order.
+func (lib *Library) Names() []string {
+	names := make([]string, 0, len(lib.sources))
+	for name := range lib.sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
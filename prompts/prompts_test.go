@@ -0,0 +1,66 @@
+package prompts_test
+
+import (
+	"multi-agent/config"
+	"multi-agent/prompts"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLibrary(t *testing.T) {
+	data := prompts.Data{
+		Role:     config.RoleExplore,
+		UserGoal: "fix the bug",
+		Tools:    []string{"bash", "view_tool_log"},
+		Repo:     config.Executor{Type: config.ExecutorLocal, RepoPath: "/testbed"},
+		Budget:   config.Budget{MaxTurns: 40},
+	}
+	lib := prompts.Embedded()
+	for _, name := range lib.Names() {
+		if _, err := lib.Render(name, data); err != nil {
+			t.Errorf("render %s failed: %v", name, err)
+		}
+	}
+	explore, err := lib.Render("explore", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(explore, "Repository: `/testbed`") || !strings.Contains(explore, "at most 40 turns") {
+		t.Errorf("expect the environment in the explore prompt, got\n%s", explore)
+	}
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "explore.tmpl"), []byte("Explore {{.UserGoal}} with {{join .Tools \" and \"}}.\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "review.tmpl"), []byte("Review {{.UserGoal}}.\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err = prompts.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.SetDefault("review", "the config prompt")
+	lib.SetDefault("doc", "Document {{.UserGoal}}.")
+	testCases := map[string]string{
+		"explore": "Explore fix the bug with bash and view_tool_log.",
+		"review":  "Review fix the bug.",
+		"doc":     "Document fix the bug.",
+	}
+	for name, want := range testCases {
+		got, err := lib.Render(name, data)
+		if err != nil || got != want {
+			t.Errorf("render %s got %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if lib.Source("explore") != filepath.Join(dir, "explore.tmpl") || lib.Source("doc") != "config" {
+		t.Errorf("unexpected sources %q and %q", lib.Source("explore"), lib.Source("doc"))
+	}
+	if lib.Version("explore") == prompts.Embedded().Version("explore") {
+		t.Errorf("expect the override to change the version")
+	}
+}
@@ -0,0 +1,261 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrClosed = errors.New("protocol connection closed")
+
+// Conn is one side of the protocol. A single goroutine reads the frames, replies are routed to the
+// pending Call and every other message is queued for Receive.
+type Conn struct {
+	in     io.Reader
+	out    io.Writer
+	closer io.Closer
+	prefix string
+
+	writeMu sync.Mutex
+	nextID  atomic.Int64
+
+	mu      sync.Mutex
+	pending map[string]chan Envelope
+
+	// incoming is unbounded so a busy receiver never blocks the replies behind it
+	queue  []Envelope
+	notify chan struct{}
+	done   chan struct{}
+	err    error
+}
+
+// NewConn starts reading frames from in, prefix is put before the message IDs so the two sides never collide.
+func NewConn(in io.Reader, out io.Writer, prefix string) *Conn {
+	c := &Conn{
+		in:      in,
+		out:     out,
+		prefix:  prefix,
+		pending: map[string]chan Envelope{},
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if closer, ok := out.(io.Closer); ok {
+		c.closer = closer
+	}
+	go c.readLoop()
+	return c
+}
+
+// Dial opens the transport named by addr: "stdio", "fd:<n>" (a socket or pipe inherited from the driver),
+// "unix:<path>" or "tcp:<host:port>".
+func Dial(addr string, prefix string) (*Conn, error) {
+	kind, target, _ := strings.Cut(addr, ":")
+	switch kind {
+	case "", "stdio":
+		return NewConn(os.Stdin, os.Stdout, prefix), nil
+	case "fd":
+		fd, err := strconv.Atoi(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fd in %q: %w", addr, err)
+		}
+		file := os.NewFile(uintptr(fd), "protocol")
+		if file == nil {
+			return nil, fmt.Errorf("fd %d is not open", fd)
+		}
+		return NewConn(file, file, prefix), nil
+	case "unix", "tcp":
+		netConn, err := net.Dial(kind, target)
+		if err != nil {
+			return nil, err
+		}
+		return NewConn(netConn, netConn, prefix), nil
+	default:
+		return nil, fmt.Errorf("unknown protocol transport %q", addr)
+	}
+}
+
+func (c *Conn) readLoop() {
+	scanner := bufio.NewScanner(c.in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var env Envelope
+		err := json.Unmarshal(line, &env)
+		if err != nil || env.Type == "" {
+			// stray output, e.g. a print of a child process, is not a frame
+			log.Warn().Str("line", string(line)).Msg("skip invalid protocol frame")
+			continue
+		}
+		if env.Version != Version {
+			c.sendError(env.ID, CodeBadVersion, fmt.Sprintf("unsupported version %d, expect %d", env.Version, Version))
+			continue
+		}
+		if env.ReplyTo != "" {
+			c.mu.Lock()
+			ch, exist := c.pending[env.ReplyTo]
+			delete(c.pending, env.ReplyTo)
+			c.mu.Unlock()
+			if exist {
+				ch <- env
+			} else {
+				log.Warn().Str("reply_to", env.ReplyTo).Msg("skip reply to unknown request")
+			}
+			continue
+		}
+		c.mu.Lock()
+		c.queue = append(c.queue, env)
+		c.mu.Unlock()
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+	c.err = scanner.Err()
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	close(c.done)
+}
+
+func (c *Conn) newID() string {
+	return fmt.Sprintf("%s%d", c.prefix, c.nextID.Add(1))
+}
+
+func (c *Conn) write(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.out.Write(append(data, '\n'))
+	return err
+}
+
+func (c *Conn) send(typ string, replyTo string, payload any) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	env := Envelope{
+		Version: Version,
+		Type:    typ,
+		ID:      c.newID(),
+		ReplyTo: replyTo,
+		Payload: data,
+	}
+	return env.ID, c.write(env)
+}
+
+// Send sends a message that expects no reply and returns its ID.
+func (c *Conn) Send(typ string, payload any) (string, error) {
+	return c.send(typ, "", payload)
+}
+
+// Reply answers the request.
+func (c *Conn) Reply(req Envelope, typ string, payload any) error {
+	_, err := c.send(typ, req.ID, payload)
+	return err
+}
+
+// ReplyError answers the request with an error frame.
+func (c *Conn) ReplyError(req Envelope, code string, err error) error {
+	return c.sendError(req.ID, code, err.Error())
+}
+
+func (c *Conn) sendError(replyTo string, code string, msg string) error {
+	_, err := c.send(TypeError, replyTo, Error{Code: code, Message: msg})
+	return err
+}
+
+// Call sends a request and waits for its reply, an error frame is returned as *RemoteError.
+// A reply arriving after ctx is done is dropped.
+func (c *Conn) Call(ctx context.Context, typ string, payload any) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env := Envelope{
+		Version: Version,
+		Type:    typ,
+		ID:      c.newID(),
+		Payload: data,
+	}
+	ch := make(chan Envelope, 1)
+	c.mu.Lock()
+	c.pending[env.ID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, env.ID)
+		c.mu.Unlock()
+	}()
+
+	err = c.write(env)
+	if err != nil {
+		return Envelope{}, err
+	}
+	select {
+	case <-ctx.Done():
+		return Envelope{}, ctx.Err()
+	case <-c.done:
+		return Envelope{}, c.err
+	case reply := <-ch:
+		if reply.Type == TypeError {
+			var remote Error
+			err := reply.Decode(&remote)
+			if err != nil {
+				return reply, err
+			}
+			return reply, &RemoteError{Code: remote.Code, Message: remote.Message}
+		}
+		return reply, nil
+	}
+}
+
+// Receive returns the next message that is not a reply.
+func (c *Conn) Receive(ctx context.Context) (Envelope, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) != 0 {
+			env := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return env, nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return Envelope{}, ctx.Err()
+		case <-c.notify:
+		case <-c.done:
+			c.mu.Lock()
+			empty := len(c.queue) == 0
+			c.mu.Unlock()
+			if empty {
+				return Envelope{}, c.err
+			}
+		}
+	}
+}
+
+func (c *Conn) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
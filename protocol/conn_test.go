@@ -0,0 +1,90 @@
+package protocol_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"multi-agent/protocol"
+	"strings"
+	"testing"
+)
+
+// agentSide answers every task by running "echo <task>" through the driver.
+func agentSide(conn *protocol.Conn) {
+	ctx := context.Background()
+	for {
+		env, err := conn.Receive(ctx)
+		if err != nil {
+			return
+		}
+		if env.Type != protocol.TypeTask {
+			conn.ReplyError(env, protocol.CodeUnsupported, fmt.Errorf("unsupported %s", env.Type))
+			continue
+		}
+		var task protocol.Task
+		env.Decode(&task)
+		reply, err := conn.Call(ctx, protocol.TypeBash, protocol.BashRequest{Command: "echo " + task.Task})
+		if err != nil {
+			conn.Reply(env, protocol.TypeResult, protocol.Result{Status: protocol.StatusFailed, Error: err.Error()})
+			continue
+		}
+		var res protocol.BashResult
+		reply.Decode(&res)
+		conn.Reply(env, protocol.TypeResult, protocol.Result{Status: protocol.StatusDone, Response: res.Output})
+	}
+}
+
+func TestDriverRunTask(t *testing.T) {
+	toAgent, driverOut := io.Pipe()
+	agentIn, agentOut := io.Pipe()
+	// stray prints of the agent are skipped by the driver
+	go agentSide(protocol.NewConn(toAgent, agentOut, "a"))
+	go fmt.Fprintln(agentOut, "msg.Content: not a frame")
+
+	driver := protocol.NewDriver(protocol.NewConn(agentIn, driverOut, "d"), func(ctx context.Context, req protocol.BashRequest) (protocol.BashResult, error) {
+		if strings.Contains(req.Command, "fail") {
+			return protocol.BashResult{}, errors.New("container is gone")
+		}
+		return protocol.BashResult{Output: strings.TrimPrefix(req.Command, "echo ")}, nil
+	})
+	res, err := driver.RunTask(context.Background(), "fix the bug")
+	if err != nil {
+		t.Fatalf("run task failed: %v", err)
+	}
+	if res.Status != protocol.StatusDone || res.Response != "fix the bug" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	res, err = driver.RunTask(context.Background(), "fail")
+	if err != nil {
+		t.Fatalf("run task failed: %v", err)
+	}
+	if res.Status != protocol.StatusFailed || !strings.Contains(res.Error, "container is gone") {
+		t.Errorf("expect failed result with the driver error, got %+v", res)
+	}
+	_, err = driver.Hello(context.Background(), "test")
+	var remoteErr *protocol.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != protocol.CodeUnsupported {
+		t.Errorf("expect unsupported error frame, got %v", err)
+	}
+}
+
+func TestConnBadVersion(t *testing.T) {
+	in, peerOut := io.Pipe()
+	peerIn, out := io.Pipe()
+	protocol.NewConn(in, out, "a")
+	go fmt.Fprintln(peerOut, `{"version":99,"type":"task","id":"x1","payload":{"task":"t"}}`)
+	line, err := bufio.NewReader(peerIn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read reply failed: %v", err)
+	}
+	var env protocol.Envelope
+	var payload protocol.Error
+	json.Unmarshal(line, &env)
+	env.Decode(&payload)
+	if env.Type != protocol.TypeError || env.ReplyTo != "x1" || payload.Code != protocol.CodeBadVersion {
+		t.Errorf("expect bad version error frame, got %s", line)
+	}
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// BashHandler runs a command on behalf of the agent, e.g. in a SWE-bench container.
+type BashHandler func(ctx context.Context, req BashRequest) (BashResult, error)
+
+// PlanHandler decides on the plan of a task, e.g. by asking a human.
+type PlanHandler func(ctx context.Context, req PlanRequest) (PlanDecision, error)
+
+// Driver is the driver side of the protocol: it hands tasks to the agent and serves its bash requests.
+type Driver struct {
+	conn *Conn
+	bash BashHandler
+	plan PlanHandler
+}
+
+func NewDriver(conn *Conn, bash BashHandler) *Driver {
+	return &Driver{
+		conn: conn,
+		bash: bash,
+	}
+}
+
+// SetPlanHandler makes the driver ask the handler about the plans of the agent, without a handler
+// every plan is approved.
+func (d *Driver) SetPlanHandler(plan PlanHandler) {
+	d.plan = plan
+}
+
+// Hello announces the driver, the agent answers with its own hello.
+func (d *Driver) Hello(ctx context.Context, name string) (Hello, error) {
+	reply, err := d.conn.Call(ctx, TypeHello, Hello{Name: name, Versions: []int{Version}})
+	if err != nil {
+		return Hello{}, err
+	}
+	var hello Hello
+	err = reply.Decode(&hello)
+	return hello, err
+}
+
+// RunTask sends the task and serves the bash requests of the agent until the result of the task arrives.
+func (d *Driver) RunTask(ctx context.Context, task string) (Result, error) {
+	serveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go d.serve(serveCtx)
+
+	reply, err := d.conn.Call(ctx, TypeTask, Task{Task: task})
+	if err != nil {
+		return Result{}, err
+	}
+	var result Result
+	err = reply.Decode(&result)
+	return result, err
+}
+
+func (d *Driver) serve(ctx context.Context) {
+	for {
+		env, err := d.conn.Receive(ctx)
+		if err != nil {
+			return
+		}
+		switch env.Type {
+		case TypeBash:
+			d.serveBash(ctx, env)
+		case TypePlan:
+			d.servePlan(ctx, env)
+		case TypeHello:
+			d.conn.Reply(env, TypeHello, Hello{Name: "driver", Versions: []int{Version}})
+		case TypeResult:
+			// the result of a task resumed from a checkpoint, nobody waits for it
+		case TypeError:
+			// errors without a request, the agent reports them before it gives up on the task
+		default:
+			d.conn.ReplyError(env, CodeUnsupported, fmt.Errorf("driver does not handle %s messages", env.Type))
+		}
+	}
+}
+
+func (d *Driver) serveBash(ctx context.Context, env Envelope) {
+	var req BashRequest
+	err := env.Decode(&req)
+	if err != nil {
+		d.conn.ReplyError(env, CodeBadRequest, err)
+		return
+	}
+	res, err := d.bash(ctx, req)
+	if err != nil {
+		d.conn.ReplyError(env, CodeFailed, err)
+		return
+	}
+	d.conn.Reply(env, TypeBashResult, res)
+}
+
+func (d *Driver) servePlan(ctx context.Context, env Envelope) {
+	var req PlanRequest
+	err := env.Decode(&req)
+	if err != nil {
+		d.conn.ReplyError(env, CodeBadRequest, err)
+		return
+	}
+	if d.plan == nil {
+		d.conn.Reply(env, TypePlanResult, PlanDecision{Approved: true})
+		return
+	}
+	decision, err := d.plan(ctx, req)
+	if err != nil {
+		d.conn.ReplyError(env, CodeFailed, err)
+		return
+	}
+	d.conn.Reply(env, TypePlanResult, decision)
+}
+
+func (d *Driver) Close() error {
+	return d.conn.Close()
+}
+
+// ProtocolFD is the fd the agent finds the protocol socket on when started by StartAgent.
+const ProtocolFD = 3
+
+// StartAgent starts the agent binary with a socket pair on fd 3, so the agent's stdout and stderr
+// stay free for logs. The agent must be given "-proto fd:3", StartAgent adds it.
+func StartAgent(path string, args ...string) (*exec.Cmd, *Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create socket pair failed: %w", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "driver")
+	remote := os.NewFile(uintptr(fds[1]), "agent")
+	defer remote.Close()
+
+	cmd := exec.Command(path, append([]string{"-proto", fmt.Sprintf("fd:%d", ProtocolFD)}, args...)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	err = cmd.Start()
+	if err != nil {
+		local.Close()
+		return nil, nil, err
+	}
+	return cmd, NewConn(local, local, "d"), nil
+}
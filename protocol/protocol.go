@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version is bumped on every incompatible change of the envelope or the payloads, see docs/protocol.md.
+const Version = 1
+
+// Message types.
+const (
+	// TypeHello is sent by both sides after connecting, the payload is Hello.
+	TypeHello = "hello"
+	// TypeTask is a user task from the driver, the payload is Task. The agent answers with TypeResult.
+	TypeTask = "task"
+	// TypeBash asks the driver to run a command, the payload is BashRequest. The driver answers with TypeBashResult.
+	TypeBash = "bash"
+	// TypeBashResult is the answer to TypeBash, the payload is BashResult.
+	TypeBashResult = "bash_result"
+	// TypePlan asks the driver to approve the plan of a task, the payload is PlanRequest. The driver
+	// answers with TypePlanResult.
+	TypePlan = "plan"
+	// TypePlanResult is the answer to TypePlan, the payload is PlanDecision.
+	TypePlanResult = "plan_result"
+	// TypeResult is the final result of a task, the payload is Result.
+	TypeResult = "result"
+	// TypeError answers a request that failed, or reports a fatal error when ReplyTo is empty. The payload is Error.
+	TypeError = "error"
+)
+
+// Envelope frames every message, one json object per line.
+type Envelope struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	// ReplyTo is the ID of the request this message answers.
+	ReplyTo string          `json:"reply_to,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode unmarshals the payload into v.
+func (e Envelope) Decode(v any) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("%s message %s has no payload", e.Type, e.ID)
+	}
+	err := json.Unmarshal(e.Payload, v)
+	if err != nil {
+		return fmt.Errorf("decode %s message %s failed: %w", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+type Hello struct {
+	Name string `json:"name"`
+	// Versions lists the protocol versions the sender understands.
+	Versions []int `json:"versions"`
+}
+
+type Task struct {
+	Task string `json:"task"`
+}
+
+type BashRequest struct {
+	Command string `json:"command"`
+	Cwd     string `json:"cwd"`
+}
+
+type BashResult struct {
+	Code   int    `json:"code"`
+	Output string `json:"output"`
+}
+
+type PlanStep struct {
+	// Type is the task type of the step.
+	Type         string `json:"type"`
+	Goal         string `json:"goal"`
+	ExpectOutput string `json:"expect_output,omitempty"`
+}
+
+type PlanRequest struct {
+	Task  string     `json:"task"`
+	Steps []PlanStep `json:"steps"`
+	// Revision counts the plans written for the task, it grows with every rejection.
+	Revision int `json:"revision"`
+}
+
+type PlanDecision struct {
+	Approved bool `json:"approved"`
+	// Steps replace the steps of an approved plan, empty keeps them.
+	Steps []PlanStep `json:"steps,omitempty"`
+	// Feedback tells the orchestrator why the plan was rejected.
+	Feedback string `json:"feedback,omitempty"`
+}
+
+type Result struct {
+	// Response is the final response of the orchestrator.
+	Response string `json:"response"`
+	// Status is "done", "failed" or "cancelled".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes.
+const (
+	CodeBadRequest  = "bad_request"
+	CodeBadVersion  = "bad_version"
+	CodeUnsupported = "unsupported"
+	CodeFailed      = "failed"
+)
+
+// RemoteError is returned by Conn.Call when the peer answered with an error frame.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %s: %s", e.Code, e.Message)
+}
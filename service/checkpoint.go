@@ -0,0 +1,255 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+const checkpointVersion = 2
+
+// Checkpoint is the on-disk state of a TaskMgr, context items only keep the tool log ID.
+type Checkpoint struct {
+	Version  int
+	UserGoal string
+	PreTasks []TaskRecord
+	Pending  []TaskRecord `json:",omitempty"`
+	Plan     *Plan        `json:",omitempty"`
+	ToolLog  []ToolLogRecord
+}
+
+// TaskRecord stores a Task with its type as discriminator.
+type TaskRecord struct {
+	Type     string
+	Task     json.RawMessage
+	Subtasks []TaskRecord `json:",omitempty"`
+}
+
+type ToolLogRecord struct {
+	ID       int
+	ToolCall openai.ToolCall
+	ToolRes  string
+	ToolErr  string `json:",omitempty"`
+}
+
+func (mgr *TaskMgr) newTaskOfType(name string) (Task, error) {
+	def, ok := mgr.LookupTaskDef(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown task type %q", name)
+	}
+	return def.New(), nil
+}
+
+func encodeTask(task Task) (TaskRecord, error) {
+	name := TaskType(task)
+	if name == "" {
+		return TaskRecord{}, fmt.Errorf("can not encode task of type %T", task)
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		return TaskRecord{}, err
+	}
+	record := TaskRecord{Type: name, Task: data}
+	for _, subtask := range task.Base().Subtasks {
+		subRecord, err := encodeTask(subtask)
+		if err != nil {
+			return TaskRecord{}, err
+		}
+		record.Subtasks = append(record.Subtasks, subRecord)
+	}
+	return record, nil
+}
+
+func (mgr *TaskMgr) decodeTask(record TaskRecord) (Task, error) {
+	task, err := mgr.newTaskOfType(record.Type)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(record.Task, task)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s task failed: %w", record.Type, err)
+	}
+	task.Base().Type = record.Type
+	for _, subRecord := range record.Subtasks {
+		subtask, err := mgr.decodeTask(subRecord)
+		if err != nil {
+			return nil, err
+		}
+		err = mgr.fillTaskToolLog(subtask)
+		if err != nil {
+			return nil, err
+		}
+		task.Base().Subtasks = append(task.Base().Subtasks, subtask)
+	}
+	return task, nil
+}
+
+// Checkpoint captures the current state of the task manager.
+func (mgr *TaskMgr) Checkpoint() (*Checkpoint, error) {
+	cp := &Checkpoint{
+		Version:  checkpointVersion,
+		UserGoal: mgr.UserGoal,
+		Plan:     mgr.Plan,
+	}
+	for _, task := range mgr.PreTasks {
+		record, err := encodeTask(task)
+		if err != nil {
+			return nil, err
+		}
+		cp.PreTasks = append(cp.PreTasks, record)
+	}
+	for _, task := range mgr.Pending {
+		record, err := encodeTask(task)
+		if err != nil {
+			return nil, err
+		}
+		cp.Pending = append(cp.Pending, record)
+	}
+	for _, toolLog := range mgr.ToolLog.Entries() {
+		record := ToolLogRecord{
+			ID:       toolLog.ID,
+			ToolCall: toolLog.ToolCall,
+			ToolRes:  toolLog.ToolRes,
+		}
+		if toolLog.ToolErr != nil {
+			record.ToolErr = toolLog.ToolErr.Error()
+		}
+		cp.ToolLog = append(cp.ToolLog, record)
+	}
+	return cp, nil
+}
+
+// Restore replaces the state of the task manager and its tool log with the checkpoint.
+func (mgr *TaskMgr) Restore(cp *Checkpoint) error {
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d, expect %d", cp.Version, checkpointVersion)
+	}
+	toolLog := make([]*ToolExecLog, 0, len(cp.ToolLog))
+	for i, record := range cp.ToolLog {
+		if record.ID != i {
+			return fmt.Errorf("tool log record %d has ID %d", i, record.ID)
+		}
+		entry := &ToolExecLog{
+			ID:       record.ID,
+			ToolCall: record.ToolCall,
+			ToolRes:  record.ToolRes,
+		}
+		if record.ToolErr != "" {
+			entry.ToolErr = errors.New(record.ToolErr)
+		}
+		toolLog = append(toolLog, entry)
+	}
+	mgr.ToolLog.Reset(toolLog)
+
+	var preTasks []Task
+	for _, record := range cp.PreTasks {
+		task, err := mgr.decodeTask(record)
+		if err != nil {
+			return err
+		}
+		err = mgr.fillTaskToolLog(task)
+		if err != nil {
+			return err
+		}
+		if base := task.Base(); !base.Status.Done() {
+			// written before the tasks had a status, or with "finished" before it was "succeeded"
+			base.Status = TaskSucceeded
+			if base.Failure != "" {
+				base.Status = TaskFailed
+			}
+		}
+		preTasks = append(preTasks, task)
+	}
+	var pending []Task
+	for _, record := range cp.Pending {
+		task, err := mgr.decodeTask(record)
+		if err != nil {
+			return err
+		}
+		// the worker was interrupted, the task runs again and its worker sees the subtasks delegated
+		// before as finished, see NewChild
+		task.Base().Status = TaskPending
+		pending = append(pending, task)
+	}
+	nextID := 0
+	for _, task := range append(preTasks, pending...) {
+		nextID = max(nextID, maxTaskID(task))
+	}
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.UserGoal = cp.UserGoal
+	mgr.PreTasks = preTasks
+	mgr.Pending = pending
+	mgr.Plan = cp.Plan
+	mgr.nextID = nextID
+	return nil
+}
+
+// maxTaskID returns the largest ID in the tree of the task and its subtasks.
+func maxTaskID(task Task) int {
+	id := task.Base().ID
+	for _, subtask := range task.Base().Subtasks {
+		id = max(id, maxTaskID(subtask))
+	}
+	return id
+}
+
+func (mgr *TaskMgr) fillTaskToolLog(task Task) error {
+	return mgr.FillToolLog(TaskContext(task))
+}
+
+// SaveCheckpoint writes the checkpoint atomically, a crash never leaves a half written file.
+func (mgr *TaskMgr) SaveCheckpoint(path string) error {
+	cp, err := mgr.Checkpoint()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// LoadCheckpoint reads the checkpoint file into the task manager.
+func (mgr *TaskMgr) LoadCheckpoint(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cp Checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return fmt.Errorf("parse checkpoint %s failed: %w", path, err)
+	}
+	return mgr.Restore(&cp)
+}
+
+// saveCheckpoint is called after every task transition with mu held, failures are only logged
+// so a full disk does not break the running task.
+func (mgr *TaskMgr) saveCheckpoint() {
+	if mgr.CheckpointPath == "" {
+		return
+	}
+	err := mgr.SaveCheckpoint(mgr.CheckpointPath)
+	if err != nil {
+		log.Error().Err(err).Any("path", mgr.CheckpointPath).Msg("save checkpoint failed")
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// EstimateTokens approximates the tokens of text, about 4 bytes per token for code and English.
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// A summarised task keeps summaryLines lines of summaryLineLength bytes after its header.
+const (
+	summaryLines      = 8
+	summaryLineLength = 120
+)
+
+// summarizeTask keeps the header of the task and shortens the rest, the context items stay visible
+// as long as the task has few of them.
+func summarizeTask(task Task) string {
+	lines := strings.Split(strings.TrimSpace(task.FormatString()), "\n")
+	var builder strings.Builder
+	builder.WriteString(lines[0])
+	builder.WriteString("\nSummary (compacted):\n")
+	written := 0
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if written == summaryLines {
+			builder.WriteString(fmt.Sprintf("  ... %d more lines\n", len(lines)-1-i))
+			break
+		}
+		if len(line) > summaryLineLength {
+			line = TruncateUTF8(line, summaryLineLength) + "..."
+		}
+		builder.WriteString("  " + line + "\n")
+		written++
+	}
+	return builder.String()
+}
+
+// TruncateUTF8 cuts s to at most n bytes without splitting a rune.
+func TruncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !isRuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// TruncateUTF8Tail keeps at most the last n bytes of s without splitting a rune.
+func TruncateUTF8Tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	start := len(s) - n
+	for start < len(s) && !isRuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// renderHistory renders the finished tasks, summarising the oldest ones until the history fits
+// HistoryTokens. The dependencies of the current task and the last task are always kept in full.
+func (mgr *TaskMgr) renderHistory(current Task) []string {
+	texts := make([]string, len(mgr.PreTasks))
+	total := 0
+	for i, task := range mgr.PreTasks {
+		texts[i] = task.FormatString()
+		total += EstimateTokens(texts[i])
+	}
+	if mgr.HistoryTokens <= 0 {
+		return texts
+	}
+	var keep []int
+	if current != nil {
+		keep = current.Base().DependsOn
+	}
+	for i, task := range mgr.PreTasks[:max(len(mgr.PreTasks)-1, 0)] {
+		if total <= mgr.HistoryTokens {
+			break
+		}
+		if slices.Contains(keep, task.Base().ID) {
+			continue
+		}
+		summary := summarizeTask(task)
+		total += EstimateTokens(summary) - EstimateTokens(texts[i])
+		texts[i] = summary
+	}
+	return texts
+}
+
+// contextToolLogs returns the tool logs referenced by the finished tasks in order. A tool log
+// referenced twice and a call repeated later, e.g. viewing a file again after a build task
+// changed it, is superseded by its last occurrence.
+func (mgr *TaskMgr) contextToolLogs() []*ToolExecLog {
+	var logs []*ToolExecLog
+	for _, task := range mgr.PreTasks {
+		for _, item := range TaskContext(task) {
+			if item.ToolLog != nil {
+				logs = append(logs, item.ToolLog)
+			}
+		}
+	}
+	seenIDs := map[int]bool{}
+	seenCalls := map[string]bool{}
+	var res []*ToolExecLog
+	for i := len(logs) - 1; i >= 0; i-- {
+		call := logs[i].ToolCall.Function.Name + "\x00" + logs[i].ToolCall.Function.Arguments
+		if seenIDs[logs[i].ID] || seenCalls[call] {
+			continue
+		}
+		seenIDs[logs[i].ID] = true
+		seenCalls[call] = true
+		res = append(res, logs[i])
+	}
+	slices.Reverse(res)
+	return res
+}
+
+type ViewToolLogArgs struct {
+	ID     int
+	Offset int
+	Limit  int
+}
+
+const defaultViewLines = 200
+
+// ViewToolLogTool reads the full output of a tool log, outputs truncated to fit the context window point here.
+func (mgr *TaskMgr) ViewToolLogTool() ToolEndPoint {
+	def := openai.FunctionDefinition{
+		Name:        "view_tool_log",
+		Description: "Read the full output of an earlier tool call by its tool log ID, e.g. an output that was truncated to fit the context window",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"ID": {
+					Type:        jsonschema.Integer,
+					Description: "the id of the tool log",
+				},
+				"Offset": {
+					Type:        jsonschema.Integer,
+					Description: "the first line to read, starting from 0",
+				},
+				"Limit": {
+					Type:        jsonschema.Integer,
+					Description: fmt.Sprintf("the number of lines to read, default %d", defaultViewLines),
+				},
+			},
+			Required: []string{"ID"},
+		},
+	}
+	handler := func(ctx context.Context, args string) (string, error) {
+		var para ViewToolLogArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
+		}
+		entry, err := mgr.ToolLog.Get(para.ID)
+		if err != nil {
+			return "", err
+		}
+		if para.Limit <= 0 {
+			para.Limit = defaultViewLines
+		}
+		lines := strings.Split(entry.ReconstructToolMessage().Content, "\n")
+		start := min(max(para.Offset, 0), len(lines))
+		end := min(start+para.Limit, len(lines))
+		header := fmt.Sprintf("tool log #%d, lines %d-%d of %d\n", para.ID, start, end, len(lines))
+		return header + strings.Join(lines[start:end], "\n"), nil
+	}
+	return ToolEndPoint{
+		Name:     "view_tool_log",
+		Def:      def,
+		Handler:  handler,
+		ReadOnly: true,
+	}
+}
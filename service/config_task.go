@@ -0,0 +1,191 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"multi-agent/config"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ConfigTask is a task of a type declared in the config, Args are the arguments of the create tool
+// and Result the arguments of the finish tool.
+type ConfigTask struct {
+	TaskBase
+	Args   map[string]any
+	Result map[string]any `json:",omitempty"`
+
+	format *template.Template
+}
+
+// GetTask returns the Task argument, or all arguments when the type has none.
+func (t *ConfigTask) GetTask() string {
+	if task, ok := t.Args["Task"].(string); ok {
+		return task
+	}
+	data, _ := json.Marshal(t.Args)
+	return string(data)
+}
+
+func (t *ConfigTask) FormatString() string {
+	var builder strings.Builder
+	writeHeader(&builder, strings.ToUpper(t.Type), &t.TaskBase)
+	if t.format != nil {
+		var text strings.Builder
+		err := t.format.Execute(&text, t)
+		if err != nil {
+			text.Reset()
+			text.WriteString(fmt.Sprintf("format %s task failed: %s", t.Type, err))
+		}
+		builder.WriteString(strings.TrimRight(text.String(), "\n") + "\n")
+	} else {
+		writeFields(&builder, t.Args)
+		if len(t.Result) != 0 {
+			builder.WriteString("\nResult:\n")
+			writeFields(&builder, t.Result)
+		}
+	}
+	writeSubtasks(&builder, &t.TaskBase)
+	writeContext(&builder, t.Context)
+	writeStatus(&builder, &t.TaskBase)
+	return builder.String()
+}
+
+// writeFields writes the fields in name order, values other than strings as JSON.
+func writeFields(builder *strings.Builder, fields map[string]any) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value, ok := fields[name].(string)
+		if !ok {
+			data, _ := json.Marshal(fields[name])
+			value = string(data)
+		}
+		builder.WriteString(fmt.Sprintf("%s: %s\n", name, value))
+	}
+}
+
+// parseSchema returns the JSON schema of tool parameters, an empty schema is an object without properties.
+func parseSchema(raw json.RawMessage) (map[string]any, error) {
+	schema := map[string]any{}
+	if len(raw) != 0 {
+		err := json.Unmarshal(raw, &schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if schema["type"] == nil {
+		schema["type"] = "object"
+	}
+	if schema["type"] != "object" {
+		return nil, fmt.Errorf("the parameters must be an object, got %v", schema["type"])
+	}
+	if _, ok := schema["properties"].(map[string]any); !ok {
+		schema["properties"] = map[string]any{}
+	}
+	return schema, nil
+}
+
+// NewConfigTaskDef builds the task type declared in the config.
+func NewConfigTaskDef(taskType config.TaskType) (*TaskDef, error) {
+	createSchema, err := parseSchema(taskType.CreateSchema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid create schema of task type %s: %w", taskType.Name, err)
+	}
+	createSchema["properties"].(map[string]any)["DependsOn"] = map[string]any{
+		"type":        "array",
+		"description": dependsOnDescription,
+		"items":       map[string]any{"type": "integer"},
+	}
+	finishSchema, err := parseSchema(taskType.FinishSchema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid finish schema of task type %s: %w", taskType.Name, err)
+	}
+	var format *template.Template
+	if taskType.Format != "" {
+		format, err = template.New(taskType.Name).Parse(taskType.Format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format of task type %s: %w", taskType.Name, err)
+		}
+	}
+
+	createName := fmt.Sprintf("create_%s_task", taskType.Name)
+	finishName := fmt.Sprintf("finish_%s_task", taskType.Name)
+	description := taskType.Description
+	if description == "" {
+		description = fmt.Sprintf("Creates a %s task", taskType.Name)
+	}
+	return &TaskDef{
+		Name:     taskType.Name,
+		Role:     taskType.AgentRole(),
+		Prompt:   taskType.Prompt,
+		Tools:    taskType.Tools,
+		Subtasks: taskType.Subtasks,
+		New:      func() Task { return &ConfigTask{format: format} },
+		CreateTool: func() ToolEndPoint {
+			return ToolEndPoint{
+				Name: createName,
+				Def:  openai.FunctionDefinition{Name: createName, Description: description, Parameters: createSchema},
+			}
+		},
+		FinishTool: func() ToolEndPoint {
+			return ToolEndPoint{
+				Name: finishName,
+				Def: openai.FunctionDefinition{
+					Name:        finishName,
+					Description: fmt.Sprintf("Finish the %s task with its result", taskType.Name),
+					Parameters:  finishSchema,
+				},
+			}
+		},
+		Create: func(args string) (Task, []int, error) {
+			var para struct {
+				DependsOn []int
+			}
+			err := json.Unmarshal([]byte(args), &para)
+			if err != nil {
+				return nil, nil, err
+			}
+			task := &ConfigTask{Args: map[string]any{}, format: format}
+			err = json.Unmarshal([]byte(args), &task.Args)
+			if err != nil {
+				return nil, nil, err
+			}
+			delete(task.Args, "DependsOn")
+			return task, para.DependsOn, nil
+		},
+		Finish: func(mgr *TaskMgr, task Task, args string) (func(), error) {
+			configTask, err := taskOf[*ConfigTask](task)
+			if err != nil {
+				return nil, err
+			}
+			var para struct {
+				Context []ContextItem
+			}
+			err = json.Unmarshal([]byte(args), &para)
+			if err != nil {
+				return nil, err
+			}
+			result := map[string]any{}
+			err = json.Unmarshal([]byte(args), &result)
+			if err != nil {
+				return nil, err
+			}
+			err = mgr.FillToolLog(para.Context)
+			if err != nil {
+				return nil, err
+			}
+			delete(result, "Context")
+			return func() {
+				configTask.Result = result
+				configTask.Context = para.Context
+			}, nil
+		},
+	}, nil
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"multi-agent/protocol"
+	"sync"
+)
+
+// BashExecutor runs the commands of the workers' bash tool.
+type BashExecutor interface {
+	Exec(ctx context.Context, cmd string, cwd string) (*BashRes, error)
+}
+
+// LocalExecutor runs commands in this process with BashTool, file changes are tracked against the repo.
+// Commands run one at a time, the change tracking of parallel commands would mix up.
+type LocalExecutor struct {
+	mu       sync.Mutex
+	tool     BashTool
+	repoPath string
+}
+
+func NewLocalExecutor(repoPath string) (*LocalExecutor, error) {
+	e := &LocalExecutor{repoPath: repoPath}
+	err := e.tool.AddRepo(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("init local executor for %s failed: %w", repoPath, err)
+	}
+	return e, nil
+}
+
+func (e *LocalExecutor) Exec(ctx context.Context, cmd string, cwd string) (*BashRes, error) {
+	if cwd == "" {
+		cwd = e.repoPath
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tool.Run(ctx, cmd, cwd)
+}
+
+// RemoteExecutor sends the commands to the external driver over the protocol connection,
+// e.g. agent.py running them in a SWE-bench container.
+type RemoteExecutor struct {
+	conn *protocol.Conn
+}
+
+func NewRemoteExecutor(conn *protocol.Conn) *RemoteExecutor {
+	return &RemoteExecutor{conn: conn}
+}
+
+func (e *RemoteExecutor) Exec(ctx context.Context, cmd string, cwd string) (*BashRes, error) {
+	reply, err := e.conn.Call(ctx, protocol.TypeBash, protocol.BashRequest{
+		Command: cmd,
+		Cwd:     cwd,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("driver failed to run command: %w", err)
+	}
+	var res protocol.BashResult
+	err = reply.Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	return &BashRes{ExitCode: res.Code, Output: res.Output}, nil
+}
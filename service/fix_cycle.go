@@ -0,0 +1,127 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// checkedBuilds returns the succeeded build tasks the verify task depends on, directly or through other
+// tasks that are not build tasks, called with mu held.
+func (mgr *TaskMgr) checkedBuilds(task *VerifyTask) []int {
+	var builds []int
+	seen := map[int]bool{}
+	queue := append([]int{}, task.DependsOn...)
+	for len(queue) != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		i := taskIndex(mgr.PreTasks, id)
+		if seen[id] || i < 0 {
+			continue
+		}
+		seen[id] = true
+		dep := mgr.PreTasks[i]
+		if _, ok := dep.(*BuildTask); ok {
+			if dep.Base().Status == TaskSucceeded {
+				builds = append(builds, id)
+			}
+			continue
+		}
+		queue = append(queue, dep.Base().DependsOn...)
+	}
+	slices.Sort(builds)
+	return builds
+}
+
+// fixChain returns the failed verify tasks of the fix cycles leading to the verify task, oldest first
+// and ending with the task.
+func (mgr *TaskMgr) fixChain(task *VerifyTask) []*VerifyTask {
+	chain := []*VerifyTask{task}
+	for {
+		prevID := 0
+		for _, id := range task.Checks {
+			if i := taskIndex(mgr.PreTasks, id); i >= 0 {
+				prevID = max(prevID, mgr.PreTasks[i].Base().FixOf)
+			}
+		}
+		i := taskIndex(mgr.PreTasks, prevID)
+		if i < 0 {
+			break
+		}
+		prev, ok := mgr.PreTasks[i].(*VerifyTask)
+		if !ok || slices.Contains(chain, prev) {
+			break
+		}
+		chain = append(chain, prev)
+		task = prev
+	}
+	slices.Reverse(chain)
+	return chain
+}
+
+// startFixCycle links the merged verify task to the build tasks it checked. When the verification
+// failed it creates a build task fixing the failure and a verify task repeating the verification,
+// unless the changes already went through MaxFixCycles fix cycles. Called with mu held.
+func (mgr *TaskMgr) startFixCycle(task *VerifyTask) {
+	task.Checks = mgr.checkedBuilds(task)
+	if !task.Failed() || mgr.MaxFixCycles <= 0 || len(task.Checks) == 0 {
+		return
+	}
+	chain := mgr.fixChain(task)
+	cycles := len(chain) - 1
+	if cycles >= mgr.MaxFixCycles {
+		var builder strings.Builder
+		for _, verify := range chain {
+			builder.WriteString(fmt.Sprintf("- verify #%d of build %s: %s, %s\n", verify.ID, formatIDs(verify.Checks), verify.Result, firstLine(verify.Conclusion)))
+		}
+		builder.WriteString(fmt.Sprintf("Stopped after %d fix cycles, the changes still fail the verification. Decide how to continue, e.g. explore the failure, change the approach or report it.", cycles))
+		task.FixSummary = builder.String()
+		return
+	}
+
+	var goal strings.Builder
+	goal.WriteString(fmt.Sprintf("Fix the problems verify task #%d found in the changes of build task %s.\n", task.ID, formatIDs(task.Checks)))
+	goal.WriteString(fmt.Sprintf("Result: %s\nConclusion: %s\n", task.Result, task.Conclusion))
+	if len(task.Evidence) != 0 {
+		goal.WriteString(fmt.Sprintf("The evidence is in the context items %s of verify task #%d.\n", formatIDs(task.Evidence), task.ID))
+	}
+	for _, id := range chain[0].Checks {
+		if i := taskIndex(mgr.PreTasks, id); i >= 0 {
+			goal.WriteString(fmt.Sprintf("Goal of build task #%d: %s\n", id, mgr.PreTasks[i].GetTask()))
+		}
+	}
+	fix := &BuildTask{Task: strings.TrimSpace(goal.String())}
+	dependsOn := []int{task.ID}
+	fixID, err := mgr.addFixTask(buildTaskDef, fix, CreateBuildTaskArgs{Task: fix.Task, DependsOn: dependsOn}, dependsOn, task, cycles+1)
+	if err != nil {
+		log.Error().Err(err).Any("task", task.ID).Msg("create fix task failed")
+		return
+	}
+	verify := &VerifyTask{Task: task.Task}
+	dependsOn = []int{fixID}
+	_, err = mgr.addFixTask(verifyTaskDef, verify, CreateVerifyTaskArgs{Task: verify.Task, DependsOn: dependsOn}, dependsOn, task, cycles+1)
+	if err != nil {
+		log.Error().Err(err).Any("task", task.ID).Msg("create verify task of the fix failed")
+	}
+}
+
+// addFixTask adds a task of the fix cycle of the failed verify task, args are the create arguments a
+// retry creates the task from.
+func (mgr *TaskMgr) addFixTask(def *TaskDef, task Task, args any, dependsOn []int, failed *VerifyTask, cycle int) (int, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+	base := task.Base()
+	base.CreateArgs = string(data)
+	base.FixOf = failed.ID
+	return mgr.addTask(def, task, dependsOn, fmt.Sprintf("fix cycle %d of #%d", cycle, failed.ID))
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return line
+}
@@ -0,0 +1,408 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// PlanStep is a step of the plan, Task links it to the task created for it.
+type PlanStep struct {
+	Type         string
+	Goal         string
+	ExpectOutput string `json:",omitempty"`
+	Task         int    `json:",omitempty"`
+}
+
+// Plan is the ordered list of steps the orchestrator writes before the first task, every agent sees it
+// in its task history.
+type Plan struct {
+	Steps []PlanStep
+	// Approved is set when the driver approved the plan.
+	Approved bool `json:",omitempty"`
+	// Revision counts the changes of the plan.
+	Revision int
+}
+
+// GetPlan returns a copy of the plan, nil before the orchestrator wrote one.
+func (mgr *TaskMgr) GetPlan() *Plan {
+	root := mgr.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.Plan == nil {
+		return nil
+	}
+	plan := *root.Plan
+	plan.Steps = slices.Clone(plan.Steps)
+	return &plan
+}
+
+// checkSteps checks the task types of the steps, called without mu held.
+func (mgr *TaskMgr) checkSteps(steps []PlanStep) error {
+	for i, step := range steps {
+		if _, ok := mgr.LookupTaskDef(step.Type); !ok {
+			return fmt.Errorf("step %d has unknown task type %q", i+1, step.Type)
+		}
+		if strings.TrimSpace(step.Goal) == "" {
+			return fmt.Errorf("step %d has no goal", i+1)
+		}
+	}
+	return nil
+}
+
+// updatePlan applies the change to the plan of the root task manager and saves the checkpoint.
+func (mgr *TaskMgr) updatePlan(update func(plan *Plan) error) error {
+	root := mgr.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.Plan == nil {
+		return fmt.Errorf("there is no plan yet")
+	}
+	err := update(root.Plan)
+	if err != nil {
+		return err
+	}
+	root.Plan.Revision++
+	root.saveCheckpoint()
+	return nil
+}
+
+// SetPlan replaces the plan with the steps, the new plan needs another approval.
+func (mgr *TaskMgr) SetPlan(steps []PlanStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("the plan has no steps")
+	}
+	err := mgr.checkSteps(steps)
+	if err != nil {
+		return err
+	}
+	root := mgr.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.Plan == nil {
+		root.Plan = &Plan{}
+	}
+	root.Plan.Steps = slices.Clone(steps)
+	root.Plan.Approved = false
+	root.Plan.Revision++
+	root.saveCheckpoint()
+	return nil
+}
+
+// ApprovePlan marks the plan as approved by the driver, steps replace the steps of the plan when the
+// driver edited them.
+func (mgr *TaskMgr) ApprovePlan(steps []PlanStep) error {
+	if steps != nil {
+		if len(steps) == 0 {
+			return fmt.Errorf("the edited plan has no steps")
+		}
+		err := mgr.checkSteps(steps)
+		if err != nil {
+			return fmt.Errorf("invalid edited plan: %w", err)
+		}
+	}
+	return mgr.updatePlan(func(plan *Plan) error {
+		if steps != nil {
+			plan.Steps = slices.Clone(steps)
+		}
+		plan.Approved = true
+		return nil
+	})
+}
+
+// stepIndex converts the 1-based step number to an index of the steps, n is the number of valid positions.
+func stepIndex(number int, n int) (int, error) {
+	if number < 1 || number > n {
+		return 0, fmt.Errorf("invalid step %d, expect 1 to %d", number, n)
+	}
+	return number - 1, nil
+}
+
+// InsertPlanStep inserts the step so that it becomes step number of the plan.
+func (mgr *TaskMgr) InsertPlanStep(number int, step PlanStep) error {
+	err := mgr.checkSteps([]PlanStep{step})
+	if err != nil {
+		return err
+	}
+	step.Task = 0
+	return mgr.updatePlan(func(plan *Plan) error {
+		i, err := stepIndex(number, len(plan.Steps)+1)
+		if err != nil {
+			return err
+		}
+		plan.Steps = slices.Insert(plan.Steps, i, step)
+		return nil
+	})
+}
+
+// RemovePlanStep removes a step no task was created for.
+func (mgr *TaskMgr) RemovePlanStep(number int) error {
+	return mgr.updatePlan(func(plan *Plan) error {
+		i, err := stepIndex(number, len(plan.Steps))
+		if err != nil {
+			return err
+		}
+		if plan.Steps[i].Task != 0 {
+			return fmt.Errorf("step %d is done by task #%d, cancel the task instead", number, plan.Steps[i].Task)
+		}
+		plan.Steps = slices.Delete(plan.Steps, i, i+1)
+		return nil
+	})
+}
+
+// MovePlanStep moves the step from to the position to.
+func (mgr *TaskMgr) MovePlanStep(from int, to int) error {
+	return mgr.updatePlan(func(plan *Plan) error {
+		i, err := stepIndex(from, len(plan.Steps))
+		if err != nil {
+			return err
+		}
+		j, err := stepIndex(to, len(plan.Steps))
+		if err != nil {
+			return err
+		}
+		step := plan.Steps[i]
+		plan.Steps = slices.Insert(slices.Delete(plan.Steps, i, i+1), j, step)
+		return nil
+	})
+}
+
+// linkPlanStep links the task to the first step of its type without a task, called with mu held.
+func (mgr *TaskMgr) linkPlanStep(task Task) {
+	if mgr.Plan == nil {
+		return
+	}
+	for i, step := range mgr.Plan.Steps {
+		if step.Task == 0 && step.Type == TaskType(task) {
+			mgr.Plan.Steps[i].Task = task.Base().ID
+			return
+		}
+	}
+}
+
+// taskStatus returns the status of the task, called with mu held.
+func (mgr *TaskMgr) taskStatus(id int) TaskStatus {
+	i := taskIndex(mgr.Pending, id)
+	if i >= 0 {
+		return mgr.Pending[i].Base().Status
+	}
+	i = taskIndex(mgr.PreTasks, id)
+	if i >= 0 {
+		return mgr.PreTasks[i].Base().Status
+	}
+	return ""
+}
+
+// writePlan writes the plan with the status of the tasks of its steps.
+func (mgr *TaskMgr) writePlan(builder *strings.Builder) {
+	root := mgr.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.Plan == nil {
+		return
+	}
+	approved := ""
+	if root.Plan.Approved {
+		approved = ", approved"
+	}
+	builder.WriteString(fmt.Sprintf("### PLAN (revision %d%s)\n", root.Plan.Revision, approved))
+	for i, step := range root.Plan.Steps {
+		builder.WriteString(fmt.Sprintf("%d. [%s] %s", i+1, step.Type, step.Goal))
+		if step.ExpectOutput != "" {
+			builder.WriteString(fmt.Sprintf(" -> expect: %s", step.ExpectOutput))
+		}
+		if step.Task == 0 {
+			builder.WriteString(" (todo)\n")
+			continue
+		}
+		status := root.taskStatus(step.Task)
+		if status == "" {
+			status = TaskPending
+		}
+		builder.WriteString(fmt.Sprintf(" (task #%d, %s)\n", step.Task, status))
+	}
+	builder.WriteByte('\n')
+}
+
+var planStepProperties = map[string]jsonschema.Definition{
+	"Type": {
+		Type:        jsonschema.String,
+		Description: "the task type of the step, e.g. explore, reason, build or verify",
+	},
+	"Goal": {
+		Type:        jsonschema.String,
+		Description: "the goal of the task of the step",
+	},
+	"ExpectOutput": {
+		Type:        jsonschema.String,
+		Description: "what the task of the step must deliver",
+	},
+}
+
+type SetPlanArgs struct {
+	Steps []PlanStep
+}
+
+// SetPlanTool lets the planner write the plan.
+func (mgr *TaskMgr) SetPlanTool() ToolEndPoint {
+	def := openai.FunctionDefinition{
+		Name:        "set_plan",
+		Description: "Write the plan of the user goal as ordered steps, each step becomes one task. Replaces the current plan",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"Steps": {
+					Type:        jsonschema.Array,
+					Description: "the steps in execution order",
+					Items: &jsonschema.Definition{
+						Type:       jsonschema.Object,
+						Properties: planStepProperties,
+						Required:   []string{"Type", "Goal", "ExpectOutput"},
+					},
+				},
+			},
+			Required: []string{"Steps"},
+		},
+	}
+	handler := func(ctx context.Context, args string) (string, error) {
+		var para SetPlanArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
+		}
+		for i := range para.Steps {
+			para.Steps[i].Task = 0
+		}
+		err = mgr.SetPlan(para.Steps)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("the plan has %d steps", len(para.Steps)), nil
+	}
+	return ToolEndPoint{
+		Name:    "set_plan",
+		Def:     def,
+		Handler: handler,
+	}
+}
+
+type InsertPlanStepArgs struct {
+	Step         int
+	Type         string
+	Goal         string
+	ExpectOutput string
+}
+
+type RemovePlanStepArgs struct {
+	Step int
+}
+
+type MovePlanStepArgs struct {
+	From int
+	To   int
+}
+
+// PlanTools let the orchestrator revise the plan.
+func (mgr *TaskMgr) PlanTools() []ToolEndPoint {
+	insertProperties := map[string]jsonschema.Definition{
+		"Step": {
+			Type:        jsonschema.Integer,
+			Description: "the number the new step gets, the steps from this number on move down",
+		},
+	}
+	for name, property := range planStepProperties {
+		insertProperties[name] = property
+	}
+	insert := ToolEndPoint{
+		Name: "insert_plan_step",
+		Def: openai.FunctionDefinition{
+			Name:        "insert_plan_step",
+			Description: "Insert a step into the plan",
+			Parameters: jsonschema.Definition{
+				Type:       jsonschema.Object,
+				Properties: insertProperties,
+				Required:   []string{"Step", "Type", "Goal", "ExpectOutput"},
+			},
+		},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			var para InsertPlanStepArgs
+			err := json.Unmarshal([]byte(args), &para)
+			if err != nil {
+				return "", err
+			}
+			err = mgr.InsertPlanStep(para.Step, PlanStep{Type: para.Type, Goal: para.Goal, ExpectOutput: para.ExpectOutput})
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("inserted step %d", para.Step), nil
+		},
+	}
+	remove := ToolEndPoint{
+		Name: "remove_plan_step",
+		Def: openai.FunctionDefinition{
+			Name:        "remove_plan_step",
+			Description: "Remove a step no task was created for from the plan",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"Step": {
+						Type:        jsonschema.Integer,
+						Description: "the number of the step to remove",
+					},
+				},
+				Required: []string{"Step"},
+			},
+		},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			var para RemovePlanStepArgs
+			err := json.Unmarshal([]byte(args), &para)
+			if err != nil {
+				return "", err
+			}
+			err = mgr.RemovePlanStep(para.Step)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("removed step %d", para.Step), nil
+		},
+	}
+	move := ToolEndPoint{
+		Name: "move_plan_step",
+		Def: openai.FunctionDefinition{
+			Name:        "move_plan_step",
+			Description: "Move a step of the plan to another position",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"From": {
+						Type:        jsonschema.Integer,
+						Description: "the number of the step to move",
+					},
+					"To": {
+						Type:        jsonschema.Integer,
+						Description: "the number of the step after the move",
+					},
+				},
+				Required: []string{"From", "To"},
+			},
+		},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			var para MovePlanStepArgs
+			err := json.Unmarshal([]byte(args), &para)
+			if err != nil {
+				return "", err
+			}
+			err = mgr.MovePlanStep(para.From, para.To)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("moved step %d to %d", para.From, para.To), nil
+		},
+	}
+	return []ToolEndPoint{insert, remove, move}
+}
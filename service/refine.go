@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func contextIndex(items []ContextItem, id int) int {
+	return slices.IndexFunc(items, func(item ContextItem) bool { return item.ID == id })
+}
+
+// refineContext replaces the context item oldID of the finished task with the tool log newID, an empty
+// desc keeps the description.
+func (mgr *TaskMgr) refineContext(task Task, oldID int, newID int, desc string) error {
+	entry, err := mgr.ToolLog.Get(newID)
+	if err != nil {
+		return err
+	}
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	items := TaskContext(task)
+	i := contextIndex(items, oldID)
+	if i < 0 {
+		return fmt.Errorf("task #%d has no context item #%d", task.Base().ID, oldID)
+	}
+	if newID != oldID && contextIndex(items, newID) >= 0 {
+		return fmt.Errorf("task #%d already has context item #%d, drop #%d instead", task.Base().ID, newID, oldID)
+	}
+	items[i].ID = newID
+	items[i].ToolLog = entry
+	if desc != "" {
+		items[i].Desc = desc
+	}
+	mgr.recordTask(task, "refined", fmt.Sprintf("#%d -> #%d", oldID, newID))
+	mgr.saveCheckpoint()
+	return nil
+}
+
+func (mgr *TaskMgr) dropContext(task Task, id int) error {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	items := TaskContext(task)
+	i := contextIndex(items, id)
+	if i < 0 {
+		return fmt.Errorf("task #%d has no context item #%d", task.Base().ID, id)
+	}
+	task.Base().Context = slices.Delete(items, i, i+1)
+	mgr.recordTask(task, "refined", fmt.Sprintf("dropped #%d", id))
+	mgr.saveCheckpoint()
+	return nil
+}
+
+// GetRefineContextPrompt renders the task history with the finished task whose context is refined.
+func (mgr *TaskMgr) GetRefineContextPrompt(task Task) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("** USER PRIMARY GOAL **: %s\n", mgr.UserGoal))
+	builder.WriteString("### TASK HISTORY\n")
+	var earlier []string
+	for i, text := range mgr.renderHistory(task) {
+		if mgr.PreTasks[i] != task {
+			earlier = append(earlier, text)
+		}
+	}
+	if len(earlier) != 0 {
+		builder.WriteString("** Completed Tasks **\n")
+		builder.WriteString(strings.Join(earlier, ""))
+		builder.WriteByte('\n')
+	}
+	builder.WriteString(fmt.Sprintf("** Task To Refine **\n%s\n", task.FormatString()))
+	builder.WriteString(fmt.Sprintf("Refine the context items of task #%d above.\n", task.Base().ID))
+	return builder.String()
+}
+
+type RefineContextArgs struct {
+	OldID int
+	NewID int
+	Desc  string
+}
+
+// RefineContextTool replaces a context item of the task, e.g. a whole file with the lines that matter.
+func (mgr *TaskMgr) RefineContextTool(task Task) ToolEndPoint {
+	def := openai.FunctionDefinition{
+		Name:        "refine_context",
+		Description: "Replace a context item of the task with the result of a narrower tool call, or rewrite its description",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"OldID": {
+					Type:        jsonschema.Integer,
+					Description: "the tool log id of the context item to replace",
+				},
+				"NewID": {
+					Type:        jsonschema.Integer,
+					Description: "the tool log id of the narrower result, the same as OldID to only rewrite the description",
+				},
+				"Desc": {
+					Type:        jsonschema.String,
+					Description: "the new description of the context item, empty keeps the description",
+				},
+			},
+			Required: []string{"OldID", "NewID"},
+		},
+	}
+	handler := func(ctx context.Context, args string) (string, error) {
+		var para RefineContextArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
+		}
+		err = mgr.refineContext(task, para.OldID, para.NewID, para.Desc)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("context item #%d of task #%d replaced by #%d", para.OldID, task.Base().ID, para.NewID), nil
+	}
+	return ToolEndPoint{
+		Name:    "refine_context",
+		Def:     def,
+		Handler: handler,
+	}
+}
+
+type DropContextArgs struct {
+	ID int
+}
+
+// DropContextTool removes a context item of the task, e.g. one already in the context of an earlier task.
+func (mgr *TaskMgr) DropContextTool(task Task) ToolEndPoint {
+	def := openai.FunctionDefinition{
+		Name:        "drop_context",
+		Description: "Remove a context item of the task that is irrelevant or duplicates the context of an earlier task",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"ID": {
+					Type:        jsonschema.Integer,
+					Description: "the tool log id of the context item",
+				},
+			},
+			Required: []string{"ID"},
+		},
+	}
+	handler := func(ctx context.Context, args string) (string, error) {
+		var para DropContextArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
+		}
+		err = mgr.dropContext(task, para.ID)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("context item #%d of task #%d dropped", para.ID, task.Base().ID), nil
+	}
+	return ToolEndPoint{
+		Name:    "drop_context",
+		Def:     def,
+		Handler: handler,
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func (mgr *TaskMgr) root() *TaskMgr {
+	for mgr.parent != nil {
+		mgr = mgr.parent
+	}
+	return mgr
+}
+
+// allocID returns the next task ID of the task tree, called on the root without mu held.
+func (mgr *TaskMgr) allocID() int {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.nextID++
+	return mgr.nextID
+}
+
+// Depth returns the nesting depth of the tasks of the task manager, 0 for the tasks of the orchestrator.
+func (mgr *TaskMgr) Depth() int {
+	return mgr.depth
+}
+
+// NewChild returns the task manager of the subtasks the worker of the task delegates, the subtasks
+// of an earlier run of the worker are its finished tasks.
+func (mgr *TaskMgr) NewChild(task Task) (*TaskMgr, error) {
+	if mgr.depth >= mgr.MaxDepth {
+		return nil, fmt.Errorf("task #%d is at depth %d, subtasks are limited to depth %d", task.Base().ID, mgr.depth, mgr.MaxDepth)
+	}
+	root := mgr.root()
+	root.mu.Lock()
+	subtasks := slices.Clone(task.Base().Subtasks)
+	root.mu.Unlock()
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return &TaskMgr{
+		UserGoal:      mgr.UserGoal,
+		PreTasks:      subtasks,
+		ToolLog:       mgr.ToolLog,
+		Executor:      mgr.Executor,
+		Trajectory:    mgr.Trajectory,
+		HistoryTokens: mgr.HistoryTokens,
+		MaxDepth:      mgr.MaxDepth,
+		RunSubtask:    mgr.RunSubtask,
+		taskDefs:      slices.Clone(mgr.taskDefs),
+		parent:        mgr,
+		parentTask:    task,
+		depth:         mgr.depth + 1,
+	}, nil
+}
+
+// SubtaskTools returns the tools delegating the subtask types of the task type to child agents, none
+// when the task is too deep or the task manager can not run subtasks.
+func (mgr *TaskMgr) SubtaskTools(def *TaskDef, task Task) ([]ToolEndPoint, error) {
+	if len(def.Subtasks) == 0 || mgr.RunSubtask == nil || mgr.depth >= mgr.MaxDepth {
+		return nil, nil
+	}
+	child, err := mgr.NewChild(task)
+	if err != nil {
+		return nil, err
+	}
+	var tools []ToolEndPoint
+	for _, name := range def.Subtasks {
+		subDef, ok := mgr.LookupTaskDef(name)
+		if !ok {
+			return nil, fmt.Errorf("task type %s delegates to unknown task type %q", def.Name, name)
+		}
+		tools = append(tools, child.subtaskTool(subDef))
+	}
+	return tools, nil
+}
+
+// subtaskTool creates a subtask of the parent task and runs its worker before returning the result.
+func (mgr *TaskMgr) subtaskTool(def *TaskDef) ToolEndPoint {
+	endpoint := def.CreateTool()
+	endpoint.Def.Description = fmt.Sprintf("Delegate a %s subtask of your task to a child agent, returns its result when it finishes. %s", def.Name, endpoint.Def.Description)
+	endpoint.Def.Parameters = withoutDependsOn(endpoint.Def.Parameters)
+	endpoint.Handler = func(ctx context.Context, args string) (string, error) {
+		task, _, err := def.Create(args)
+		if err != nil {
+			return "", err
+		}
+		task.Base().CreateArgs = args
+		_, err = mgr.addSubtask(def, task)
+		if err != nil {
+			return "", err
+		}
+		err = mgr.StartTask(task)
+		if err != nil {
+			return "", err
+		}
+		err = mgr.RunSubtask(ctx, mgr, task)
+		if err != nil && !mgr.IsFinished(task) {
+			err = mgr.FailTask(task, fmt.Sprintf("the worker failed: %s", err))
+		}
+		if err != nil {
+			return "", err
+		}
+		err = mgr.MergeTask(task)
+		if err != nil {
+			return "", err
+		}
+		mgr.foldSubtask(task)
+		return task.FormatString(), nil
+	}
+	return endpoint
+}
+
+func (mgr *TaskMgr) addSubtask(def *TaskDef, task Task) (int, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return mgr.addTask(def, task, nil, fmt.Sprintf("subtask of #%d", mgr.parentTask.Base().ID))
+}
+
+// foldSubtask adds the merged subtask to the subtasks of the parent task and saves the checkpoint of
+// the root, the checkpoint keeps the subtasks of a pending task for a resumed run.
+func (mgr *TaskMgr) foldSubtask(task Task) {
+	root := mgr.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	base := mgr.parentTask.Base()
+	base.Subtasks = append(base.Subtasks, task)
+	root.saveCheckpoint()
+}
+
+// foldSubtaskContext appends the context items of the subtasks the worker did not keep itself, the
+// later tasks see what the child agents found as the context of the task. Called with mu held.
+func foldSubtaskContext(task Task) {
+	base := task.Base()
+	for _, subtask := range base.Subtasks {
+		for _, item := range TaskContext(subtask) {
+			if contextIndex(base.Context, item.ID) < 0 {
+				item.Desc = fmt.Sprintf("subtask #%d: %s", subtask.Base().ID, item.Desc)
+				base.Context = append(base.Context, item)
+			}
+		}
+	}
+}
+
+// withoutDependsOn removes the DependsOn parameter, a subtask runs right away.
+func withoutDependsOn(parameters any) any {
+	switch params := parameters.(type) {
+	case jsonschema.Definition:
+		params.Properties = maps.Clone(params.Properties)
+		delete(params.Properties, "DependsOn")
+		return params
+	case map[string]any:
+		params = maps.Clone(params)
+		if properties, ok := params["properties"].(map[string]any); ok {
+			properties = maps.Clone(properties)
+			delete(properties, "DependsOn")
+			params["properties"] = properties
+		}
+		return params
+	}
+	return parameters
+}
@@ -3,21 +3,88 @@ package service
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
-// Task is the interface that all task types must implement
+// Task is the interface that all task types must implement, see RegisterTaskDef for adding a type.
 type Task interface {
 	FormatString() string
 	GetTask() string
+	// Fail records why the task was finished without a result.
+	Fail(reason string)
+	Base() *TaskBase
+}
+
+// TaskStatus is the state of a task in the task manager. A pending task becomes running when its
+// worker starts and ends in one of the done states, a done task is merged into the task history.
+type TaskStatus string
+
+const (
+	TaskPending   TaskStatus = "pending"
+	TaskRunning   TaskStatus = "running"
+	TaskSucceeded TaskStatus = "succeeded"
+	// TaskFailed is a task whose worker gave up, stopped without finishing it or returned an error.
+	TaskFailed TaskStatus = "failed"
+	// TaskCancelled is a task cancelled by the orchestrator before it ran.
+	TaskCancelled TaskStatus = "cancelled"
+	// TaskAbandoned is a task whose worker was interrupted with the user task.
+	TaskAbandoned TaskStatus = "abandoned"
+)
+
+// Done reports whether the task reached a final state, successfully or not.
+func (s TaskStatus) Done() bool {
+	switch s {
+	case TaskSucceeded, TaskFailed, TaskCancelled, TaskAbandoned:
+		return true
+	}
+	return false
+}
+
+// TaskBase holds the fields common to all task types, the types embed it and add their payload.
+type TaskBase struct {
+	// ID numbers the tasks of a user goal in creation order, starting from 1.
+	ID int
+	// Type is the name the task type is registered with.
+	Type   string
+	Status TaskStatus
+	// ParentID is the task whose worker created the task, 0 for the tasks of the orchestrator.
+	ParentID int `json:",omitempty"`
+	// DependsOn lists the IDs of the tasks that must finish before this task runs.
+	DependsOn []int `json:",omitempty"`
+	// FixOf is the failed verify task whose fix cycle created the task.
+	FixOf int `json:",omitempty"`
+	// Role is the config role whose model runs the worker.
+	Role string
+	// CreateArgs are the arguments of the create tool, a retried task is created again from them.
+	CreateArgs string `json:",omitempty"`
+	// Attempts counts the runs of a worker on the task.
+	Attempts   int
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Context are the tool logs the worker kept for the later tasks.
+	Context []ContextItem `json:",omitempty"`
+	// Subtasks are the tasks the worker delegated to child agents, stored by the checkpoint itself.
+	Subtasks []Task `json:"-"`
+	// Failure is why a task failed, was cancelled or abandoned.
+	Failure string `json:",omitempty"`
+}
+
+func (b *TaskBase) Base() *TaskBase {
+	return b
+}
+
+func (b *TaskBase) Fail(reason string) {
+	b.Failure = reason
 }
 
 type ExploreTask struct {
+	TaskBase
 	Task         string
 	ExpectOutput string
-	Context      []ContextItem
 }
 
 func (t *ExploreTask) GetTask() string {
@@ -25,6 +92,7 @@ func (t *ExploreTask) GetTask() string {
 }
 
 type ReasonTask struct {
+	TaskBase
 	Task         string
 	ExpectOutput string
 	Conclusion   string
@@ -35,19 +103,54 @@ func (t *ReasonTask) GetTask() string {
 }
 
 type BuildTask struct {
+	TaskBase
 	Task      string
 	ChangeLog string
-	Context   []ContextItem
 }
 
 func (t *BuildTask) GetTask() string {
 	return t.Task
 }
 
+// VerifyResult is the outcome of a verify task.
+type VerifyResult string
+
+const (
+	VerifyPass    VerifyResult = "pass"
+	VerifyFail    VerifyResult = "fail"
+	VerifyPartial VerifyResult = "partial"
+)
+
+// parseVerifyResult reads the result from a free text conclusion, the form before verify tasks had a result.
+func parseVerifyResult(conclusion string) VerifyResult {
+	conclusion = strings.ToLower(strings.TrimSpace(conclusion))
+	switch {
+	case strings.HasPrefix(conclusion, "partial"):
+		return VerifyPartial
+	case strings.HasPrefix(conclusion, "fail"), strings.HasPrefix(conclusion, "not verified"):
+		return VerifyFail
+	case strings.HasPrefix(conclusion, "success"), strings.HasPrefix(conclusion, "verified"), strings.HasPrefix(conclusion, "pass"):
+		return VerifyPass
+	}
+	return ""
+}
+
 type VerifyTask struct {
+	TaskBase
 	Task       string
+	Result     VerifyResult `json:",omitempty"`
 	Conclusion string
-	Context    []ContextItem
+	// Evidence are the IDs of the context items proving the result.
+	Evidence []int `json:",omitempty"`
+	// Checks are the build tasks whose changes the task verified, set when the task is merged.
+	Checks []int `json:",omitempty"`
+	// FixSummary tells the orchestrator why no fix cycle follows the failed verification.
+	FixSummary string `json:",omitempty"`
+}
+
+// Failed reports whether the verification found a problem.
+func (t *VerifyTask) Failed() bool {
+	return t.Result == VerifyFail || t.Result == VerifyPartial
 }
 
 func (t *VerifyTask) GetTask() string {
@@ -56,21 +159,18 @@ func (t *VerifyTask) GetTask() string {
 
 func (t *ExploreTask) FormatString() string {
 	var builder strings.Builder
-	builder.WriteString("--- EXPLORE TASK ---\n")
+	writeHeader(&builder, "EXPLORE", &t.TaskBase)
 	builder.WriteString(fmt.Sprintf("Goal: %s\n", t.Task))
 	builder.WriteString(fmt.Sprintf("Expected Output: %s\n", t.ExpectOutput))
-	if len(t.Context) > 0 {
-		builder.WriteString("\nContext Items:\n")
-		for _, ctx := range t.Context {
-			builder.WriteString(fmt.Sprintf("#%d: %s\n", ctx.ID, ctx.Desc))
-		}
-	}
+	writeSubtasks(&builder, &t.TaskBase)
+	writeContext(&builder, t.Context)
+	writeStatus(&builder, &t.TaskBase)
 	return builder.String()
 }
 
 func (t *ReasonTask) FormatString() string {
 	var builder strings.Builder
-	builder.WriteString("--- REASON TASK ---\n")
+	writeHeader(&builder, "REASON", &t.TaskBase)
 	builder.WriteString(fmt.Sprintf("Goal: %s\n", t.Task))
 	builder.WriteString(fmt.Sprintf("Expected Output: %s\n", t.ExpectOutput))
 	if t.Conclusion != "" {
@@ -78,45 +178,124 @@ func (t *ReasonTask) FormatString() string {
 		builder.WriteString(t.Conclusion)
 		builder.WriteByte('\n')
 	}
+	writeSubtasks(&builder, &t.TaskBase)
+	// the context items of a reason task come from its subtasks
+	writeContext(&builder, t.Context)
+	writeStatus(&builder, &t.TaskBase)
 	return builder.String()
 }
 
 func (t *BuildTask) FormatString() string {
 	var builder strings.Builder
-	builder.WriteString("--- BUILD TASK ---\n")
+	writeHeader(&builder, "BUILD", &t.TaskBase)
 	builder.WriteString(fmt.Sprintf("Goal: %s\n", t.Task))
 	if t.ChangeLog != "" {
 		builder.WriteString("\nChange Log:\n")
 		builder.WriteString(t.ChangeLog)
 		builder.WriteByte('\n')
 	}
-	if len(t.Context) > 0 {
-		builder.WriteString("\nContext Items:\n")
-		for _, ctx := range t.Context {
-			builder.WriteString(fmt.Sprintf("#%d: %s\n", ctx.ID, ctx.Desc))
-		}
-	}
+	writeSubtasks(&builder, &t.TaskBase)
+	writeContext(&builder, t.Context)
+	writeStatus(&builder, &t.TaskBase)
 	return builder.String()
 }
 
 func (t *VerifyTask) FormatString() string {
 	var builder strings.Builder
-	builder.WriteString("--- VERIFY TASK ---\n")
+	writeHeader(&builder, "VERIFY", &t.TaskBase)
 	builder.WriteString(fmt.Sprintf("Goal: %s\n", t.Task))
+	if len(t.Checks) != 0 {
+		builder.WriteString(fmt.Sprintf("Checks: %s\n", formatIDs(t.Checks)))
+	}
+	if t.Result != "" {
+		builder.WriteString(fmt.Sprintf("\nResult: %s\n", t.Result))
+	}
 	if t.Conclusion != "" {
 		builder.WriteString("\nConclusion:\n")
 		builder.WriteString(t.Conclusion)
 		builder.WriteByte('\n')
 	}
-	if len(t.Context) > 0 {
-		builder.WriteString("\nContext Items:\n")
-		for _, ctx := range t.Context {
-			builder.WriteString(fmt.Sprintf("#%d: %s\n", ctx.ID, ctx.Desc))
-		}
+	if len(t.Evidence) != 0 {
+		builder.WriteString(fmt.Sprintf("Evidence: %s\n", formatIDs(t.Evidence)))
+	}
+	if t.FixSummary != "" {
+		builder.WriteString("\nFix Cycle:\n")
+		builder.WriteString(t.FixSummary)
+		builder.WriteByte('\n')
 	}
+	writeSubtasks(&builder, &t.TaskBase)
+	writeContext(&builder, t.Context)
+	writeStatus(&builder, &t.TaskBase)
 	return builder.String()
 }
 
+func writeHeader(builder *strings.Builder, kind string, base *TaskBase) {
+	builder.WriteString(fmt.Sprintf("--- %s TASK #%d ---\n", kind, base.ID))
+	if len(base.DependsOn) != 0 {
+		builder.WriteString(fmt.Sprintf("Depends On: %s\n", formatIDs(base.DependsOn)))
+	}
+	if base.FixOf != 0 {
+		builder.WriteString(fmt.Sprintf("Fix Cycle Of: #%d\n", base.FixOf))
+	}
+}
+
+// formatIDs writes task or tool log IDs as "#1, #2".
+func formatIDs(ids []int) string {
+	texts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		texts = append(texts, fmt.Sprintf("#%d", id))
+	}
+	return strings.Join(texts, ", ")
+}
+
+// writeSubtasks writes the subtasks indented below the task, a task history is a tree of tasks.
+func writeSubtasks(builder *strings.Builder, base *TaskBase) {
+	if len(base.Subtasks) == 0 {
+		return
+	}
+	builder.WriteString("\nSubtasks:\n")
+	for _, subtask := range base.Subtasks {
+		for _, line := range strings.SplitAfter(subtask.FormatString(), "\n") {
+			if strings.TrimSpace(line) != "" {
+				builder.WriteString("  " + line)
+			} else {
+				builder.WriteString(line)
+			}
+		}
+	}
+}
+
+func writeContext(builder *strings.Builder, items []ContextItem) {
+	if len(items) == 0 {
+		return
+	}
+	builder.WriteString("\nContext Items:\n")
+	for _, item := range items {
+		builder.WriteString(fmt.Sprintf("#%d: %s\n", item.ID, item.Desc))
+	}
+}
+
+// writeStatus writes why the task has no result, a succeeded task only shows its result.
+func writeStatus(builder *strings.Builder, base *TaskBase) {
+	switch base.Status {
+	case TaskSucceeded, TaskPending, TaskRunning:
+		if base.Failure == "" {
+			return
+		}
+	}
+	status := "FAILED"
+	switch base.Status {
+	case TaskCancelled:
+		status = "CANCELLED"
+	case TaskAbandoned:
+		status = "ABANDONED"
+	}
+	builder.WriteString(fmt.Sprintf("\n%s: %s\n", status, base.Failure))
+	if base.Attempts > 1 {
+		builder.WriteString(fmt.Sprintf("Attempts: %d\n", base.Attempts))
+	}
+}
+
 type FinishExploreTaskArgs struct {
 	Context []ContextItem
 }
@@ -131,10 +310,21 @@ type FinishBuildTaskArgs struct {
 }
 
 type FinishVerifyTaskArgs struct {
+	Result     VerifyResult
 	Conclusion string
+	Evidence   []int
 	Context    []ContextItem
 }
 
+// dependsOnDescription describes the DependsOn parameter of the create tools of all task types.
+const dependsOnDescription = "IDs of earlier tasks whose output this task needs, the task runs after them. Tasks without dependencies between them run in parallel"
+
+var dependsOnProperty = jsonschema.Definition{
+	Type:        jsonschema.Array,
+	Description: dependsOnDescription,
+	Items:       &jsonschema.Definition{Type: jsonschema.Integer},
+}
+
 func CreateExploreTask() ToolEndPoint {
 	def := openai.FunctionDefinition{
 		Name:        "create_explore_task",
@@ -150,6 +340,7 @@ func CreateExploreTask() ToolEndPoint {
 					Type:        jsonschema.String,
 					Description: "What kind of output is expected from this exploration task, e.g., 'List of handler functions with their routes'",
 				},
+				"DependsOn": dependsOnProperty,
 			},
 			Required: []string{"Task", "ExpectOutput"},
 		},
@@ -176,6 +367,7 @@ func CreateReasonTask() ToolEndPoint {
 					Type:        jsonschema.String,
 					Description: "What kind of reasoning output is expected, e.g., 'Detailed analysis with supporting evidence'",
 				},
+				"DependsOn": dependsOnProperty,
 			},
 			Required: []string{"Task", "ExpectOutput"},
 		},
@@ -198,6 +390,7 @@ func CreateBuildTask() ToolEndPoint {
 					Type:        jsonschema.String,
 					Description: "The build task to perform, e.g., 'Implement error handling in the API handler'",
 				},
+				"DependsOn": dependsOnProperty,
 			},
 			Required: []string{"Task"},
 		},
@@ -220,6 +413,7 @@ func CreateVerifyTask() ToolEndPoint {
 					Type:        jsonschema.String,
 					Description: "The verification task to perform, e.g., 'Test the error handling implementation'",
 				},
+				"DependsOn": dependsOnProperty,
 			},
 			Required: []string{"Task"},
 		},
@@ -330,13 +524,23 @@ func FinishBuildTask() ToolEndPoint {
 func FinishVerifyTask() ToolEndPoint {
 	def := openai.FunctionDefinition{
 		Name:        "finish_verify_task",
-		Description: "Finish the verification task with the result (success/failed), reason if failed, and corresponding context as output",
+		Description: "Finish the verification task with the result (pass/fail/partial), the reason and the context items proving it",
 		Parameters: jsonschema.Definition{
 			Type: jsonschema.Object,
 			Properties: map[string]jsonschema.Definition{
+				"Result": {
+					Type:        jsonschema.String,
+					Enum:        []string{string(VerifyPass), string(VerifyFail), string(VerifyPartial)},
+					Description: "'pass' if everything verified works, 'fail' if it does not, 'partial' if only a part works",
+				},
 				"Conclusion": {
 					Type:        jsonschema.String,
-					Description: "The verification result: 'success' if verification passed, or 'failed' with detailed reason for the failure",
+					Description: "What was verified and, unless the result is 'pass', the detailed reason of the failure",
+				},
+				"Evidence": {
+					Type:        jsonschema.Array,
+					Description: "The IDs of the context items proving the result, e.g. the failing test output",
+					Items:       &jsonschema.Definition{Type: jsonschema.Integer},
 				},
 				"Context": {
 					Type:        jsonschema.Array,
@@ -356,7 +560,7 @@ func FinishVerifyTask() ToolEndPoint {
 					},
 				},
 			},
-			Required: []string{"Conclusion", "Context"},
+			Required: []string{"Result", "Conclusion", "Context"},
 		},
 	}
 	endpoint := ToolEndPoint{
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+func taskIndex(tasks []Task, id int) int {
+	return slices.IndexFunc(tasks, func(task Task) bool { return task.Base().ID == id })
+}
+
+// CancelTask cancels the pending task that has not started yet and the pending tasks depending on it,
+// the cancelled tasks are merged into PreTasks. It returns the IDs of the cancelled tasks.
+func (mgr *TaskMgr) CancelTask(id int, reason string) ([]int, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	i := taskIndex(mgr.Pending, id)
+	if i < 0 {
+		return nil, fmt.Errorf("task #%d is not pending, only pending tasks can be cancelled", id)
+	}
+	if status := mgr.Pending[i].Base().Status; status != TaskPending {
+		return nil, fmt.Errorf("task #%d is %s, only tasks not started yet can be cancelled", id, status)
+	}
+	if reason == "" {
+		reason = "cancelled by the orchestrator"
+	}
+	mgr.setDone(mgr.Pending[i], TaskCancelled, reason)
+	cancelled := append([]int{id}, mgr.cascade(id, TaskCancelled, "dependency #%d was cancelled")...)
+	mgr.mergeDone(cancelled)
+	mgr.saveCheckpoint()
+	return cancelled, nil
+}
+
+// cascade finishes the pending tasks not started yet that depend on the done task, directly or through
+// other cascaded tasks, in the status with the reason formatted with the dependency. It returns their
+// IDs, called with mu held.
+func (mgr *TaskMgr) cascade(id int, status TaskStatus, reason string) []int {
+	done := []int{id}
+	var cascaded []int
+	// Pending is in ID order and tasks only depend on earlier tasks, one pass finds all dependents
+	for _, task := range mgr.Pending {
+		base := task.Base()
+		if base.Status != TaskPending {
+			continue
+		}
+		for _, dep := range base.DependsOn {
+			if slices.Contains(done, dep) {
+				mgr.setDone(task, status, fmt.Sprintf(reason, dep))
+				done = append(done, base.ID)
+				cascaded = append(cascaded, base.ID)
+				break
+			}
+		}
+	}
+	return cascaded
+}
+
+// mergeDone moves the done pending tasks of the IDs to PreTasks, called with mu held.
+func (mgr *TaskMgr) mergeDone(ids []int) {
+	var pending []Task
+	for _, task := range mgr.Pending {
+		if !slices.Contains(ids, task.Base().ID) {
+			pending = append(pending, task)
+			continue
+		}
+		mgr.PreTasks = append(mgr.PreTasks, task)
+		mgr.recordTask(task, "merged", "")
+	}
+	mgr.Pending = pending
+}
+
+// RetryTask creates the failed, cancelled or abandoned task again from its create arguments, the new
+// task keeps the ID and dependencies and moves from PreTasks back to Pending.
+func (mgr *TaskMgr) RetryTask(id int) error {
+	mgr.mu.Lock()
+	i := taskIndex(mgr.PreTasks, id)
+	var old Task
+	if i >= 0 {
+		old = mgr.PreTasks[i]
+	}
+	mgr.mu.Unlock()
+	if old == nil {
+		return fmt.Errorf("task #%d is not done, only failed, cancelled or abandoned tasks can be retried", id)
+	}
+	oldBase := old.Base()
+	if oldBase.Status == TaskSucceeded {
+		return fmt.Errorf("task #%d succeeded, create a new task instead", id)
+	}
+	// LookupTaskDef takes mu
+	def, ok := mgr.LookupTaskDef(oldBase.Type)
+	if !ok {
+		return fmt.Errorf("task #%d has unknown type %q", id, oldBase.Type)
+	}
+	if oldBase.CreateArgs == "" {
+		return fmt.Errorf("task #%d has no create arguments, create a new task instead", id)
+	}
+	task, _, err := def.Create(oldBase.CreateArgs)
+	if err != nil {
+		return err
+	}
+
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	i = slices.Index(mgr.PreTasks, old)
+	if i < 0 {
+		return fmt.Errorf("task #%d was retried already", id)
+	}
+	base := task.Base()
+	base.ID = oldBase.ID
+	base.Type = oldBase.Type
+	base.Role = oldBase.Role
+	base.Status = TaskPending
+	base.ParentID = oldBase.ParentID
+	base.FixOf = oldBase.FixOf
+	base.DependsOn = oldBase.DependsOn
+	base.CreateArgs = oldBase.CreateArgs
+	base.Attempts = oldBase.Attempts
+	base.CreatedAt = time.Now()
+	mgr.PreTasks = slices.Delete(mgr.PreTasks, i, i+1)
+	// keep Pending in ID order, ReadyTasks returns the tasks in this order
+	j, _ := slices.BinarySearchFunc(mgr.Pending, id, func(task Task, id int) int { return task.Base().ID - id })
+	mgr.Pending = slices.Insert(mgr.Pending, j, task)
+	mgr.recordTask(task, "retried", oldBase.Failure)
+	mgr.saveCheckpoint()
+	return nil
+}
+
+type CancelTaskArgs struct {
+	ID     int
+	Reason string
+}
+
+// CancelTaskTool lets the orchestrator cancel a task it created before the task runs.
+func (mgr *TaskMgr) CancelTaskTool() ToolEndPoint {
+	def := openai.FunctionDefinition{
+		Name:        "cancel_task",
+		Description: "Cancel a pending task that has not started yet, the pending tasks depending on it are cancelled too",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"ID": {
+					Type:        jsonschema.Integer,
+					Description: "the ID of the task to cancel",
+				},
+				"Reason": {
+					Type:        jsonschema.String,
+					Description: "why the task is not needed, shown in the task history",
+				},
+			},
+			Required: []string{"ID", "Reason"},
+		},
+	}
+	handler := func(ctx context.Context, args string) (string, error) {
+		var para CancelTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
+		}
+		cancelled, err := mgr.CancelTask(para.ID, para.Reason)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("cancelled task %s", formatIDs(cancelled)), nil
+	}
+	return ToolEndPoint{
+		Name:    "cancel_task",
+		Def:     def,
+		Handler: handler,
+	}
+}
+
+type RetryTaskArgs struct {
+	ID int
+}
+
+// RetryTaskTool lets the orchestrator run a task that did not succeed again.
+func (mgr *TaskMgr) RetryTaskTool() ToolEndPoint {
+	def := openai.FunctionDefinition{
+		Name:        "retry_task",
+		Description: "Run a failed, cancelled or abandoned task again with the same arguments and dependencies",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"ID": {
+					Type:        jsonschema.Integer,
+					Description: "the ID of the task to retry",
+				},
+			},
+			Required: []string{"ID"},
+		},
+	}
+	handler := func(ctx context.Context, args string) (string, error) {
+		var para RetryTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
+		}
+		err = mgr.RetryTask(para.ID)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("task #%d will run again", para.ID), nil
+	}
+	return ToolEndPoint{
+		Name:    "retry_task",
+		Def:     def,
+		Handler: handler,
+	}
+}
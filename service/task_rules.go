@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// TaskRule checks a task the orchestrator creates before it is added, the error tells the orchestrator
+// how to change the task. Check is called with the mutex of the task manager held, it may read
+// PreTasks and Pending but must not call the methods of the task manager.
+type TaskRule struct {
+	Name string
+	// Description is shown to the orchestrator in its prompt.
+	Description string
+	Check       func(mgr *TaskMgr, task Task, dependsOn []int) error
+}
+
+var taskRules = []*TaskRule{
+	{
+		Name:        "explore-before-build",
+		Description: "a build task needs an explore task that ran before it or that it depends on",
+		Check:       exploreBeforeBuild,
+	},
+	{
+		Name:        "reason-before-build",
+		Description: "a build task must depend on a reason task planning the change",
+		Check:       reasonBeforeBuild,
+	},
+	{
+		Name:        "observed-files",
+		Description: "the files a build task names must appear in the context items of earlier explore or build tasks",
+		Check:       observedFiles,
+	},
+	{
+		Name:        "verify-after-build",
+		Description: "every finished build task must be checked by a verify task before the next build task",
+		Check:       verifyAfterBuild,
+	},
+}
+
+// LookupTaskRule returns the built-in rule of the name.
+func LookupTaskRule(name string) (*TaskRule, bool) {
+	i := slices.IndexFunc(taskRules, func(rule *TaskRule) bool { return rule.Name == name })
+	if i < 0 {
+		return nil, false
+	}
+	return taskRules[i], true
+}
+
+// TaskRules returns the built-in rules.
+func TaskRules() []*TaskRule {
+	return slices.Clone(taskRules)
+}
+
+// checkRules runs the rules of the task manager on the task, called with mu held.
+func (mgr *TaskMgr) checkRules(task Task, dependsOn []int) error {
+	var errs []string
+	for _, rule := range mgr.Rules {
+		err := rule.Check(mgr, task, dependsOn)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("rule %s: %s", rule.Name, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("task rejected by %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ancestors returns the tasks the dependencies refer to and their own dependencies.
+func (mgr *TaskMgr) ancestors(dependsOn []int) []Task {
+	tasks := append(slices.Clone(mgr.PreTasks), mgr.Pending...)
+	var res []Task
+	seen := map[int]bool{}
+	queue := slices.Clone(dependsOn)
+	for len(queue) != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		i := taskIndex(tasks, id)
+		if seen[id] || i < 0 {
+			continue
+		}
+		seen[id] = true
+		res = append(res, tasks[i])
+		queue = append(queue, tasks[i].Base().DependsOn...)
+	}
+	return res
+}
+
+func isBuild(task Task) bool {
+	_, ok := task.(*BuildTask)
+	return ok
+}
+
+func exploreBeforeBuild(mgr *TaskMgr, task Task, dependsOn []int) error {
+	if !isBuild(task) {
+		return nil
+	}
+	for _, done := range mgr.PreTasks {
+		if _, ok := done.(*ExploreTask); ok && done.Base().Status == TaskSucceeded {
+			return nil
+		}
+	}
+	for _, dep := range mgr.ancestors(dependsOn) {
+		if _, ok := dep.(*ExploreTask); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("no explore task looked at the code yet, create an explore task for the code to change and make the build task depend on it")
+}
+
+func reasonBeforeBuild(mgr *TaskMgr, task Task, dependsOn []int) error {
+	if !isBuild(task) {
+		return nil
+	}
+	for _, dep := range mgr.ancestors(dependsOn) {
+		if _, ok := dep.(*ReasonTask); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("the build task does not depend on a reason task, create a reason task planning the change from the explored code and make the build task depend on it")
+}
+
+var filePattern = regexp.MustCompile(`(?:[\w.-]+/)+[\w-]+\.\w+|\b[\w-]+\.(?:go|py|js|jsx|ts|tsx|java|kt|c|h|cc|cpp|hpp|rs|rb|php|cs|swift|sh|sql|json|yaml|yml|toml|html|css|md)\b`)
+
+// observedText returns the context items of the finished explore and build tasks, with the arguments
+// and outputs of their tool calls.
+func (mgr *TaskMgr) observedText() string {
+	var builder strings.Builder
+	for _, task := range mgr.PreTasks {
+		switch task.(type) {
+		case *ExploreTask, *BuildTask:
+		default:
+			continue
+		}
+		for _, item := range TaskContext(task) {
+			builder.WriteString(item.Desc + "\n")
+			if item.ToolLog != nil {
+				builder.WriteString(item.ToolLog.ToolCall.Function.Arguments + "\n")
+				builder.WriteString(item.ToolLog.ToolRes + "\n")
+			}
+		}
+	}
+	return builder.String()
+}
+
+// productNames look like file names but name tools and libraries.
+var productNames = []string{"node.js", "deno.js", "vue.js", "next.js", "nuxt.js", "react.js", "express.js", "angular.js", "ember.js", "backbone.js", "three.js", "d3.js", "chart.js"}
+
+// taskFiles returns the file paths the task text names, the paths of URLs and product names are left out.
+func taskFiles(text string) []string {
+	var files []string
+	for _, loc := range filePattern.FindAllStringIndex(text, -1) {
+		file := text[loc[0]:loc[1]]
+		if strings.HasSuffix(text[:loc[0]], "://") || slices.Contains(productNames, strings.ToLower(file)) {
+			continue
+		}
+		files = append(files, strings.TrimPrefix(file, "./"))
+	}
+	return files
+}
+
+// mentions reports whether text names the path as a whole path component, "main.go" is not in
+// "domain.go" but in "cmd/main.go". A path ending with a slash is a directory prefix.
+func mentions(text string, path string) bool {
+	end := `(?:$|[^\w.-]|\.(?:$|\W))`
+	if strings.HasSuffix(path, "/") {
+		end = ""
+	}
+	pattern := regexp.MustCompile("(?:^|[\\s/\"'`(=:])" + regexp.QuoteMeta(path) + end)
+	return pattern.MatchString(text)
+}
+
+// observedFiles rejects a build task naming files nobody looked at, a new file is fine when its
+// directory was seen.
+func observedFiles(mgr *TaskMgr, task Task, dependsOn []int) error {
+	if !isBuild(task) {
+		return nil
+	}
+	text := mgr.observedText()
+	var unseen []string
+	for _, file := range taskFiles(task.GetTask()) {
+		if mentions(text, file) || slices.Contains(unseen, file) {
+			continue
+		}
+		if dir := path.Dir(file); dir != "." && mentions(text, dir+"/") {
+			continue
+		}
+		unseen = append(unseen, file)
+	}
+	if len(unseen) != 0 {
+		return fmt.Errorf("no explore or build task has seen %s, create an explore task reading them first or correct the paths", strings.Join(unseen, ", "))
+	}
+	return nil
+}
+
+func verifyAfterBuild(mgr *TaskMgr, task Task, dependsOn []int) error {
+	if !isBuild(task) {
+		return nil
+	}
+	verified := map[int]bool{}
+	for _, other := range append(slices.Clone(mgr.PreTasks), mgr.Pending...) {
+		if _, ok := other.(*VerifyTask); !ok {
+			continue
+		}
+		for _, dep := range mgr.ancestors(other.Base().DependsOn) {
+			verified[dep.Base().ID] = true
+		}
+	}
+	var unverified []int
+	for _, done := range mgr.PreTasks {
+		if isBuild(done) && done.Base().Status == TaskSucceeded && !verified[done.Base().ID] {
+			unverified = append(unverified, done.Base().ID)
+		}
+	}
+	if len(unverified) != 0 {
+		return fmt.Errorf("build task %s was not verified, create a verify task depending on it before building more", formatIDs(unverified))
+	}
+	return nil
+}
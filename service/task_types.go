@@ -0,0 +1,312 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"multi-agent/config"
+	"sync"
+)
+
+// TaskDef describes a task type: the tools creating and finishing its tasks, the prompt of its worker
+// and the role whose model runs it. The FormatString method of the task is its formatter.
+type TaskDef struct {
+	Name string
+	// Role is the config role whose model runs the worker.
+	Role string
+	// Prompt is the text/template of the worker's system prompt, the prompt library has the templates
+	// of the built-in types.
+	Prompt string
+	// Tools are the tools of the worker besides the finish tool, nil for bash and view_tool_log.
+	Tools []string
+	// Subtasks are the task types the worker can delegate to child agents.
+	Subtasks []string
+	// New returns an empty task, checkpoints are decoded into it.
+	New func() Task
+	// CreateTool and FinishTool return the tool definitions, the handlers are bound by the TaskMgr.
+	CreateTool func() ToolEndPoint
+	FinishTool func() ToolEndPoint
+	// Create builds the task from the arguments of the create tool and returns its dependencies.
+	Create func(args string) (Task, []int, error)
+	// Finish checks the arguments of the finish tool and returns the function storing them in the
+	// task, the task manager calls it with its mutex held while the task is running.
+	Finish func(mgr *TaskMgr, task Task, args string) (func(), error)
+}
+
+var taskDefs struct {
+	mu   sync.RWMutex
+	defs []*TaskDef
+}
+
+func checkTaskDef(def *TaskDef) error {
+	if def.Name == "" || def.New == nil || def.CreateTool == nil || def.FinishTool == nil || def.Create == nil || def.Finish == nil {
+		return fmt.Errorf("task type %q is incomplete", def.Name)
+	}
+	return nil
+}
+
+// RegisterTaskDef adds a task type for every TaskMgr, the orchestrator offers the create tools in
+// registration order. TaskMgr.RegisterTaskDef adds a type for one task manager.
+func RegisterTaskDef(def *TaskDef) error {
+	err := checkTaskDef(def)
+	if err != nil {
+		return err
+	}
+	taskDefs.mu.Lock()
+	defer taskDefs.mu.Unlock()
+	for _, other := range taskDefs.defs {
+		if other.Name == def.Name {
+			return fmt.Errorf("task type %q is already registered", def.Name)
+		}
+	}
+	taskDefs.defs = append(taskDefs.defs, def)
+	return nil
+}
+
+// LookupTaskDef returns the registered task type.
+func LookupTaskDef(name string) (*TaskDef, bool) {
+	taskDefs.mu.RLock()
+	defer taskDefs.mu.RUnlock()
+	for _, def := range taskDefs.defs {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return nil, false
+}
+
+// TaskDefs returns the registered task types in registration order.
+func TaskDefs() []*TaskDef {
+	taskDefs.mu.RLock()
+	defer taskDefs.mu.RUnlock()
+	return append([]*TaskDef{}, taskDefs.defs...)
+}
+
+// RegisterTaskDef adds a task type to the task manager only, e.g. one declared in the config.
+func (mgr *TaskMgr) RegisterTaskDef(def *TaskDef) error {
+	err := checkTaskDef(def)
+	if err != nil {
+		return err
+	}
+	if _, exist := mgr.LookupTaskDef(def.Name); exist {
+		return fmt.Errorf("task type %q is already registered", def.Name)
+	}
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.taskDefs = append(mgr.taskDefs, def)
+	return nil
+}
+
+// LookupTaskDef returns the task type registered globally or with the task manager.
+func (mgr *TaskMgr) LookupTaskDef(name string) (*TaskDef, bool) {
+	for _, def := range mgr.TaskDefs() {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return nil, false
+}
+
+// TaskDefs returns the global task types followed by the ones of the task manager.
+func (mgr *TaskMgr) TaskDefs() []*TaskDef {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return append(TaskDefs(), mgr.taskDefs...)
+}
+
+// TaskType returns the type name of the task, "" for a task not created by a TaskMgr.
+func TaskType(task Task) string {
+	return task.Base().Type
+}
+
+// taskOf checks that the finish tool of a type is called on a task of the type.
+func taskOf[T Task](task Task) (T, error) {
+	typed, ok := task.(T)
+	if !ok {
+		return typed, fmt.Errorf("task #%d is a %s task, not a %T", task.Base().ID, TaskType(task), typed)
+	}
+	return typed, nil
+}
+
+func init() {
+	for _, def := range []*TaskDef{exploreTaskDef, reasonTaskDef, buildTaskDef, verifyTaskDef} {
+		err := RegisterTaskDef(def)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+type CreateExploreTaskArgs struct {
+	Task         string
+	ExpectOutput string
+	DependsOn    []int
+}
+
+var exploreTaskDef = &TaskDef{
+	Name:       "explore",
+	Role:       config.RoleExplore,
+	New:        func() Task { return &ExploreTask{} },
+	CreateTool: CreateExploreTask,
+	FinishTool: FinishExploreTask,
+	Create: func(args string) (Task, []int, error) {
+		var para CreateExploreTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ExploreTask{Task: para.Task, ExpectOutput: para.ExpectOutput}, para.DependsOn, nil
+	},
+	Finish: func(mgr *TaskMgr, task Task, args string) (func(), error) {
+		var para FinishExploreTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, err
+		}
+		_, err = taskOf[*ExploreTask](task)
+		if err != nil {
+			return nil, err
+		}
+		err = mgr.FillToolLog(para.Context)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			task.Base().Context = para.Context
+		}, nil
+	},
+}
+
+type CreateReasonTaskArgs struct {
+	Task         string
+	ExpectOutput string
+	DependsOn    []int
+}
+
+var reasonTaskDef = &TaskDef{
+	Name:       "reason",
+	Role:       config.RoleReason,
+	Subtasks:   []string{"explore"},
+	New:        func() Task { return &ReasonTask{} },
+	CreateTool: CreateReasonTask,
+	FinishTool: FinishReasonTask,
+	Create: func(args string) (Task, []int, error) {
+		var para CreateReasonTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ReasonTask{Task: para.Task, ExpectOutput: para.ExpectOutput}, para.DependsOn, nil
+	},
+	Finish: func(mgr *TaskMgr, task Task, args string) (func(), error) {
+		var para FinishReasonTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, err
+		}
+		reasonTask, err := taskOf[*ReasonTask](task)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			reasonTask.Conclusion = para.Conclusion
+		}, nil
+	},
+}
+
+type CreateBuildTaskArgs struct {
+	Task      string
+	DependsOn []int
+}
+
+var buildTaskDef = &TaskDef{
+	Name:       "build",
+	Role:       config.RoleBuild,
+	Subtasks:   []string{"explore", "reason"},
+	New:        func() Task { return &BuildTask{} },
+	CreateTool: CreateBuildTask,
+	FinishTool: FinishBuildTask,
+	Create: func(args string) (Task, []int, error) {
+		var para CreateBuildTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &BuildTask{Task: para.Task}, para.DependsOn, nil
+	},
+	Finish: func(mgr *TaskMgr, task Task, args string) (func(), error) {
+		var para FinishBuildTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, err
+		}
+		buildTask, err := taskOf[*BuildTask](task)
+		if err != nil {
+			return nil, err
+		}
+		err = mgr.FillToolLog(para.Context)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			buildTask.ChangeLog = para.ChangeLog
+			buildTask.Context = para.Context
+		}, nil
+	},
+}
+
+type CreateVerifyTaskArgs struct {
+	Task      string
+	DependsOn []int
+}
+
+var verifyTaskDef = &TaskDef{
+	Name:       "verify",
+	Role:       config.RoleVerify,
+	Subtasks:   []string{"explore"},
+	New:        func() Task { return &VerifyTask{} },
+	CreateTool: CreateVerifyTask,
+	FinishTool: FinishVerifyTask,
+	Create: func(args string) (Task, []int, error) {
+		var para CreateVerifyTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &VerifyTask{Task: para.Task}, para.DependsOn, nil
+	},
+	Finish: func(mgr *TaskMgr, task Task, args string) (func(), error) {
+		var para FinishVerifyTaskArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return nil, err
+		}
+		verifyTask, err := taskOf[*VerifyTask](task)
+		if err != nil {
+			return nil, err
+		}
+		err = mgr.FillToolLog(para.Context)
+		if err != nil {
+			return nil, err
+		}
+		result := para.Result
+		if result == "" {
+			result = parseVerifyResult(para.Conclusion)
+		}
+		switch result {
+		case VerifyPass, VerifyFail, VerifyPartial:
+		default:
+			return nil, fmt.Errorf("invalid result %q, expect pass, fail or partial", para.Result)
+		}
+		for _, id := range para.Evidence {
+			if contextIndex(para.Context, id) < 0 {
+				return nil, fmt.Errorf("evidence #%d is not a context item of the task", id)
+			}
+		}
+		return func() {
+			verifyTask.Result = result
+			verifyTask.Conclusion = para.Conclusion
+			verifyTask.Evidence = para.Evidence
+			verifyTask.Context = para.Context
+		}, nil
+	},
+}
@@ -1,78 +1,85 @@
 package service
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"multi-agent/trajectory"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
-type TaskItem struct {
-	ID            int
-	Completed     bool
-	Goal          string
-	ConclusionReq string
-	ContextReq    string
-
-	Conclusion string
-	Context    map[int]*ContextItem
-}
-
-func (item *TaskItem) GetTask() string {
-	return item.Goal
-}
-
 type ContextItem struct {
 	ID      int
 	Desc    string
-	ToolLog *ToolExecLog
-}
-
-func (item *TaskItem) FormatString() string {
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("Task %d: %s\n", item.ID, item.Goal))
-	if !item.Completed {
-		builder.WriteString(fmt.Sprintf("Conclusions Requirements:\n%s\nBackground Context Requirements:\n%s\n", item.ConclusionReq, item.ContextReq))
-	} else {
-		if item.Conclusion != "" {
-			builder.WriteString(fmt.Sprintf("Conclusions:\n%s\n", item.Conclusion))
-		}
-		if len(item.Context) != 0 {
-			builder.WriteString("Retrievaled Context: ")
-			for _, ctxItem := range item.Context {
-				builder.WriteString(fmt.Sprintf("#%d: %s, ", ctxItem.ID, ctxItem.Desc))
-			}
-			builder.WriteByte('\n')
-		}
-	}
-	return builder.String()
+	ToolLog *ToolExecLog `json:"-"`
 }
 
 type TaskMgr struct {
-	UserGoal       string
-	PreTasks       []Task
-	CurrentTask    Task
-	ToolDispatcher *ToolDispatcher
+	UserGoal string
+	// PreTasks are the finished tasks, merged in dependency order.
+	PreTasks []Task
+	// Pending are the tasks created by the orchestrator and not merged yet.
+	Pending []Task
+	// ToolLog is shared by the tool dispatchers of all agents, context items refer to its IDs.
+	ToolLog *ToolLog
+	// CheckpointPath is rewritten after every task transition when set.
+	CheckpointPath string
+	// Executor runs the commands of the workers' bash tool.
+	Executor BashExecutor
+	// Trajectory records the task transitions.
+	Trajectory *trajectory.Recorder
+	// HistoryTokens bounds the task history prompt, older tasks are summarised beyond it. 0 means no limit.
+	HistoryTokens int
+	// MaxFixCycles bounds the fix cycles started for a failed verification of a build task, see
+	// startFixCycle. 0 disables them.
+	MaxFixCycles int
+	// Rules check the tasks created with the create tools, the tasks of fix cycles and retries skip them.
+	Rules []*TaskRule
+	// MaxDepth bounds the nesting of subtasks, the workers of the tasks at depth MaxDepth can not
+	// delegate subtasks. 0 disables subtasks.
+	MaxDepth int
+	// RunSubtask runs the worker of a subtask created by the worker of a task, set by the workflow.
+	RunSubtask func(ctx context.Context, child *TaskMgr, task Task) error
+	// Plan is written by the orchestrator before the first task when the plan mode is on, nil
+	// otherwise. The task managers of subtasks use the plan of the root.
+	Plan *Plan
+
+	// mu guards Pending and the status of its tasks, the workers of parallel tasks finish concurrently.
+	mu     sync.Mutex
+	nextID int
+	// taskDefs are the task types of this task manager only, see RegisterTaskDef.
+	taskDefs []*TaskDef
+	// parent is the task manager of parentTask for the task manager of its subtasks, see NewChild.
+	parent     *TaskMgr
+	parentTask Task
+	depth      int
 }
 
 func (mgr *TaskMgr) Reset(userGoal string) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
 	mgr.UserGoal = userGoal
 	mgr.PreTasks = nil
-	mgr.CurrentTask = nil
+	mgr.Pending = nil
+	mgr.Plan = nil
+	mgr.nextID = 0
+	mgr.saveCheckpoint()
 }
 
 func (mgr *TaskMgr) FillToolLog(context []ContextItem) error {
 	var err []error
 	for i, elem := range context {
-		if elem.ID < 0 || elem.ID >= len(mgr.ToolDispatcher.toolLog) {
-			err = append(err, fmt.Errorf("invalid tool log ID %d, must be between 0 and %d", elem.ID, len(mgr.ToolDispatcher.toolLog)-1))
+		entry, getErr := mgr.ToolLog.Get(elem.ID)
+		if getErr != nil {
+			err = append(err, getErr)
 		} else {
-			context[i].ToolLog = mgr.ToolDispatcher.toolLog[elem.ID]
+			context[i].ToolLog = entry
 		}
 	}
 	if len(err) != 0 {
@@ -81,331 +88,315 @@ func (mgr *TaskMgr) FillToolLog(context []ContextItem) error {
 	return nil
 }
 
-func (mgr *TaskMgr) refineContext(oldID int, newID int) error {
-	// task := mgr.PreTasks[len(mgr.PreTasks)-1]
-	// item, exist := task.Context[oldID]
-	// if !exist {
-	// 	return fmt.Errorf("contex ID %d not found", oldID)
-	// }
-	// item.ID = newID
-	return nil
+// TaskContext returns the context items of the task.
+func TaskContext(task Task) []ContextItem {
+	return task.Base().Context
 }
 
-func (mgr *TaskMgr) createTask(task Task) error {
-	if mgr.CurrentTask != nil {
-		return fmt.Errorf("Current Task %s not finished, can not create new task", task.GetTask())
+func (mgr *TaskMgr) createTask(def *TaskDef, task Task, dependsOn []int) (int, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	err := mgr.checkRules(task, dependsOn)
+	if err != nil {
+		return 0, err
 	}
-	mgr.CurrentTask = task
-	return nil
+	id, err := mgr.addTask(def, task, dependsOn, "")
+	if err != nil {
+		return 0, err
+	}
+	mgr.linkPlanStep(task)
+	return id, nil
 }
 
-func (mgr *TaskMgr) finishTask() error {
-	if mgr.CurrentTask == nil {
-		return fmt.Errorf("There is no current task, can not finish task")
+// addTask adds the task to Pending with the next ID, called with mu held.
+func (mgr *TaskMgr) addTask(def *TaskDef, task Task, dependsOn []int, detail string) (int, error) {
+	if mgr.parent != nil {
+		// subtasks have no dependencies, their IDs are unique in the whole task tree
+		id := mgr.root().allocID()
+		mgr.initTask(def, task, id, nil, detail)
+		return id, nil
 	}
-
-	mgr.PreTasks = append(mgr.PreTasks, mgr.CurrentTask)
-	mgr.CurrentTask = nil
-	return nil
-}
-func (mgr *TaskMgr) GetInputForRefineContext() string {
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("** USER PRIMARY GOAL **: %s\n", mgr.UserGoal))
-	builder.WriteString("### TASK HISTORY\n")
-	length := len(mgr.PreTasks)
-	if len(mgr.PreTasks) != 0 {
-		builder.WriteString("** Completed Tasks **\n")
-		for _, task := range mgr.PreTasks[:length-1] {
-			builder.WriteString(task.FormatString())
+	for _, dep := range dependsOn {
+		// the IDs are shared with the subtasks, which are not tasks of the orchestrator
+		if taskIndex(mgr.PreTasks, dep) < 0 && taskIndex(mgr.Pending, dep) < 0 {
+			return 0, fmt.Errorf("invalid dependency #%d, a task can only depend on the tasks created before it, not on subtasks", dep)
 		}
-		builder.WriteByte('\n')
 	}
-
-	lastTask := mgr.PreTasks[length-1]
-	builder.WriteString(lastTask.FormatString())
-	builder.WriteString("Refine the context from the last task above\n")
-
-	builder.WriteByte('\n')
-	return builder.String()
+	id := mgr.nextID + 1
+	mgr.nextID = id
+	mgr.initTask(def, task, id, dependsOn, detail)
+	return id, nil
 }
 
-func (mgr *TaskMgr) GetTaskContextPrompt() string {
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("** USER PRIMARY GOAL **: %s\n", mgr.UserGoal))
-	builder.WriteString("### TASK HISTORY\n")
-	if len(mgr.PreTasks) != 0 {
-		builder.WriteString("** Completed Tasks **\n")
-		for _, task := range mgr.PreTasks {
-			builder.WriteString(task.FormatString())
-		}
-		builder.WriteByte('\n')
-	}
-
-	if mgr.CurrentTask == nil {
-		builder.WriteString("NO TASK IN PROGRESS\n")
-	} else {
-		builder.WriteString("Focus MAINLY on this 'Current Task', accomplish the 'Current Task'\n")
-		builder.WriteString("** Current Tasks **\n")
-		builder.WriteString(mgr.CurrentTask.FormatString())
+func (mgr *TaskMgr) initTask(def *TaskDef, task Task, id int, dependsOn []int, detail string) {
+	base := task.Base()
+	base.ID = id
+	if mgr.parentTask != nil {
+		base.ParentID = mgr.parentTask.Base().ID
 	}
-	builder.WriteByte('\n')
-	return builder.String()
+	base.Type = def.Name
+	base.Role = def.Role
+	base.Status = TaskPending
+	base.DependsOn = dependsOn
+	base.CreatedAt = time.Now()
+	mgr.Pending = append(mgr.Pending, task)
+	mgr.recordTask(task, "created", detail)
+	mgr.saveCheckpoint()
 }
 
-type CreateTaskArgs struct {
-	Goal          string
-	ConclusionReq string
-	ContextReq    string
-}
-type FinishTaskArgs struct {
-	Conclusion string
-	Context    []ContextItem
+func (mgr *TaskMgr) recordTask(task Task, transition string, detail string) {
+	mgr.Trajectory.Record(trajectory.Event{
+		Type: trajectory.EventTask,
+		Task: &trajectory.TaskEvent{
+			ID:         task.Base().ID,
+			Type:       TaskType(task),
+			Transition: transition,
+			Goal:       task.GetTask(),
+			Detail:     detail,
+		},
+	})
 }
-type RefineContextArgs struct {
-	OldID int
-	NewID int
+
+// StartTask marks the pending task as running, called before its worker starts.
+func (mgr *TaskMgr) StartTask(task Task) error {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.pendingIndex(task) < 0 {
+		return fmt.Errorf("task #%d is not pending, can not start task", task.Base().ID)
+	}
+	base := task.Base()
+	base.Status = TaskRunning
+	base.StartedAt = time.Now()
+	base.Attempts++
+	mgr.recordTask(task, "started", "")
+	return nil
 }
-type CreateExploreTaskArgs struct {
-	Task         string
-	ExpectOutput string
+
+// finishTask ends the pending task in the done status, reason is why the task did not succeed. The
+// task is moved to PreTasks by MergeTask.
+func (mgr *TaskMgr) finishTask(task Task, status TaskStatus, reason string) error {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.pendingIndex(task) < 0 {
+		return fmt.Errorf("task #%d is not pending, can not finish task", task.Base().ID)
+	}
+	if task.Base().Status.Done() {
+		return fmt.Errorf("task #%d is already %s", task.Base().ID, task.Base().Status)
+	}
+	mgr.setDone(task, status, reason)
+	return nil
 }
 
-func (mgr *TaskMgr) CreateExploreTaskTool() ToolEndPoint {
-	endpoint := CreateExploreTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para CreateExploreTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		task := &ExploreTask{
-			Task:         para.Task,
-			ExpectOutput: para.ExpectOutput,
-			Context:      []ContextItem{},
-		}
-		err = mgr.createTask(task)
-		if err != nil {
-			return "", err
-		}
-		return "", nil
+func (mgr *TaskMgr) setDone(task Task, status TaskStatus, reason string) {
+	base := task.Base()
+	base.FinishedAt = time.Now()
+	base.Status = status
+	if status == TaskSucceeded {
+		mgr.recordTask(task, "finished", "")
+		return
 	}
-	return endpoint
+	task.Fail(reason)
+	mgr.recordTask(task, string(status), reason)
 }
 
-type CreateReasonTaskArgs struct {
-	Task         string
-	ExpectOutput string
+// IsFinished reports whether the pending task was finished by its worker.
+func (mgr *TaskMgr) IsFinished(task Task) bool {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return task.Base().Status.Done()
 }
 
-func (mgr *TaskMgr) CreateReasonTaskTool() ToolEndPoint {
-	endpoint := CreateReasonTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para CreateReasonTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		task := &ReasonTask{
-			Task:         para.Task,
-			ExpectOutput: para.ExpectOutput,
-			Conclusion:   "",
-		}
-		err = mgr.createTask(task)
-		if err != nil {
-			return "", err
+func (mgr *TaskMgr) pendingIndex(task Task) int {
+	for i, pending := range mgr.Pending {
+		if pending == task {
+			return i
 		}
-		return "", nil
 	}
-	return endpoint
+	return -1
 }
 
-type CreateBuildTaskArgs struct {
-	Task string
+// FailTask finishes the task with a failure the orchestrator can see in the task history.
+func (mgr *TaskMgr) FailTask(task Task, reason string) error {
+	return mgr.finishTask(task, TaskFailed, reason)
 }
 
-func (mgr *TaskMgr) CreateBuildTaskTool() ToolEndPoint {
-	endpoint := CreateBuildTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para CreateBuildTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		task := &BuildTask{
-			Task:      para.Task,
-			ChangeLog: "",
-			Context:   []ContextItem{},
+// ReadyTasks returns the pending tasks not started yet whose dependencies all succeeded, in ID order.
+// A task created or retried after a dependency did not succeed fails without running.
+func (mgr *TaskMgr) ReadyTasks() []Task {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	merged := map[int]TaskStatus{}
+	for _, task := range mgr.PreTasks {
+		merged[task.Base().ID] = task.Base().Status
+	}
+	var ready []Task
+	var failed []int
+	for _, task := range mgr.Pending {
+		base := task.Base()
+		if base.Status != TaskPending {
+			continue
+		}
+		ok := true
+		for _, dep := range base.DependsOn {
+			status, done := merged[dep]
+			if status == TaskSucceeded {
+				continue
+			}
+			ok = false
+			if done {
+				mgr.setDone(task, TaskFailed, fmt.Sprintf("dependency #%d %s", dep, status))
+				failed = append(failed, base.ID)
+				failed = append(failed, mgr.cascade(base.ID, TaskFailed, "dependency #%d failed")...)
+			}
+			break
 		}
-		err = mgr.createTask(task)
-		if err != nil {
-			return "", err
+		if ok {
+			ready = append(ready, task)
 		}
-		return "", nil
 	}
-	return endpoint
+	if len(failed) != 0 {
+		mgr.mergeDone(failed)
+		mgr.saveCheckpoint()
+	}
+	return ready
 }
 
-type CreateVerifyTaskArgs struct {
-	Task string
+// MergeTask moves the task from Pending to PreTasks, a task whose worker stopped without finishing it
+// is merged as failed. The pending tasks depending on a task that did not succeed fail with it.
+func (mgr *TaskMgr) MergeTask(task Task) error {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	index := mgr.pendingIndex(task)
+	if index < 0 {
+		return fmt.Errorf("task #%d is not pending, can not merge task", task.Base().ID)
+	}
+	if !task.Base().Status.Done() {
+		mgr.setDone(task, TaskFailed, "the worker stopped without finishing the task")
+	}
+
+	mgr.Pending = append(mgr.Pending[:index], mgr.Pending[index+1:]...)
+	mgr.PreTasks = append(mgr.PreTasks, task)
+	mgr.recordTask(task, "merged", "")
+	if status := task.Base().Status; status != TaskSucceeded {
+		// the output the dependents need was never produced, they fail with the task
+		mgr.mergeDone(mgr.cascade(task.Base().ID, TaskFailed, "dependency #%d "+string(status)))
+	}
+	if verifyTask, ok := task.(*VerifyTask); ok && verifyTask.Status == TaskSucceeded {
+		mgr.startFixCycle(verifyTask)
+	}
+	mgr.saveCheckpoint()
+	return nil
 }
 
-func (mgr *TaskMgr) CreateVerifyTaskTool() ToolEndPoint {
-	endpoint := CreateVerifyTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para CreateVerifyTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		task := &VerifyTask{
-			Task:       para.Task,
-			Conclusion: "",
-			Context:    []ContextItem{},
-		}
-		err = mgr.createTask(task)
-		if err != nil {
-			return "", err
+// AbortPending merges the unfinished tasks as abandoned, used when the workers are cancelled.
+func (mgr *TaskMgr) AbortPending() {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	for _, task := range mgr.Pending {
+		if !task.Base().Status.Done() {
+			mgr.setDone(task, TaskAbandoned, "the user task was interrupted")
 		}
-		return "", nil
+		mgr.PreTasks = append(mgr.PreTasks, task)
+		mgr.recordTask(task, "merged", "")
 	}
-	return endpoint
+	mgr.Pending = nil
+	mgr.saveCheckpoint()
 }
 
-func (mgr *TaskMgr) RefineContextTool() ToolEndPoint {
-	def := openai.FunctionDefinition{
-		Name:        "refine_context",
-		Description: "replace the context with the refined context",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"OldID": {
-					Type:        jsonschema.Integer,
-					Description: "the old id of the context",
-				},
-				"NewID": {
-					Type:        jsonschema.Integer,
-					Description: "the new id of the context",
-				},
-			},
-			Required: []string{"OldD", "NewID"},
-		},
-	}
-	Handler := func(args string) (string, error) {
-		var para RefineContextArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		err = mgr.refineContext(para.OldID, para.NewID)
-		if err != nil {
-			return "", err
+// GetTaskContextPrompt renders the task history for an agent, current is the task of a worker
+// and nil for the orchestrator.
+func (mgr *TaskMgr) GetTaskContextPrompt(current Task) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("** USER PRIMARY GOAL **: %s\n", mgr.UserGoal))
+	mgr.writePlan(&builder)
+	builder.WriteString("### TASK HISTORY\n")
+	if mgr.parentTask != nil {
+		// the parent task shows the finished subtasks, the history of the parent is left out
+		builder.WriteString("** Parent Task **\n")
+		builder.WriteString(mgr.parentTask.FormatString())
+		builder.WriteByte('\n')
+	} else if len(mgr.PreTasks) != 0 {
+		builder.WriteString("** Completed Tasks **\n")
+		for _, text := range mgr.renderHistory(current) {
+			builder.WriteString(text)
 		}
-		return "", nil
+		builder.WriteByte('\n')
 	}
-	endpoint := ToolEndPoint{
-		Name:    "refine_context",
-		Def:     def,
-		Handler: Handler,
+
+	if current == nil {
+		builder.WriteString("NO TASK IN PROGRESS\n")
+	} else {
+		builder.WriteString("Focus MAINLY on this 'Current Task', accomplish the 'Current Task'\n")
+		builder.WriteString("** Current Tasks **\n")
+		builder.WriteString(current.FormatString())
 	}
-	return endpoint
+	builder.WriteByte('\n')
+	return builder.String()
 }
 
-func (mgr *TaskMgr) FinishExploreTaskTool() ToolEndPoint {
-	endpoint := FinishExploreTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para FinishExploreTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
+// CreateTaskTool binds the create tool of the task type to the task manager.
+func (mgr *TaskMgr) CreateTaskTool(def *TaskDef) ToolEndPoint {
+	endpoint := def.CreateTool()
+	endpoint.Handler = func(ctx context.Context, args string) (string, error) {
+		task, dependsOn, err := def.Create(args)
 		if err != nil {
 			return "", err
 		}
-		// Cast to ExploreTask to update Context
-		if exploreTask, ok := mgr.CurrentTask.(*ExploreTask); ok {
-			err := mgr.FillToolLog(para.Context)
-			if err != nil {
-				return "", err
-			}
-			exploreTask.Context = para.Context
-		}
-		err = mgr.finishTask()
+		task.Base().CreateArgs = args
+		id, err := mgr.createTask(def, task, dependsOn)
 		if err != nil {
 			return "", err
 		}
-		return "", nil
+		return fmt.Sprintf("created %s task #%d", def.Name, id), nil
 	}
 	return endpoint
 }
 
-func (mgr *TaskMgr) FinishReasonTaskTool() ToolEndPoint {
-	endpoint := FinishReasonTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para FinishReasonTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		// Cast to ReasonTask to update Conclusion
-		if reasonTask, ok := mgr.CurrentTask.(*ReasonTask); ok {
-			reasonTask.Conclusion = para.Conclusion
-		}
-		err = mgr.finishTask()
-		if err != nil {
-			return "", err
-		}
-		return "", nil
+// CreateTaskTools returns the create tools of all registered task types.
+func (mgr *TaskMgr) CreateTaskTools() []ToolEndPoint {
+	var endpoints []ToolEndPoint
+	for _, def := range mgr.TaskDefs() {
+		endpoints = append(endpoints, mgr.CreateTaskTool(def))
 	}
-	return endpoint
+	return endpoints
 }
 
-func (mgr *TaskMgr) FinishBuildTaskTool() ToolEndPoint {
-	endpoint := FinishBuildTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para FinishBuildTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
+// FinishTaskTool finishes the running task of the worker it is registered for, the arguments are
+// stored with the status change so a checkpoint never sees a half finished task.
+func (mgr *TaskMgr) FinishTaskTool(def *TaskDef, task Task) ToolEndPoint {
+	endpoint := def.FinishTool()
+	endpoint.Handler = func(ctx context.Context, args string) (string, error) {
+		store, err := def.Finish(mgr, task, args)
 		if err != nil {
 			return "", err
 		}
-		// Cast to BuildTask to update ChangeLog and Context
-		if buildTask, ok := mgr.CurrentTask.(*BuildTask); ok {
-			err := mgr.FillToolLog(para.Context)
-			if err != nil {
-				return "", err
-			}
-			buildTask.ChangeLog = para.ChangeLog
-			buildTask.Context = para.Context
+		mgr.mu.Lock()
+		defer mgr.mu.Unlock()
+		if mgr.pendingIndex(task) < 0 {
+			return "", fmt.Errorf("task #%d is not pending, can not finish task", task.Base().ID)
 		}
-		err = mgr.finishTask()
-		if err != nil {
-			return "", err
+		if status := task.Base().Status; status != TaskRunning {
+			// a done task keeps its result, its dependents may have read it already
+			return "", fmt.Errorf("task #%d is %s, only a running task can be finished", task.Base().ID, status)
 		}
+		store()
+		foldSubtaskContext(task)
+		mgr.setDone(task, TaskSucceeded, "")
 		return "", nil
 	}
 	return endpoint
 }
 
-func (mgr *TaskMgr) FinishVerifyTaskTool() ToolEndPoint {
-	endpoint := FinishVerifyTask()
-	endpoint.Handler = func(args string) (string, error) {
-		var para FinishVerifyTaskArgs
-		err := json.Unmarshal([]byte(args), &para)
-		if err != nil {
-			return "", err
-		}
-		// Cast to VerifyTask to update Conclusion and Context
-		if verifyTask, ok := mgr.CurrentTask.(*VerifyTask); ok {
-			err := mgr.FillToolLog(para.Context)
-			if err != nil {
-				return "", err
-			}
-			verifyTask.Conclusion = para.Conclusion
-			verifyTask.Context = para.Context
-		}
-		err = mgr.finishTask()
-		if err != nil {
-			return "", err
-		}
-		return "", nil
+type BashToolArgs struct {
+	Command string
+	Cwd     string
+}
+
+func writeFileChanges(builder *strings.Builder, tag string, files []string) {
+	if len(files) == 0 {
+		return
 	}
-	return endpoint
+	builder.WriteString(fmt.Sprintf("<%s>%s</%s>\n", tag, strings.Join(files, ", "), tag))
 }
 
 func (mgr *TaskMgr) BashTool() ToolEndPoint {
@@ -427,28 +418,29 @@ func (mgr *TaskMgr) BashTool() ToolEndPoint {
 			Required: []string{"Command", "Cwd"},
 		},
 	}
-	Handler := func(args string) (string, error) {
-		println(args)
-		scanner := bufio.NewScanner(os.Stdin)
-		var output struct {
-			Code   int
-			Output string
+	Handler := func(ctx context.Context, args string) (string, error) {
+		var para BashToolArgs
+		err := json.Unmarshal([]byte(args), &para)
+		if err != nil {
+			return "", err
 		}
-		if !scanner.Scan() {
-			return "", fmt.Errorf("can not read from stdin")
+		if mgr.Executor == nil {
+			return "", fmt.Errorf("no bash executor configured")
 		}
-		line := scanner.Text() // Automatically trims the newline
-		err := json.Unmarshal([]byte(line), &output)
+		output, err := mgr.Executor.Exec(ctx, para.Command, para.Cwd)
 		if err != nil {
 			return "", err
 		}
 		var builder strings.Builder
 		builder.WriteString("<returncode>")
-		builder.WriteString(fmt.Sprintf("%d", output.Code))
+		builder.WriteString(fmt.Sprintf("%d", output.ExitCode))
 		builder.WriteString("</returncode>\n")
 		builder.WriteString("<output>\n")
 		builder.WriteString(output.Output)
 		builder.WriteString("</output>\n")
+		writeFileChanges(&builder, "modified_files", output.ModifiedFiles)
+		writeFileChanges(&builder, "created_files", output.CreatedFiles)
+		writeFileChanges(&builder, "deleted_files", output.DeletedFiles)
 		return builder.String(), nil
 	}
 	endpoint := ToolEndPoint{
@@ -458,22 +450,3 @@ func (mgr *TaskMgr) BashTool() ToolEndPoint {
 	}
 	return endpoint
 }
-
-func (mgr *TaskMgr) GetCurrentTaskType() string {
-	if mgr.CurrentTask == nil {
-		return ""
-	}
-
-	switch mgr.CurrentTask.(type) {
-	case *ExploreTask:
-		return "explore"
-	case *ReasonTask:
-		return "reason"
-	case *BuildTask:
-		return "build"
-	case *VerifyTask:
-		return "verify"
-	default:
-		return ""
-	}
-}
@@ -0,0 +1,837 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"multi-agent/config"
+	"multi-agent/service"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func echoTool() service.ToolEndPoint {
+	return service.ToolEndPoint{
+		Name: "echo",
+		Def:  openai.FunctionDefinition{Name: "echo"},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			return args, nil
+		},
+	}
+}
+
+func callTool(t *testing.T, td *service.ToolDispatcher, name string, args string) openai.ChatCompletionMessage {
+	t.Helper()
+	return td.Run(context.Background(), openai.ToolCall{
+		ID:       "call_" + name,
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: name, Arguments: args},
+	})
+}
+
+func finishTool(t *testing.T, mgr *service.TaskMgr, task service.Task) service.ToolEndPoint {
+	t.Helper()
+	def, ok := mgr.LookupTaskDef(service.TaskType(task))
+	if !ok {
+		t.Fatalf("task #%d has unknown type %q", task.Base().ID, service.TaskType(task))
+	}
+	return mgr.FinishTaskTool(def, task)
+}
+
+func TestTaskMgrCheckpoint(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("find the bug")
+
+	callTool(t, td, "create_explore_task", `{"Task":"find handlers","ExpectOutput":"handler list"}`)
+	explore := mgr.Pending[0]
+	if err := mgr.StartTask(explore); err != nil {
+		t.Fatal(err)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(echoTool(), finishTool(t, mgr, explore))
+	callTool(t, worker, "echo", `handlers are in api/server.go`)
+	callTool(t, worker, "finish_explore_task", `{"Context":[{"ID":1,"Desc":"handler list"}]}`)
+	err := mgr.MergeTask(explore)
+	if err != nil {
+		t.Fatalf("merge task failed: %v", err)
+	}
+	callTool(t, td, "create_reason_task", `{"Task":"why does it fail","ExpectOutput":"root cause","DependsOn":[1]}`)
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	err = mgr.SaveCheckpoint(path)
+	if err != nil {
+		t.Fatalf("save checkpoint failed: %v", err)
+	}
+
+	restored := &service.TaskMgr{ToolLog: service.NewToolLog()}
+	err = restored.LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("load checkpoint failed: %v", err)
+	}
+	if restored.UserGoal != "find the bug" || len(restored.PreTasks) != 1 || len(restored.Pending) != 1 || service.TaskType(restored.Pending[0]) != "reason" {
+		t.Fatalf("unexpected restored state: goal %q, %d tasks, %d pending", restored.UserGoal, len(restored.PreTasks), len(restored.Pending))
+	}
+	if restored.ToolLog.Len() != mgr.ToolLog.Len() {
+		t.Fatalf("expect %d tool logs, got %d", mgr.ToolLog.Len(), restored.ToolLog.Len())
+	}
+	restoredExplore := restored.PreTasks[0].(*service.ExploreTask)
+	if restoredExplore.Context[0].ToolLog == nil || restoredExplore.Context[0].ToolLog.ToolRes != "handlers are in api/server.go" {
+		t.Errorf("context item tool log not restored: %+v", restoredExplore.Context[0])
+	}
+	if restored.GetTaskContextPrompt(restored.Pending[0]) != mgr.GetTaskContextPrompt(mgr.Pending[0]) {
+		t.Errorf("restored prompt differs:\n%s\nwant:\n%s", restored.GetTaskContextPrompt(restored.Pending[0]), mgr.GetTaskContextPrompt(mgr.Pending[0]))
+	}
+}
+
+func TestTaskMgrParallelTasks(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("find the bug")
+
+	callTool(t, td, "create_explore_task", `{"Task":"find handlers","ExpectOutput":"handler list"}`)
+	callTool(t, td, "create_explore_task", `{"Task":"find queries","ExpectOutput":"query list"}`)
+	callTool(t, td, "create_reason_task", `{"Task":"why does it fail","ExpectOutput":"root cause","DependsOn":[1,2]}`)
+	res := callTool(t, td, "create_reason_task", `{"Task":"bad","ExpectOutput":"none","DependsOn":[7]}`)
+	if !strings.Contains(res.Content, "invalid dependency #7") || len(mgr.Pending) != 3 {
+		t.Fatalf("expect dependency on a later task to be rejected, got %s", res.Content)
+	}
+
+	ready := mgr.ReadyTasks()
+	if len(ready) != 2 {
+		t.Fatalf("expect the two explore tasks to be ready, got %d", len(ready))
+	}
+	// the workers share the tool log but not their tools
+	workers := make([]*service.ToolDispatcher, len(ready))
+	var wg sync.WaitGroup
+	for i, task := range ready {
+		if err := mgr.StartTask(task); err != nil {
+			t.Fatal(err)
+		}
+		workers[i] = service.NewToolDispatcher(mgr.ToolLog)
+		workers[i].RegisterToolEndpoint(echoTool(), finishTool(t, mgr, task))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callTool(t, workers[i], "echo", fmt.Sprintf("result of task %d", i+1))
+			// the ID in the shared log depends on which worker ran first
+			id := workers[i].GetToolLog()[0].ID
+			callTool(t, workers[i], "finish_explore_task", fmt.Sprintf(`{"Context":[{"ID":%d,"Desc":"result"}]}`, id))
+		}()
+	}
+	wg.Wait()
+	for _, task := range ready {
+		err := mgr.MergeTask(task)
+		if err != nil {
+			t.Fatalf("merge task failed: %v", err)
+		}
+	}
+
+	if len(workers[0].GetTools()) != 2 || len(td.GetToolLog()) != 4 || mgr.ToolLog.Len() != 8 {
+		t.Errorf("unexpected tool views: %d worker tools, %d orchestrator calls, %d calls in total", len(workers[0].GetTools()), len(td.GetToolLog()), mgr.ToolLog.Len())
+	}
+
+	ready = mgr.ReadyTasks()
+	if len(ready) != 1 || service.TaskType(ready[0]) != "reason" {
+		t.Fatalf("expect the reason task to be ready after its dependencies, got %d tasks", len(ready))
+	}
+	for i, task := range mgr.PreTasks {
+		item := task.(*service.ExploreTask).Context[0]
+		if item.ToolLog == nil || item.ToolLog.ID != item.ID || item.ToolLog.ToolRes != fmt.Sprintf("result of task %d", i+1) {
+			t.Errorf("context item of task %d does not refer to its tool log entry: %+v", i+1, item)
+		}
+	}
+	if !strings.Contains(mgr.GetTaskContextPrompt(ready[0]), "Depends On: #1, #2") {
+		t.Errorf("expect the dependencies in the prompt:\n%s", mgr.GetTaskContextPrompt(ready[0]))
+	}
+}
+
+// TestTaskMgrParallelCheckpoint finishes parallel workers while the transitions of the others write
+// the checkpoint, run it with -race.
+func TestTaskMgrParallelCheckpoint(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog(), CheckpointPath: filepath.Join(t.TempDir(), "checkpoint.json")}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("find the bug")
+
+	const rounds, workers = 10, 4
+	for round := range rounds {
+		for i := range workers {
+			callTool(t, td, "create_explore_task", fmt.Sprintf(`{"Task":"find part %d of round %d","ExpectOutput":"the files"}`, i+1, round+1))
+		}
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, task := range mgr.ReadyTasks() {
+			if err := mgr.StartTask(task); err != nil {
+				t.Fatal(err)
+			}
+			worker := service.NewToolDispatcher(mgr.ToolLog)
+			worker.RegisterToolEndpoint(echoTool(), finishTool(t, mgr, task))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				callTool(t, worker, "echo", fmt.Sprintf("output of task %d", task.Base().ID))
+				id := worker.GetToolLog()[0].ID
+				res := callTool(t, worker, "finish_explore_task", fmt.Sprintf(`{"Context":[{"ID":%d,"Desc":"result"}]}`, id))
+				if !mgr.IsFinished(task) {
+					t.Errorf("task #%d not finished: %s", task.Base().ID, res.Content)
+				}
+				if err := mgr.MergeTask(task); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+	}
+
+	restored := &service.TaskMgr{ToolLog: service.NewToolLog()}
+	if err := restored.LoadCheckpoint(mgr.CheckpointPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.PreTasks) != rounds*workers {
+		t.Fatalf("expect %d finished tasks in the checkpoint, got %d", rounds*workers, len(restored.PreTasks))
+	}
+	for _, task := range restored.PreTasks {
+		if len(service.TaskContext(task)) != 1 {
+			t.Errorf("expect the context of task #%d in the checkpoint, got %+v", task.Base().ID, service.TaskContext(task))
+		}
+	}
+}
+
+func TestTaskMgrCompaction(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	td.RegisterToolEndpoint(mgr.ViewToolLogTool())
+	mgr.Reset("read the config")
+
+	// three explore tasks viewing the same file, the last one views it again
+	results := []string{"old config", "other file", "new config"}
+	args := []string{"config.json", "main.go", "config.json"}
+	for i := range results {
+		callTool(t, td, "create_explore_task", fmt.Sprintf(`{"Task":"task %d %s","ExpectOutput":"%s"}`, i+1, strings.Repeat("long goal ", 100), strings.Repeat("details ", 200)))
+		task := mgr.Pending[0]
+		if err := mgr.StartTask(task); err != nil {
+			t.Fatal(err)
+		}
+		worker := service.NewToolDispatcher(mgr.ToolLog)
+		worker.RegisterToolEndpoint(service.ToolEndPoint{
+			Name: "cat",
+			Def:  openai.FunctionDefinition{Name: "cat"},
+			Handler: func(ctx context.Context, _ string) (string, error) {
+				return results[i], nil
+			},
+		}, finishTool(t, mgr, task))
+		id := mgr.ToolLog.Len()
+		callTool(t, worker, "cat", args[i])
+		callTool(t, worker, "finish_explore_task", fmt.Sprintf(`{"Context":[{"ID":%d,"Desc":"%s"}]}`, id, args[i]))
+		if err := mgr.MergeTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs := mgr.GetAllTaskToolCallMessages()
+	if len(msgs) != 4 || !strings.Contains(msgs[1].Content, "other file") || !strings.Contains(msgs[3].Content, "new config") {
+		t.Errorf("expect the first view of config.json superseded, got %v", msgs)
+	}
+
+	full := mgr.GetTaskContextPrompt(nil)
+	mgr.HistoryTokens = 1000
+	compact := mgr.GetTaskContextPrompt(nil)
+	if strings.Count(compact, "Summary (compacted)") != 2 || len(compact) >= len(full) {
+		t.Errorf("expect the 2 older tasks summarised:\n%s", compact)
+	}
+	if !strings.Contains(compact, "  #4: main.go\n") || !strings.Contains(compact, "Expected Output: "+strings.Repeat("details ", 200)) {
+		t.Errorf("expect the last task in full:\n%s", compact)
+	}
+
+	res := callTool(t, td, "view_tool_log", `{"ID":1,"Limit":1}`)
+	if res.Content != "<ToolLogID>9</ToolLogID>\ntool log #1, lines 0-1 of 2\n<ToolLogID>1</ToolLogID>" {
+		t.Errorf("unexpected view_tool_log output %q", res.Content)
+	}
+}
+
+func TestTaskMgrRefineContext(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("explain main")
+
+	callTool(t, td, "create_explore_task", `{"Task":"read main","ExpectOutput":"the main function"}`)
+	task := mgr.Pending[0]
+	if err := mgr.StartTask(task); err != nil {
+		t.Fatal(err)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(echoTool(), finishTool(t, mgr, task))
+	callTool(t, worker, "echo", "the whole main.go")
+	callTool(t, worker, "echo", "the imports of main.go")
+	callTool(t, worker, "finish_explore_task", `{"Context":[{"ID":1,"Desc":"main.go"},{"ID":2,"Desc":"imports"}]}`)
+	if err := mgr.MergeTask(task); err != nil {
+		t.Fatal(err)
+	}
+
+	refiner := service.NewToolDispatcher(mgr.ToolLog)
+	refiner.RegisterToolEndpoint(echoTool(), mgr.RefineContextTool(task), mgr.DropContextTool(task))
+	if !strings.Contains(mgr.GetRefineContextPrompt(task), "Refine the context items of task #1") {
+		t.Errorf("unexpected refine prompt:\n%s", mgr.GetRefineContextPrompt(task))
+	}
+	callTool(t, refiner, "echo", "func main() {}")
+	callTool(t, refiner, "refine_context", `{"OldID":1,"NewID":4,"Desc":"the main function"}`)
+	callTool(t, refiner, "drop_context", `{"ID":2}`)
+	res := callTool(t, refiner, "refine_context", `{"OldID":2,"NewID":4}`)
+	if !strings.Contains(res.Content, "task #1 has no context item #2") {
+		t.Errorf("expect refining a dropped item to fail, got %q", res.Content)
+	}
+	res = callTool(t, refiner, "refine_context", `{"OldID":4,"NewID":42}`)
+	if !strings.Contains(res.Content, "invalid tool log ID 42") {
+		t.Errorf("expect an unknown tool log to fail, got %q", res.Content)
+	}
+
+	items := service.TaskContext(task)
+	if len(items) != 1 || items[0].ID != 4 || items[0].Desc != "the main function" {
+		t.Fatalf("unexpected context %+v", items)
+	}
+	msgs := mgr.GetAllTaskToolCallMessages()
+	if len(msgs) != 2 || !strings.Contains(msgs[1].Content, "func main() {}") {
+		t.Errorf("expect the refined tool call only, got %v", msgs)
+	}
+}
+
+type noteTask struct {
+	service.TaskBase
+	Note string
+}
+
+func (t *noteTask) GetTask() string {
+	return "note"
+}
+
+func (t *noteTask) FormatString() string {
+	return fmt.Sprintf("--- NOTE TASK #%d ---\nNote: %s\n", t.ID, t.Note)
+}
+
+func TestTaskMgrTaskDef(t *testing.T) {
+	def := &service.TaskDef{
+		Name:       "note",
+		Role:       "reason",
+		New:        func() service.Task { return &noteTask{} },
+		CreateTool: func() service.ToolEndPoint { return service.ToolEndPoint{Name: "create_note_task"} },
+		FinishTool: func() service.ToolEndPoint { return service.ToolEndPoint{Name: "finish_note_task"} },
+		Create: func(args string) (service.Task, []int, error) {
+			return &noteTask{}, nil, nil
+		},
+		Finish: func(mgr *service.TaskMgr, task service.Task, args string) (func(), error) {
+			return func() { task.(*noteTask).Note = args }, nil
+		},
+	}
+	explore, _ := service.LookupTaskDef("explore")
+	if err := service.RegisterTaskDef(explore); err == nil {
+		t.Errorf("expect registering %q twice to fail", explore.Name)
+	}
+
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	if err := mgr.RegisterTaskDef(def); err != nil {
+		t.Fatal(err)
+	}
+	td.RegisterToolEndpoint(mgr.CreateTaskTool(def))
+	mgr.Reset("take notes")
+	res := callTool(t, td, "create_note_task", `{}`)
+	if !strings.Contains(res.Content, "created note task #1") {
+		t.Fatalf("unexpected create result %q", res.Content)
+	}
+	task := mgr.Pending[0]
+	base := task.Base()
+	if base.Type != "note" || base.Role != "reason" || base.Status != service.TaskPending || base.CreatedAt.IsZero() {
+		t.Fatalf("unexpected task base %+v", base)
+	}
+
+	if err := mgr.StartTask(task); err != nil {
+		t.Fatal(err)
+	}
+	if len(mgr.ReadyTasks()) != 0 || base.Status != service.TaskRunning || base.Attempts != 1 {
+		t.Fatalf("expect the started task to run, got %+v", base)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(finishTool(t, mgr, task))
+	callTool(t, worker, "finish_note_task", "done")
+	if !mgr.IsFinished(task) || base.Status != service.TaskSucceeded || base.FinishedAt.IsZero() {
+		t.Fatalf("expect the task to be finished, got %+v", base)
+	}
+	if res := callTool(t, worker, "finish_note_task", "again"); !strings.Contains(res.Content, "task #1 is succeeded") || task.(*noteTask).Note != "done" {
+		t.Errorf("expect a finished task to keep its result, got %q and note %q", res.Content, task.(*noteTask).Note)
+	}
+	if err := mgr.MergeTask(task); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := mgr.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &service.TaskMgr{ToolLog: service.NewToolLog()}
+	restored.RegisterTaskDef(def)
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.PreTasks[0].FormatString(); got != "--- NOTE TASK #1 ---\nNote: done\n" {
+		t.Errorf("unexpected restored task %q", got)
+	}
+}
+
+func TestTaskMgrCancelRetry(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	td.RegisterToolEndpoint(mgr.CancelTaskTool(), mgr.RetryTaskTool())
+	mgr.Reset("fix the bug")
+
+	callTool(t, td, "create_explore_task", `{"Task":"find handlers","ExpectOutput":"handler list"}`)
+	callTool(t, td, "create_build_task", `{"Task":"fix the handler","DependsOn":[1]}`)
+	callTool(t, td, "create_verify_task", `{"Task":"run the tests","DependsOn":[2]}`)
+	res := callTool(t, td, "cancel_task", `{"ID":2,"Reason":"explore first"}`)
+	if !strings.Contains(res.Content, "cancelled task #2, #3") {
+		t.Fatalf("unexpected cancel result %q", res.Content)
+	}
+	if len(mgr.Pending) != 1 || len(mgr.PreTasks) != 2 {
+		t.Fatalf("expect the cancelled tasks to be merged, got %d pending and %d merged", len(mgr.Pending), len(mgr.PreTasks))
+	}
+	if got := mgr.PreTasks[1].FormatString(); !strings.Contains(got, "CANCELLED: dependency #2 was cancelled") {
+		t.Errorf("unexpected cancelled task %q", got)
+	}
+
+	explore := mgr.Pending[0]
+	if err := mgr.StartTask(explore); err != nil {
+		t.Fatal(err)
+	}
+	res = callTool(t, td, "cancel_task", `{"ID":1,"Reason":"not needed"}`)
+	if !strings.Contains(res.Content, "task #1 is running") {
+		t.Errorf("expect cancelling a running task to fail, got %q", res.Content)
+	}
+	mgr.AbortPending()
+	base := explore.Base()
+	if base.Status != service.TaskAbandoned || len(mgr.Pending) != 0 || len(mgr.PreTasks) != 3 {
+		t.Fatalf("expect the running task to be abandoned, got %+v", base)
+	}
+
+	res = callTool(t, td, "retry_task", `{"ID":1}`)
+	if !strings.Contains(res.Content, "task #1 will run again") {
+		t.Fatalf("unexpected retry result %q", res.Content)
+	}
+	retried := mgr.Pending[0]
+	if retried == explore || retried.GetTask() != "find handlers" || retried.Base().ID != 1 || retried.Base().Status != service.TaskPending {
+		t.Fatalf("unexpected retried task %+v", retried.Base())
+	}
+	callTool(t, td, "retry_task", `{"ID":2}`)
+	if len(mgr.Pending) != 2 || mgr.Pending[1].Base().ID != 2 || len(mgr.ReadyTasks()) != 1 {
+		t.Fatalf("expect task #2 to wait for task #1")
+	}
+	res = callTool(t, td, "retry_task", `{"ID":2}`)
+	if !strings.Contains(res.Content, "task #2 is not done") {
+		t.Errorf("expect retrying a pending task to fail, got %q", res.Content)
+	}
+
+	if err := mgr.StartTask(retried); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.FailTask(retried, "the worker failed: timeout"); err != nil {
+		t.Fatal(err)
+	}
+	got := retried.FormatString()
+	if !strings.Contains(got, "FAILED: the worker failed: timeout\nAttempts: 2\n") {
+		t.Errorf("unexpected failed task %q", got)
+	}
+	if err := mgr.MergeTask(retried); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskMgrFailedDependency(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	td.RegisterToolEndpoint(mgr.RetryTaskTool())
+	mgr.Reset("fix the bug")
+
+	callTool(t, td, "create_explore_task", `{"Task":"find handlers","ExpectOutput":"handler list"}`)
+	callTool(t, td, "create_explore_task", `{"Task":"find the tests","ExpectOutput":"test list"}`)
+	callTool(t, td, "create_build_task", `{"Task":"fix the handler","DependsOn":[1]}`)
+	callTool(t, td, "create_verify_task", `{"Task":"run the tests","DependsOn":[2,3]}`)
+	explore := mgr.Pending[0]
+	if err := mgr.StartTask(explore); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.FailTask(explore, "the worker failed: timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.MergeTask(explore); err != nil {
+		t.Fatal(err)
+	}
+	if len(mgr.Pending) != 1 || mgr.Pending[0].Base().ID != 2 {
+		t.Fatalf("expect only the independent task #2 to stay pending, got %d pending", len(mgr.Pending))
+	}
+	for id, want := range map[int]string{3: "FAILED: dependency #1 failed", 4: "FAILED: dependency #3 failed"} {
+		i := slices.IndexFunc(mgr.PreTasks, func(task service.Task) bool { return task.Base().ID == id })
+		if i < 0 || !strings.Contains(mgr.PreTasks[i].FormatString(), want) {
+			t.Errorf("expect task #%d to fail with %q", id, want)
+		}
+	}
+	// a task created after its dependency failed does not run either
+	callTool(t, td, "create_reason_task", `{"Task":"why do the handlers fail","ExpectOutput":"root cause","DependsOn":[1]}`)
+	if ready := mgr.ReadyTasks(); len(ready) != 1 || ready[0].Base().ID != 2 {
+		t.Errorf("expect only task #2 to be ready, got %d tasks", len(ready))
+	}
+	if i := slices.IndexFunc(mgr.PreTasks, func(task service.Task) bool { return task.Base().ID == 5 }); i < 0 || !strings.Contains(mgr.PreTasks[i].FormatString(), "FAILED: dependency #1 failed") {
+		t.Errorf("expect the late task #5 to fail with its dependency")
+	}
+
+	callTool(t, td, "retry_task", `{"ID":1}`)
+	res := callTool(t, td, "retry_task", `{"ID":3}`)
+	if !strings.Contains(res.Content, "task #3 will run again") {
+		t.Fatalf("expect the failed dependent to be retried, got %q", res.Content)
+	}
+	if ready := mgr.ReadyTasks(); len(ready) != 2 || ready[0].Base().ID != 1 || ready[1].Base().ID != 2 {
+		t.Errorf("expect task #3 to wait for the retried task #1")
+	}
+}
+
+// runTask runs a worker finishing the task with the tool call, the worker first echoes output.
+func runTask(t *testing.T, mgr *service.TaskMgr, task service.Task, output string, finish string, args string) {
+	t.Helper()
+	if err := mgr.StartTask(task); err != nil {
+		t.Fatal(err)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(echoTool(), finishTool(t, mgr, task))
+	callTool(t, worker, "echo", output)
+	res := callTool(t, worker, finish, args)
+	if !mgr.IsFinished(task) {
+		t.Fatalf("task #%d not finished: %s", task.Base().ID, res.Content)
+	}
+	if err := mgr.MergeTask(task); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskMgrFixCycle(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog(), MaxFixCycles: 1}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("add the flag")
+
+	callTool(t, td, "create_build_task", `{"Task":"add the -v flag"}`)
+	callTool(t, td, "create_verify_task", `{"Task":"run the tests","DependsOn":[1]}`)
+	runTask(t, mgr, mgr.Pending[0], "main.go changed", "finish_build_task", `{"ChangeLog":"added -v","Context":[]}`)
+	verify := mgr.Pending[0]
+	if err := mgr.StartTask(verify); err != nil {
+		t.Fatal(err)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(echoTool(), finishTool(t, mgr, verify))
+	callTool(t, worker, "echo", "FAIL TestFlag")
+	res := callTool(t, worker, "finish_verify_task", `{"Result":"fail","Conclusion":"TestFlag fails","Evidence":[4],"Context":[{"ID":2,"Desc":"test output"}]}`)
+	if !strings.Contains(res.Content, "evidence #4 is not a context item") {
+		t.Fatalf("expect evidence outside the context to be rejected, got %q", res.Content)
+	}
+	callTool(t, worker, "finish_verify_task", `{"Result":"fail","Conclusion":"TestFlag fails","Evidence":[2],"Context":[{"ID":2,"Desc":"test output"}]}`)
+	if err := mgr.MergeTask(verify); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mgr.Pending) != 2 {
+		t.Fatalf("expect a fix cycle of 2 tasks, got %d pending", len(mgr.Pending))
+	}
+	fix, reverify := mgr.Pending[0], mgr.Pending[1]
+	if fix.Base().FixOf != 2 || len(fix.Base().DependsOn) != 1 || fix.Base().DependsOn[0] != 2 || reverify.Base().DependsOn[0] != fix.Base().ID {
+		t.Fatalf("unexpected fix cycle %+v %+v", fix.Base(), reverify.Base())
+	}
+	for _, want := range []string{"verify task #2 found in the changes of build task #1", "TestFlag fails", "context items #2", "Goal of build task #1: add the -v flag"} {
+		if !strings.Contains(fix.GetTask(), want) {
+			t.Errorf("expect %q in the fix task %q", want, fix.GetTask())
+		}
+	}
+	if got := verify.FormatString(); !strings.Contains(got, "Checks: #1\n\nResult: fail\n") || !strings.Contains(got, "Evidence: #2\n") {
+		t.Errorf("unexpected verify task %q", got)
+	}
+
+	runTask(t, mgr, fix, "main.go fixed", "finish_build_task", `{"ChangeLog":"fixed -v","Context":[]}`)
+	// the conclusion alone still works, the result is read from it
+	runTask(t, mgr, reverify, "FAIL TestFlag again", "finish_verify_task", `{"Conclusion":"failed: TestFlag still fails","Context":[]}`)
+	if len(mgr.Pending) != 0 {
+		t.Fatalf("expect the fix cycles to stop after 1 cycle, got %d pending", len(mgr.Pending))
+	}
+	got := reverify.FormatString()
+	for _, want := range []string{"Fix Cycle Of: #2\n", "Checks: #3\n", "- verify #2 of build #1: fail, TestFlag fails\n- verify #4 of build #3: fail, failed: TestFlag still fails\nStopped after 1 fix cycles"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expect %q in the verify task %q", want, got)
+		}
+	}
+}
+
+func TestTaskMgrRules(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	for _, name := range []string{"explore-before-build", "observed-files", "verify-after-build"} {
+		rule, ok := service.LookupTaskRule(name)
+		if !ok {
+			t.Fatalf("no rule %s", name)
+		}
+		mgr.Rules = append(mgr.Rules, rule)
+	}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("add the flag")
+
+	res := callTool(t, td, "create_build_task", `{"Task":"add the -v flag to cmd/main.go"}`)
+	if !strings.Contains(res.Content, "rule explore-before-build: no explore task") || !strings.Contains(res.Content, "rule observed-files: no explore or build task has seen cmd/main.go") {
+		t.Fatalf("expect the build task to be rejected, got %q", res.Content)
+	}
+	callTool(t, td, "create_explore_task", `{"Task":"find the flags","ExpectOutput":"the flag parsing"}`)
+	runTask(t, mgr, mgr.Pending[0], "cmd/main.go: flag.Bool(\"q\")", "finish_explore_task", `{"Context":[{"ID":2,"Desc":"the flags"}]}`)
+
+	res = callTool(t, td, "create_build_task", `{"Task":"add the -v flag to cmd/main.go and config.yaml"}`)
+	if !strings.Contains(res.Content, "has seen config.yaml,") || strings.Contains(res.Content, "explore-before-build") {
+		t.Fatalf("expect only config.yaml to be unseen, got %q", res.Content)
+	}
+	// a new file in a directory seen before is fine
+	res = callTool(t, td, "create_build_task", `{"Task":"add the -v flag to cmd/main.go and test it in cmd/main_test.go"}`)
+	if !strings.Contains(res.Content, "created build task #2") {
+		t.Fatalf("unexpected create result %q", res.Content)
+	}
+	runTask(t, mgr, mgr.Pending[0], "cmd/main.go changed", "finish_build_task", `{"ChangeLog":"added -v","Context":[]}`)
+	res = callTool(t, td, "create_build_task", `{"Task":"document the -v flag in cmd/main.go"}`)
+	if !strings.Contains(res.Content, "rule verify-after-build: build task #2 was not verified") {
+		t.Fatalf("expect the unverified build to be reported, got %q", res.Content)
+	}
+	callTool(t, td, "create_verify_task", `{"Task":"run the tests","DependsOn":[2]}`)
+	res = callTool(t, td, "create_build_task", `{"Task":"document the -v flag in cmd/main.go"}`)
+	if !strings.Contains(res.Content, "created build task #4") {
+		t.Fatalf("unexpected create result %q", res.Content)
+	}
+	// only cmd/main.go was seen, in.go is a different file
+	res = callTool(t, td, "create_build_task", `{"Task":"move the flags to in.go"}`)
+	if !strings.Contains(res.Content, "has seen in.go,") {
+		t.Errorf("expect in.go to be unseen, got %q", res.Content)
+	}
+	res = callTool(t, td, "create_build_task", `{"Task":"parse the flags in cmd/main.go like Node.js does, see https://nodejs.org/api/cli.html"}`)
+	if !strings.Contains(res.Content, "created build task #5") {
+		t.Errorf("expect product names and URLs not to count as files, got %q", res.Content)
+	}
+}
+
+func TestTaskMgrSubtasks(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog(), MaxDepth: 1}
+	mgr.RunSubtask = func(ctx context.Context, child *service.TaskMgr, task service.Task) error {
+		if child.Depth() != 1 {
+			t.Errorf("expect the subtask at depth 1, got %d", child.Depth())
+		}
+		worker := service.NewToolDispatcher(child.ToolLog)
+		worker.RegisterToolEndpoint(echoTool(), finishTool(t, child, task))
+		callTool(t, worker, "echo", "func main() {}")
+		callTool(t, worker, "finish_explore_task", `{"Context":[{"ID":1,"Desc":"main.go"}]}`)
+		return nil
+	}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("fix main")
+	callTool(t, td, "create_build_task", `{"Task":"fix main"}`)
+	build := mgr.Pending[0]
+	if err := mgr.StartTask(build); err != nil {
+		t.Fatal(err)
+	}
+
+	def, _ := mgr.LookupTaskDef("build")
+	tools, err := mgr.SubtaskTools(def, build)
+	if err != nil || len(tools) != 2 {
+		t.Fatalf("expect the explore and reason subtask tools, got %d: %v", len(tools), err)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(tools...)
+	worker.RegisterToolEndpoint(finishTool(t, mgr, build))
+	res := callTool(t, worker, "create_explore_task", `{"Task":"read main.go","ExpectOutput":"main"}`)
+	if !strings.Contains(res.Content, "--- EXPLORE TASK #2 ---") {
+		t.Fatalf("unexpected subtask result %q", res.Content)
+	}
+
+	// a run resumed before the worker finished keeps its subtasks, the worker sees them as finished
+	cp, err := mgr.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := &service.TaskMgr{ToolLog: service.NewToolLog(), MaxDepth: 1}
+	if err := resumed.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	interrupted := resumed.Pending[0]
+	if base := interrupted.Base(); base.Status != service.TaskPending || len(base.Subtasks) != 1 {
+		t.Fatalf("expect the interrupted task pending with its subtask, got %s with %d subtasks", base.Status, len(base.Subtasks))
+	}
+	resumedChild, err := resumed.NewChild(interrupted)
+	if err != nil || len(resumedChild.PreTasks) != 1 {
+		t.Fatalf("expect the subtask in the history of the child, got %v", err)
+	}
+	if err := resumed.StartTask(interrupted); err != nil {
+		t.Fatal(err)
+	}
+	resumedWorker := service.NewToolDispatcher(resumed.ToolLog)
+	resumedWorker.RegisterToolEndpoint(finishTool(t, resumed, interrupted))
+	callTool(t, resumedWorker, "finish_build_task", `{"ChangeLog":"fixed main","Context":[{"ID":1,"Desc":"main.go"}]}`)
+	if items := service.TaskContext(interrupted); len(items) != 1 || items[0].ToolLog == nil {
+		t.Errorf("expect the context of the subtask folded once, got %+v", items)
+	}
+
+	callTool(t, worker, "finish_build_task", `{"ChangeLog":"fixed main","Context":[]}`)
+	if err := mgr.MergeTask(build); err != nil {
+		t.Fatal(err)
+	}
+	if items := service.TaskContext(build); len(items) != 1 || items[0].Desc != "subtask #2: main.go" {
+		t.Errorf("expect the context of the subtask folded into the task, got %+v", items)
+	}
+	child, err := mgr.NewChild(build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := child.NewChild(build.Base().Subtasks[0]); err == nil {
+		t.Errorf("expect the depth limit to stop nesting")
+	}
+
+	cp, err = mgr.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &service.TaskMgr{ToolLog: service.NewToolLog()}
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restored.PreTasks[0].FormatString(), build.FormatString(); got != want {
+		t.Errorf("got restored task\n%s\nwant\n%s", got, want)
+	}
+	td = service.NewToolDispatcher(restored.ToolLog)
+	td.RegisterToolEndpoint(restored.CreateTaskTools()...)
+	if res := callTool(t, td, "create_explore_task", `{"Task":"next","ExpectOutput":"next"}`); !strings.Contains(res.Content, "task #3") {
+		t.Errorf("expect the IDs to continue after the subtasks, got %q", res.Content)
+	}
+	if res := callTool(t, td, "create_reason_task", `{"Task":"plan","ExpectOutput":"plan","DependsOn":[2]}`); !strings.Contains(res.Content, "invalid dependency #2") {
+		t.Errorf("expect a dependency on a subtask to be rejected, got %q", res.Content)
+	}
+}
+
+func TestTaskMgrPlan(t *testing.T) {
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	td.RegisterToolEndpoint(mgr.SetPlanTool())
+	td.RegisterToolEndpoint(mgr.PlanTools()...)
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("fix the crash")
+
+	if res := callTool(t, td, "insert_plan_step", `{"Step":1,"Type":"explore","Goal":"find the crash"}`); !strings.Contains(res.Content, "no plan yet") {
+		t.Errorf("expect no plan to revise, got %q", res.Content)
+	}
+	if res := callTool(t, td, "set_plan", `{"Steps":[{"Type":"debug","Goal":"find the crash"}]}`); !strings.Contains(res.Content, `step 1 has unknown task type "debug"`) {
+		t.Errorf("expect the unknown type to be rejected, got %q", res.Content)
+	}
+	callTool(t, td, "set_plan", `{"Steps":[{"Type":"explore","Goal":"find the crash","ExpectOutput":"the stack trace"},{"Type":"build","Goal":"fix the crash"}]}`)
+	callTool(t, td, "insert_plan_step", `{"Step":3,"Type":"verify","Goal":"run the tests"}`)
+	callTool(t, td, "insert_plan_step", `{"Step":2,"Type":"verify","Goal":"reproduce the crash"}`)
+	callTool(t, td, "move_plan_step", `{"From":2,"To":1}`)
+	callTool(t, td, "create_explore_task", `{"Task":"find the crash","ExpectOutput":"the stack trace"}`)
+	if res := callTool(t, td, "remove_plan_step", `{"Step":2}`); !strings.Contains(res.Content, "step 2 is done by task #1") {
+		t.Errorf("expect the step of a task to stay, got %q", res.Content)
+	}
+	runTask(t, mgr, mgr.Pending[0], "panic in main.go", "finish_explore_task", `{"Context":[]}`)
+	callTool(t, td, "remove_plan_step", `{"Step":1}`)
+	callTool(t, td, "create_build_task", `{"Task":"fix the crash","DependsOn":[1]}`)
+
+	want := "** USER PRIMARY GOAL **: fix the crash\n" +
+		"### PLAN (revision 5)\n" +
+		"1. [explore] find the crash -> expect: the stack trace (task #1, succeeded)\n" +
+		"2. [build] fix the crash (task #2, pending)\n" +
+		"3. [verify] run the tests (todo)\n\n"
+	if got := mgr.GetTaskContextPrompt(mgr.Pending[0]); !strings.HasPrefix(got, want) {
+		t.Errorf("got prompt\n%s\nwant prefix\n%s", got, want)
+	}
+	if err := mgr.ApprovePlan([]service.PlanStep{{Type: "explore"}}); err == nil {
+		t.Errorf("expect the edited plan without goal to be rejected")
+	}
+
+	cp, err := mgr.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &service.TaskMgr{ToolLog: service.NewToolLog()}
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.GetTaskContextPrompt(restored.Pending[0]); !strings.HasPrefix(got, want) {
+		t.Errorf("expect the restored plan, got\n%s", got)
+	}
+	restored.Reset("next goal")
+	if restored.GetPlan() != nil {
+		t.Errorf("expect a new user goal to drop the plan")
+	}
+}
+
+func TestConfigTaskDef(t *testing.T) {
+	cfg, err := config.Load("../config/example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := service.NewConfigTaskDef(cfg.TaskTypes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := service.NewToolDispatcher(nil)
+	mgr := &service.TaskMgr{ToolLog: td.ToolLog()}
+	if err := mgr.RegisterTaskDef(def); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.RegisterTaskDef(def); err == nil {
+		t.Errorf("expect registering %q twice to fail", def.Name)
+	}
+	td.RegisterToolEndpoint(mgr.CreateTaskTools()...)
+	mgr.Reset("review the fix")
+
+	callTool(t, td, "create_review_task", `{"Task":"review the handler change"}`)
+	task := mgr.Pending[0]
+	if err := mgr.StartTask(task); err != nil {
+		t.Fatal(err)
+	}
+	worker := service.NewToolDispatcher(mgr.ToolLog)
+	worker.RegisterToolEndpoint(echoTool(), finishTool(t, mgr, task))
+	callTool(t, worker, "echo", "missing error check")
+	res := callTool(t, worker, "finish_review_task", `{"Verdict":"changes requested","Context":[{"ID":1,"Desc":"the missing check"}]}`)
+	if !mgr.IsFinished(task) {
+		t.Fatalf("expect the review task to finish, got %q", res.Content)
+	}
+	if err := mgr.MergeTask(task); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := mgr.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &service.TaskMgr{ToolLog: service.NewToolLog()}
+	if err := restored.Restore(cp); err == nil {
+		t.Errorf("expect restoring an unregistered task type to fail")
+	}
+	restored.RegisterTaskDef(def)
+	if err := restored.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+	want := "--- REVIEW TASK #1 ---\nGoal: review the handler change\nVerdict: changes requested\n\nContext Items:\n#1: the missing check\n"
+	if got := restored.PreTasks[0].FormatString(); got != want {
+		t.Errorf("got task\n%s\nwant\n%s", got, want)
+	}
+	if msgs := restored.GetAllTaskToolCallMessages(); len(msgs) != 2 {
+		t.Errorf("expect the context item as tool call messages, got %v", msgs)
+	}
+}
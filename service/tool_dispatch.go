@@ -1,10 +1,12 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/sashabaranov/go-openai"
 )
@@ -12,7 +14,9 @@ import (
 type ToolEndPoint struct {
 	Name    string
 	Def     openai.FunctionDefinition
-	Handler func(args string) (string, error)
+	Handler func(ctx context.Context, args string) (string, error)
+	// ReadOnly tools do not change the repo or the task state, their calls may run in parallel.
+	ReadOnly bool
 }
 
 type ToolExecLog struct {
@@ -26,6 +30,9 @@ func (toolLog *ToolExecLog) formatString() string {
 	var builder strings.Builder
 	builder.WriteString(fmt.Sprintf("<ToolLogID>%d</ToolLogID>\n", toolLog.ID))
 	builder.WriteString(toolLog.ToolRes)
+	if toolLog.ToolErr != nil {
+		builder.WriteString(fmt.Sprintf("Error: %s", toolLog.ToolErr))
+	}
 	return builder.String()
 }
 
@@ -39,39 +46,105 @@ func (toolLog *ToolExecLog) ReconstructAssistantMessage() openai.ChatCompletionM
 	}
 }
 
-// ReconstructToolMessage reconstructs the tool response message
+// ReconstructToolMessage reconstructs the tool response message, as the dispatcher returned it
 func (toolLog *ToolExecLog) ReconstructToolMessage() openai.ChatCompletionMessage {
-	content := toolLog.ToolRes
-	if toolLog.ToolErr != nil {
-		content = fmt.Sprintf("Error: %s", toolLog.ToolErr)
-	}
-
 	return openai.ChatCompletionMessage{
 		Role:       openai.ChatMessageRoleTool,
 		ToolCallID: toolLog.ToolCall.ID,
-		Content:    content,
+		Content:    toolLog.formatString(),
+	}
+}
+
+// ToolLog is the append-only log of all tool calls of a user goal, shared by the tool dispatchers
+// of all agents. IDs are the index in the log and never change, context items refer to them.
+type ToolLog struct {
+	mu      sync.RWMutex
+	entries []*ToolExecLog
+}
+
+func NewToolLog() *ToolLog {
+	return &ToolLog{}
+}
+
+func (l *ToolLog) append(toolCall openai.ToolCall, res string, err error) *ToolExecLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := &ToolExecLog{
+		ID:       len(l.entries),
+		ToolCall: toolCall,
+		ToolRes:  res,
+		ToolErr:  err,
+	}
+	l.entries = append(l.entries, entry)
+	return entry
+}
+
+// Get returns the entry with the ID.
+func (l *ToolLog) Get(id int) (*ToolExecLog, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if id < 0 || id >= len(l.entries) {
+		return nil, fmt.Errorf("invalid tool log ID %d, must be between 0 and %d", id, len(l.entries)-1)
 	}
+	return l.entries[id], nil
+}
+
+func (l *ToolLog) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+// Entries returns a snapshot of the log.
+func (l *ToolLog) Entries() []*ToolExecLog {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]*ToolExecLog(nil), l.entries...)
+}
+
+// Reset replaces the log, used when a checkpoint is restored.
+func (l *ToolLog) Reset(entries []*ToolExecLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = entries
 }
 
+// ToolDispatcher is the tool set of one agent. The tool calls are recorded in the shared ToolLog,
+// the dispatcher only remembers which entries are its own.
 type ToolDispatcher struct {
+	log *ToolLog
+
+	mu      sync.RWMutex
 	toolMap map[string]ToolEndPoint
-	toolLog []*ToolExecLog
+	own     []*ToolExecLog
 }
 
-func NewToolDispatcher(toolLog []*ToolExecLog) *ToolDispatcher {
+// NewToolDispatcher creates an empty tool set recording into toolLog, a nil toolLog gets a private log.
+func NewToolDispatcher(toolLog *ToolLog) *ToolDispatcher {
+	if toolLog == nil {
+		toolLog = NewToolLog()
+	}
 	return &ToolDispatcher{
+		log:     toolLog,
 		toolMap: map[string]ToolEndPoint{},
-		toolLog: toolLog,
 	}
 }
+
+// GetToolLog returns the tool calls run by this dispatcher.
 func (td *ToolDispatcher) GetToolLog() []*ToolExecLog {
-	return td.toolLog
+	td.mu.RLock()
+	defer td.mu.RUnlock()
+	return append([]*ToolExecLog(nil), td.own...)
 }
 
-func (td *ToolDispatcher) ResetTools() {
-	td.toolMap = map[string]ToolEndPoint{}
+// ToolLog returns the shared log the dispatcher records into.
+func (td *ToolDispatcher) ToolLog() *ToolLog {
+	return td.log
 }
+
 func (td *ToolDispatcher) RegisterToolEndpoint(endpoints ...ToolEndPoint) error {
+	td.mu.Lock()
+	defer td.mu.Unlock()
 	err := []error{}
 	for _, endpoint := range endpoints {
 		_, exist := td.toolMap[endpoint.Name]
@@ -84,8 +157,17 @@ func (td *ToolDispatcher) RegisterToolEndpoint(endpoints ...ToolEndPoint) error
 	return errors.Join(err...)
 }
 
-func (td *ToolDispatcher) Run(toolCall openai.ToolCall) openai.ChatCompletionMessage {
+// IsReadOnly reports whether the named tool is registered as read-only.
+func (td *ToolDispatcher) IsReadOnly(name string) bool {
+	td.mu.RLock()
+	defer td.mu.RUnlock()
+	return td.toolMap[name].ReadOnly
+}
+
+func (td *ToolDispatcher) Run(ctx context.Context, toolCall openai.ToolCall) openai.ChatCompletionMessage {
+	td.mu.RLock()
 	endpoint, exist := td.toolMap[toolCall.Function.Name]
+	td.mu.RUnlock()
 	res := openai.ChatCompletionMessage{
 		Role:       "tool",
 		ToolCallID: toolCall.ID,
@@ -93,22 +175,21 @@ func (td *ToolDispatcher) Run(toolCall openai.ToolCall) openai.ChatCompletionMes
 	content := ""
 	var err error
 	if exist {
-		content, err = endpoint.Handler(toolCall.Function.Arguments)
+		content, err = endpoint.Handler(ctx, toolCall.Function.Arguments)
 	} else {
 		err = fmt.Errorf("Run tool call failed, Can not find tool with name %s", toolCall.Function.Name)
 	}
-	log := ToolExecLog{
-		ID:       len(td.toolLog),
-		ToolCall: toolCall,
-		ToolRes:  content,
-		ToolErr:  err,
-	}
-	td.toolLog = append(td.toolLog, &log)
+	log := td.log.append(toolCall, content, err)
+	td.mu.Lock()
+	td.own = append(td.own, log)
+	td.mu.Unlock()
 	res.Content = log.formatString()
 	return res
 }
 
 func (td *ToolDispatcher) GetTools() []openai.Tool {
+	td.mu.RLock()
+	defer td.mu.RUnlock()
 	res := make([]openai.Tool, 0, len(td.toolMap))
 	for _, endpoint := range td.toolMap {
 		res = append(res, openai.Tool{
@@ -120,6 +201,8 @@ func (td *ToolDispatcher) GetTools() []openai.Tool {
 }
 
 func (td *ToolDispatcher) DebugTools() {
+	td.mu.RLock()
+	defer td.mu.RUnlock()
 	for _, tool := range td.toolMap {
 		fmt.Printf("tool.Name: %v\n", tool.Name)
 		data, _ := json.Marshal(tool.Def)
@@ -2,6 +2,7 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"multi-agent/shared"
@@ -12,6 +13,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"mvdan.cc/sh/v3/syntax"
@@ -254,7 +257,7 @@ func (tool *BashTool) AddRepo(path string) error {
 	log.Info().Any("git repo", tool.gitRepoPath).Any("tmp index", tool.tempIndexFile).Msg("init bash tool")
 	return nil
 }
-func (tool *BashTool) Run(cmd string, dir string) (*BashRes, error) {
+func (tool *BashTool) Run(ctx context.Context, cmd string, dir string) (*BashRes, error) {
 	runMode, err := tool.chooseRunMode(cmd, dir)
 	if err != nil {
 		log.Error().Err(err).Any("cmd", cmd).Msg("choose run mode for shell cmd failed")
@@ -263,9 +266,9 @@ func (tool *BashTool) Run(cmd string, dir string) (*BashRes, error) {
 	var res *BashRes
 	switch runMode {
 	case DirectRun:
-		res, err = tool.DirectRun(cmd, dir)
+		res, err = tool.DirectRun(ctx, cmd, dir)
 	case DiffRun:
-		res, err = tool.DiffRun(cmd, dir)
+		res, err = tool.DiffRun(ctx, cmd, dir)
 	}
 	if err != nil {
 		log.Error().Err(err).Any("cmd", cmd).Msg("Executing shell cmd failed")
@@ -286,12 +289,28 @@ func (tool *BashTool) chooseRunMode(cmd string, dir string) (RunMode, error) {
 	}
 	return DirectRun, nil
 }
-func (tool *BashTool) DirectRun(cmd string, dir string) (*BashRes, error) {
-	runCmd := exec.Command("bash", "-c", cmd)
+
+// bashCommand runs the command in its own process group, so cancelling the context
+// also kills the children (e.g. the test binary started by 'go test').
+func bashCommand(ctx context.Context, cmd string, dir string) *exec.Cmd {
+	runCmd := exec.CommandContext(ctx, "bash", "-c", cmd)
 	if dir != "" {
 		runCmd.Dir = dir
 	}
+	runCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	runCmd.Cancel = func() error {
+		return syscall.Kill(-runCmd.Process.Pid, syscall.SIGKILL)
+	}
+	runCmd.WaitDelay = 5 * time.Second
+	return runCmd
+}
+
+func runBash(ctx context.Context, cmd string, dir string) (*BashRes, error) {
+	runCmd := bashCommand(ctx, cmd, dir)
 	output, err := runCmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("command %q aborted: %w", cmd, ctx.Err())
+	}
 	exitCode := 0
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
@@ -306,27 +325,18 @@ func (tool *BashTool) DirectRun(cmd string, dir string) (*BashRes, error) {
 	}
 	return bashResult, nil
 }
-func (tool *BashTool) DiffRun(cmd string, dir string) (*BashRes, error) {
+
+func (tool *BashTool) DirectRun(ctx context.Context, cmd string, dir string) (*BashRes, error) {
+	return runBash(ctx, cmd, dir)
+}
+func (tool *BashTool) DiffRun(ctx context.Context, cmd string, dir string) (*BashRes, error) {
 	err := tool.syncRepo()
 	if err != nil {
 		return nil, err
 	}
-	runCmd := exec.Command("bash", "-c", cmd)
-	if dir != "" {
-		runCmd.Dir = dir
-	}
-	output, err := runCmd.CombinedOutput()
-	exitCode := 0
+	bashResult, err := runBash(ctx, cmd, dir)
 	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
-		} else {
-			return nil, err // System error (e.g., bash not found)
-		}
-	}
-	bashResult := &BashRes{
-		ExitCode: exitCode,
-		Output:   string(output),
+		return nil, err
 	}
 	tool.diffOutput(bashResult)
 
@@ -367,9 +377,9 @@ func (tool *BashTool) diffOutput(res *BashRes) {
 		case " M":
 			res.ModifiedFiles = append(res.ModifiedFiles, filename)
 		case " D":
-			res.DeletedFiles = append(res.ModifiedFiles, filename)
+			res.DeletedFiles = append(res.DeletedFiles, filename)
 		case "??":
-			res.CreatedFiles = append(res.ModifiedFiles, filename)
+			res.CreatedFiles = append(res.CreatedFiles, filename)
 		}
 	}
 }
@@ -1,7 +1,11 @@
 package service_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"multi-agent/protocol"
 	"multi-agent/service"
 	_ "multi-agent/shared"
 	"testing"
@@ -41,7 +45,7 @@ func TestBashRun(t *testing.T) {
 			// `echo "hello you" > test.txt`,
 		}
 		for _, cmd := range testCashs {
-			res, err := test.Run(cmd, "")
+			res, err := test.Run(context.Background(), cmd, "")
 			if err != nil {
 				fmt.Printf("err: %v\n", err)
 				continue
@@ -77,3 +81,39 @@ func TestViewFile(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoteExecutor(t *testing.T) {
+	toAgent, driverOut := io.Pipe()
+	driverIn, fromAgent := io.Pipe()
+	executor := service.NewRemoteExecutor(protocol.NewConn(toAgent, fromAgent, "a"))
+	driver := protocol.NewConn(driverIn, driverOut, "d")
+	go func() {
+		for {
+			env, err := driver.Receive(context.Background())
+			if err != nil {
+				return
+			}
+			var req protocol.BashRequest
+			env.Decode(&req)
+			if req.Command == "false" {
+				driver.ReplyError(env, protocol.CodeFailed, fmt.Errorf("container is gone"))
+				continue
+			}
+			driver.Reply(env, protocol.TypeBashResult, protocol.BashResult{Code: 0, Output: "ran " + req.Command})
+		}
+	}()
+	for _, cmd := range []string{"ls", "pwd"} {
+		res, err := executor.Exec(context.Background(), cmd, "/testbed")
+		if err != nil {
+			t.Fatalf("exec %s failed: %v", cmd, err)
+		}
+		if res.ExitCode != 0 || res.Output != "ran "+cmd {
+			t.Errorf("unexpected result for %s: %+v", cmd, res)
+		}
+	}
+	_, err := executor.Exec(context.Background(), "false", "/testbed")
+	var remoteErr *protocol.RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != protocol.CodeFailed {
+		t.Errorf("expect remote error, got %v", err)
+	}
+}
@@ -17,7 +17,7 @@ func init() {
 	}
 
 	consoleWriter := zerolog.ConsoleWriter{
-		Out:        os.Stdout,
+		Out:        os.Stderr,
 		TimeFormat: "15:04:05", // Custom time format (e.g., HH:mm:ss)
 		// FormatLevel: func(i interface{}) string {
 		// 	return strings.ToUpper(fmt.Sprintf("[%s]", i))
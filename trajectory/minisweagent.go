@@ -0,0 +1,143 @@
+package trajectory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// MiniSWEFormat is the trajectory_format of the .traj.json files of mini-swe-agent.
+const MiniSWEFormat = "mini-swe-agent-1"
+
+// MiniSWETrajectory is the .traj.json layout of mini-swe-agent, so its inspector and the SWE-bench
+// tooling around agent.py read our runs as well.
+type MiniSWETrajectory struct {
+	Info             MiniSWEInfo      `json:"info"`
+	Messages         []MiniSWEMessage `json:"messages"`
+	TrajectoryFormat string           `json:"trajectory_format"`
+}
+
+type MiniSWEInfo struct {
+	ExitStatus string            `json:"exit_status"`
+	Submission string            `json:"submission"`
+	ModelStats MiniSWEModelStats `json:"model_stats"`
+}
+
+type MiniSWEModelStats struct {
+	InstanceCost float64 `json:"instance_cost"`
+	APICalls     int     `json:"api_calls"`
+}
+
+// MiniSWEMessage only has the system, user and assistant roles of mini-swe-agent, Agent tells
+// which of our agents the message belongs to.
+type MiniSWEMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Agent   string `json:"agent,omitempty"`
+}
+
+var exitStatus = map[string]string{
+	"done":      "Submitted",
+	"failed":    "Failed",
+	"cancelled": "Cancelled",
+}
+
+// LastRun returns the ID of the last run in the events.
+func LastRun(events []Event) string {
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Run != "" {
+			return events[i].Run
+		}
+	}
+	return ""
+}
+
+// MiniSWE converts the events of the run to the mini-swe-agent format. The conversations of the agents
+// are concatenated in the order the agents started, each one contiguous even when parallel workers
+// interleaved their events.
+func MiniSWE(events []Event, run string) *MiniSWETrajectory {
+	traj := &MiniSWETrajectory{
+		Messages:         []MiniSWEMessage{},
+		TrajectoryFormat: MiniSWEFormat,
+	}
+	// conversations are in start order, current maps an agent to its running conversation
+	var conversations [][]MiniSWEMessage
+	current := map[string]int{}
+	add := func(agent string, msgs ...MiniSWEMessage) {
+		i, ok := current[agent]
+		if !ok {
+			i = len(conversations)
+			conversations = append(conversations, nil)
+			current[agent] = i
+		}
+		conversations[i] = append(conversations[i], msgs...)
+	}
+	for _, event := range events {
+		if event.Run != run {
+			continue
+		}
+		switch event.Type {
+		case EventAgentStart:
+			// an agent running again, e.g. the orchestrator, starts a new conversation
+			current[event.Agent] = len(conversations)
+			conversations = append(conversations, nil)
+		case EventRequest:
+			for _, msg := range event.Messages {
+				add(event.Agent, miniSWEMessage(msg, event.Agent))
+			}
+		case EventResponse:
+			traj.Info.ModelStats.APICalls++
+			traj.Info.ModelStats.InstanceCost += event.Cost
+			if event.Message != nil {
+				add(event.Agent, miniSWEMessage(*event.Message, event.Agent))
+			}
+		case EventToolResult:
+			add(event.Agent, MiniSWEMessage{Role: openai.ChatMessageRoleUser, Content: event.Content, Agent: event.Agent})
+		case EventRunEnd:
+			if event.Result != nil {
+				traj.Info.ExitStatus = exitStatus[event.Result.Status]
+				traj.Info.Submission = event.Result.Response
+			}
+		}
+	}
+	for _, conversation := range conversations {
+		traj.Messages = append(traj.Messages, conversation...)
+	}
+	return traj
+}
+
+func miniSWEMessage(msg openai.ChatCompletionMessage, agent string) MiniSWEMessage {
+	role := msg.Role
+	var builder strings.Builder
+	builder.WriteString(msg.Content)
+	switch role {
+	case openai.ChatMessageRoleAssistant:
+		for _, call := range msg.ToolCalls {
+			builder.WriteString(fmt.Sprintf("\n<tool_call name=%q>%s</tool_call>", call.Function.Name, call.Function.Arguments))
+		}
+	case openai.ChatMessageRoleSystem:
+	default:
+		role = openai.ChatMessageRoleUser
+	}
+	return MiniSWEMessage{Role: role, Content: builder.String(), Agent: agent}
+}
+
+// WriteMiniSWE converts the run of the trajectory file in to a .traj.json file at out,
+// an empty run takes the last run.
+func WriteMiniSWE(in string, out string, run string) error {
+	events, err := ReadFile(in)
+	if err != nil {
+		return err
+	}
+	if run == "" {
+		run = LastRun(events)
+	}
+	data, err := json.MarshalIndent(MiniSWE(events, run), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0644)
+}
@@ -0,0 +1,243 @@
+package trajectory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+type agentKey struct{}
+
+// WithAgent tells the Replayer which agent sends the requests made with ctx.
+func WithAgent(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, agentKey{}, name)
+}
+
+func agentFrom(ctx context.Context) string {
+	name, _ := ctx.Value(agentKey{}).(string)
+	return name
+}
+
+type replayTurn struct {
+	request  Event
+	response Event
+}
+
+// Replayer is an http.RoundTripper answering chat completions with the responses of a recorded trajectory
+// instead of calling the api. Every agent gets its recorded responses in order, so parallel workers
+// replay the same way however they are scheduled.
+//
+// The recorded request is checked against the actual one: a different message count, first turn
+// messages or tool set fails the request, the recording no longer matches the behaviour of the code.
+type Replayer struct {
+	mu    sync.Mutex
+	turns map[string][]replayTurn
+	calls int
+}
+
+// NewReplayer pairs the request and response events of every agent, failed attempts are skipped.
+func NewReplayer(events []Event) *Replayer {
+	r := &Replayer{turns: map[string][]replayTurn{}}
+	requests := map[string]Event{}
+	for _, event := range events {
+		switch event.Type {
+		case EventRequest:
+			requests[event.Agent] = event
+		case EventResponse:
+			if event.Message == nil {
+				continue
+			}
+			r.turns[event.Agent] = append(r.turns[event.Agent], replayTurn{request: requests[event.Agent], response: event})
+		}
+	}
+	return r
+}
+
+// LoadReplayer reads the trajectory file at path, see NewReplayer.
+func LoadReplayer(path string) (*Replayer, error) {
+	events, err := ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read replay trajectory %s failed: %w", path, err)
+	}
+	return NewReplayer(events), nil
+}
+
+// Remaining returns the number of responses not replayed yet per agent, agents with none left are omitted.
+func (r *Replayer) Remaining() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	remaining := map[string]int{}
+	for agent, turns := range r.turns {
+		if len(turns) != 0 {
+			remaining[agent] = len(turns)
+		}
+	}
+	return remaining
+}
+
+func (r *Replayer) next(agent string) (replayTurn, int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	turns := r.turns[agent]
+	if len(turns) == 0 {
+		return replayTurn{}, 0, false
+	}
+	r.turns[agent] = turns[1:]
+	r.calls++
+	return turns[0], r.calls, true
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return replayError(req, http.StatusNotFound, fmt.Sprintf("replay only serves chat completions, got %s %s", req.Method, req.URL.Path)), nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var chatReq openai.ChatCompletionRequest
+	err = json.Unmarshal(body, &chatReq)
+	if err != nil {
+		return replayError(req, http.StatusBadRequest, fmt.Sprintf("invalid chat completion request: %s", err)), nil
+	}
+
+	agent := agentFrom(req.Context())
+	turn, call, ok := r.next(agent)
+	if !ok {
+		return replayError(req, http.StatusBadRequest, fmt.Sprintf("replay mismatch: no recorded response left for agent %q", agent)), nil
+	}
+	err = matchRequest(turn.request, chatReq)
+	if err != nil {
+		return replayError(req, http.StatusBadRequest, fmt.Sprintf("replay mismatch: agent %q turn %d: %s", agent, turn.response.Turn, err)), nil
+	}
+
+	id := fmt.Sprintf("replay-%d", call)
+	if chatReq.Stream {
+		return replayStream(req, id, chatReq.Model, turn.response), nil
+	}
+	resp := openai.ChatCompletionResponse{
+		ID:     id,
+		Object: "chat.completion",
+		Model:  chatReq.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      *turn.response.Message,
+			FinishReason: openai.FinishReason(turn.response.FinishReason),
+		}},
+	}
+	if turn.response.Usage != nil {
+		resp.Usage = *turn.response.Usage
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return replayResponse(req, http.StatusOK, "application/json", data), nil
+}
+
+// matchRequest compares the parts the recording has, a hand written trajectory may leave them out.
+func matchRequest(recorded Event, actual openai.ChatCompletionRequest) error {
+	if recorded.MessageCount != 0 && recorded.MessageCount != len(actual.Messages) {
+		return fmt.Errorf("recorded %d messages, got %d", recorded.MessageCount, len(actual.Messages))
+	}
+	for i, msg := range recorded.Messages {
+		if i >= len(actual.Messages) {
+			return fmt.Errorf("recorded %d messages, got %d", len(recorded.Messages), len(actual.Messages))
+		}
+		if msg.Role != actual.Messages[i].Role || msg.Content != actual.Messages[i].Content {
+			return fmt.Errorf("message %d (%s) differs from the recording", i, actual.Messages[i].Role)
+		}
+	}
+	if recorded.Tools != nil {
+		tools := ToolNames(actual.Tools)
+		if !slices.Equal(recorded.Tools, tools) {
+			return fmt.Errorf("recorded tools %v, got %v", recorded.Tools, tools)
+		}
+	}
+	return nil
+}
+
+// ToolNames returns the sorted names of the tools of a request.
+func ToolNames(tools []openai.Tool) []string {
+	names := []string{}
+	for _, tool := range tools {
+		if tool.Function != nil {
+			names = append(names, tool.Function.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replayStream sends the whole recorded message as a single chunk, followed by the usage.
+func replayStream(req *http.Request, id string, model string, response Event) *http.Response {
+	body := StreamBody(id, model, response.Message, openai.FinishReason(response.FinishReason), response.Usage)
+	return replayResponse(req, http.StatusOK, "text/event-stream", body)
+}
+
+// StreamBody encodes the message as the server-sent events of a streamed chat completion: one chunk
+// with the whole message, a usage chunk when usage is set, then [DONE].
+func StreamBody(id string, model string, msg *openai.ChatCompletionMessage, finish openai.FinishReason, usage *openai.Usage) []byte {
+	delta := openai.ChatCompletionStreamChoiceDelta{
+		Role:             msg.Role,
+		Content:          msg.Content,
+		ReasoningContent: msg.ReasoningContent,
+	}
+	for i, call := range msg.ToolCalls {
+		index := i
+		call.Index = &index
+		delta.ToolCalls = append(delta.ToolCalls, call)
+	}
+	chunks := []openai.ChatCompletionStreamResponse{{
+		ID:      id,
+		Object:  "chat.completion.chunk",
+		Model:   model,
+		Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: finish}},
+	}}
+	if usage != nil {
+		chunks = append(chunks, openai.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Model:   model,
+			Choices: []openai.ChatCompletionStreamChoice{},
+			Usage:   usage,
+		})
+	}
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(&body, "data: %s\n\n", data)
+	}
+	body.WriteString("data: [DONE]\n\n")
+	return body.Bytes()
+}
+
+func replayError(req *http.Request, code int, msg string) *http.Response {
+	data, _ := json.Marshal(map[string]any{
+		"error": map[string]any{"message": msg, "type": "replay_error"},
+	})
+	return replayResponse(req, code, "application/json", data)
+}
+
+func replayResponse(req *http.Request, code int, contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,183 @@
+package trajectory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Event types.
+const (
+	// EventRunStart and EventRunEnd enclose a user task, Goal is the user goal and Result the outcome.
+	EventRunStart = "run_start"
+	EventRunEnd   = "run_end"
+	// EventAgentStart and EventAgentEnd enclose one BaseAgent.Run.
+	EventAgentStart = "agent_start"
+	EventAgentEnd   = "agent_end"
+	// EventRequest is a chat completion request. Only the first request of an agent carries the
+	// messages and tools, later requests only add the response and tool results recorded in between.
+	EventRequest    = "request"
+	EventResponse   = "response"
+	EventToolCall   = "tool_call"
+	EventToolResult = "tool_result"
+	// EventTask is a task transition of the TaskMgr.
+	EventTask = "task"
+	// EventError is a failed chat completion attempt.
+	EventError = "error"
+)
+
+// Event is one line of the trajectory file.
+type Event struct {
+	Seq   int       `json:"seq"`
+	Time  time.Time `json:"time"`
+	Run   string    `json:"run,omitempty"`
+	Type  string    `json:"type"`
+	Agent string    `json:"agent,omitempty"`
+	Role  string    `json:"role,omitempty"`
+	Model string    `json:"model,omitempty"`
+	Turn  int       `json:"turn,omitempty"`
+	// DurationMs is the time the request, tool call, agent or run took.
+	DurationMs int64 `json:"duration_ms,omitempty"`
+
+	Messages     []openai.ChatCompletionMessage `json:"messages,omitempty"`
+	MessageCount int                            `json:"message_count,omitempty"`
+	// Tools are the sorted tool names offered with the first request.
+	Tools        []string                      `json:"tools,omitempty"`
+	Message      *openai.ChatCompletionMessage `json:"message,omitempty"`
+	FinishReason string                        `json:"finish_reason,omitempty"`
+	Usage        *openai.Usage                 `json:"usage,omitempty"`
+	// Cost is the price of Usage in USD, 0 for models without a configured price.
+	Cost float64 `json:"cost,omitempty"`
+
+	ToolCall *openai.ToolCall `json:"tool_call,omitempty"`
+	// Content is the tool result as the model sees it.
+	Content string `json:"content,omitempty"`
+
+	Goal   string     `json:"goal,omitempty"`
+	Task   *TaskEvent `json:"task,omitempty"`
+	Result *RunResult `json:"result,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type TaskEvent struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"`
+	// Transition is "created", "started", "finished", "failed", "cancelled", "abandoned", "retried",
+	// "merged" or "refined".
+	Transition string `json:"transition"`
+	Goal       string `json:"goal,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+type RunResult struct {
+	Status   string `json:"status"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Since returns the milliseconds elapsed since start, for Event.DurationMs.
+func Since(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
+
+// Recorder appends events as json lines. Every event is written at once, a crash loses nothing.
+// A nil Recorder records nothing, so agents without a trajectory need no checks.
+type Recorder struct {
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+	run    string
+	seq    int
+}
+
+func NewRecorder(out io.Writer) *Recorder {
+	r := &Recorder{out: out}
+	if closer, ok := out.(io.Closer); ok {
+		r.closer = closer
+	}
+	return r
+}
+
+// Create appends to the trajectory file at path.
+func Create(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open trajectory %s failed: %w", path, err)
+	}
+	return NewRecorder(file), nil
+}
+
+// SetRun sets the run ID of the following events.
+func (r *Recorder) SetRun(run string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run = run
+}
+
+func (r *Recorder) Record(event Event) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	event.Seq = r.seq
+	event.Time = time.Now()
+	event.Run = r.run
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Any("type", event.Type).Msg("encode trajectory event failed")
+		return
+	}
+	_, err = r.out.Write(append(data, '\n'))
+	if err != nil {
+		log.Error().Err(err).Any("type", event.Type).Msg("write trajectory event failed")
+	}
+}
+
+func (r *Recorder) Close() error {
+	if r == nil || r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// Read parses a trajectory file, a truncated last line of a crashed run is skipped.
+func Read(in io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var event Event
+		err := json.Unmarshal(line, &event)
+		if err != nil {
+			log.Warn().Err(err).Msg("skip invalid trajectory line")
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+func ReadFile(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
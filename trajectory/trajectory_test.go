@@ -0,0 +1,101 @@
+package trajectory_test
+
+import (
+	"bytes"
+	"multi-agent/trajectory"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestMiniSWE(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := trajectory.NewRecorder(&buf)
+	recorder.SetRun("r1")
+	recorder.Record(trajectory.Event{Type: trajectory.EventRunStart, Goal: "fix the bug"})
+	recorder.Record(trajectory.Event{Type: trajectory.EventRequest, Agent: "explore#1", Turn: 1, Messages: []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "system"},
+		{Role: openai.ChatMessageRoleUser, Content: "user"},
+	}})
+	call := openai.ToolCall{ID: "c1", Function: openai.FunctionCall{Name: "bash", Arguments: `{"Command":"ls"}`}}
+	recorder.Record(trajectory.Event{Type: trajectory.EventResponse, Agent: "explore#1", Turn: 1, Message: &openai.ChatCompletionMessage{
+		Role:      openai.ChatMessageRoleAssistant,
+		Content:   "look around",
+		ToolCalls: []openai.ToolCall{call},
+	}})
+	recorder.Record(trajectory.Event{Type: trajectory.EventToolResult, Agent: "explore#1", ToolCall: &call, Content: "main.go"})
+	recorder.Record(trajectory.Event{Type: trajectory.EventRunEnd, Result: &trajectory.RunResult{Status: "done", Response: "fixed"}})
+	recorder.SetRun("r2")
+	recorder.Record(trajectory.Event{Type: trajectory.EventRunStart, Goal: "next"})
+	// a crash in the middle of a line
+	buf.WriteString(`{"seq":7,"type":"resp`)
+
+	events, err := trajectory.Read(&buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if len(events) != 6 || events[5].Seq != 6 || trajectory.LastRun(events) != "r2" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	traj := trajectory.MiniSWE(events, "r1")
+	if traj.TrajectoryFormat != trajectory.MiniSWEFormat || traj.Info.ExitStatus != "Submitted" || traj.Info.Submission != "fixed" || traj.Info.ModelStats.APICalls != 1 {
+		t.Errorf("unexpected info: %+v", traj.Info)
+	}
+	roles := []string{"system", "user", "assistant", "user"}
+	if len(traj.Messages) != len(roles) {
+		t.Fatalf("expect %d messages, got %+v", len(roles), traj.Messages)
+	}
+	for i, role := range roles {
+		if traj.Messages[i].Role != role {
+			t.Errorf("message %d: expect role %s, got %s", i, role, traj.Messages[i].Role)
+		}
+	}
+	if traj.Messages[2].Content != "look around\n<tool_call name=\"bash\">{\"Command\":\"ls\"}</tool_call>" {
+		t.Errorf("unexpected assistant message: %q", traj.Messages[2].Content)
+	}
+}
+
+// TestMiniSWE_parallel keeps the conversations of parallel workers contiguous.
+func TestMiniSWE_parallel(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := trajectory.NewRecorder(&buf)
+	recorder.SetRun("r1")
+	call := openai.ToolCall{ID: "c1", Function: openai.FunctionCall{Name: "bash", Arguments: `{"Command":"ls"}`}}
+	for _, agent := range []string{"explore#1", "explore#2"} {
+		recorder.Record(trajectory.Event{Type: trajectory.EventAgentStart, Agent: agent})
+	}
+	for _, agent := range []string{"explore#1", "explore#2"} {
+		recorder.Record(trajectory.Event{Type: trajectory.EventRequest, Agent: agent, Turn: 1, Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "task of " + agent}}})
+	}
+	for _, agent := range []string{"explore#2", "explore#1"} {
+		recorder.Record(trajectory.Event{Type: trajectory.EventResponse, Agent: agent, Turn: 1, Message: &openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: "call of " + agent, ToolCalls: []openai.ToolCall{call}}})
+	}
+	for _, agent := range []string{"explore#1", "explore#2"} {
+		recorder.Record(trajectory.Event{Type: trajectory.EventToolResult, Agent: agent, ToolCall: &call, Content: "result of " + agent})
+	}
+	recorder.Record(trajectory.Event{Type: trajectory.EventAgentStart, Agent: "explore#1"})
+	recorder.Record(trajectory.Event{Type: trajectory.EventRequest, Agent: "explore#1", Turn: 1, Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "again"}}})
+
+	events, err := trajectory.Read(&buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	traj := trajectory.MiniSWE(events, "r1")
+	var got []string
+	for _, msg := range traj.Messages {
+		got = append(got, msg.Agent+": "+strings.SplitN(msg.Content, "\n", 2)[0])
+	}
+	want := []string{
+		"explore#1: task of explore#1",
+		"explore#1: call of explore#1",
+		"explore#1: result of explore#1",
+		"explore#2: task of explore#2",
+		"explore#2: call of explore#2",
+		"explore#2: result of explore#2",
+		"explore#1: again",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got messages\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
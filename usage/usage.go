@@ -0,0 +1,167 @@
+package usage
+
+import (
+	"cmp"
+	"fmt"
+	"multi-agent/config"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Record is the usage of one agent run.
+type Record struct {
+	Agent string
+	Role  string
+	Model string
+	// Task is the task ID of a worker, 0 for the orchestrator and the context agent.
+	Task     int
+	TaskType string
+	Usage    openai.Usage
+	Cost     float64
+	// Calls counts the chat completions.
+	Calls int
+}
+
+// Total sums up records.
+type Total struct {
+	Usage openai.Usage
+	Cost  float64
+	Calls int
+	Runs  int
+}
+
+func (t *Total) add(record Record) {
+	t.Usage.PromptTokens += record.Usage.PromptTokens
+	t.Usage.CompletionTokens += record.Usage.CompletionTokens
+	t.Usage.TotalTokens += record.Usage.TotalTokens
+	t.Cost += record.Cost
+	t.Calls += record.Calls
+	t.Runs++
+}
+
+func (t Total) String() string {
+	return fmt.Sprintf("%d calls, %d prompt + %d completion tokens, $%.4f",
+		t.Calls, t.Usage.PromptTokens, t.Usage.CompletionTokens, t.Cost)
+}
+
+// Tracker collects the usage of the agents of a user task, the workers of parallel tasks add concurrently.
+type Tracker struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+func (t *Tracker) Add(record Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records = append(t.records, record)
+}
+
+// Reset drops the records, called when a new user task starts.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records = nil
+}
+
+func (t *Tracker) Records() []Record {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Record{}, t.records...)
+}
+
+func (t *Tracker) Total() Total {
+	var total Total
+	for _, record := range t.Records() {
+		total.add(record)
+	}
+	return total
+}
+
+func groupBy[K comparable](records []Record, key func(Record) K) map[K]Total {
+	totals := map[K]Total{}
+	for _, record := range records {
+		total := totals[key(record)]
+		total.add(record)
+		totals[key(record)] = total
+	}
+	return totals
+}
+
+func (t *Tracker) ByRole() map[string]Total {
+	return groupBy(t.Records(), func(r Record) string { return r.Role })
+}
+
+func (t *Tracker) ByModel() map[string]Total {
+	return groupBy(t.Records(), func(r Record) string { return r.Model })
+}
+
+// ByTask sums up the workers of every task, the agents without task are left out.
+func (t *Tracker) ByTask() map[int]Total {
+	var records []Record
+	for _, record := range t.Records() {
+		if record.Task != 0 {
+			records = append(records, record)
+		}
+	}
+	return groupBy(records, func(r Record) int { return r.Task })
+}
+
+// Check returns an error when the budget is used up.
+func (t *Tracker) Check(budget config.RunBudget) error {
+	total := t.Total()
+	switch {
+	case budget.MaxTokens > 0 && total.Usage.TotalTokens >= budget.MaxTokens:
+		return fmt.Errorf("run used %d tokens, max %d", total.Usage.TotalTokens, budget.MaxTokens)
+	case budget.MaxCost > 0 && total.Cost >= budget.MaxCost:
+		return fmt.Errorf("run cost $%.4f, max $%.2f", total.Cost, budget.MaxCost)
+	}
+	return nil
+}
+
+// BudgetPrompt tells the orchestrator how much of the budget remains, "" without a budget.
+func (t *Tracker) BudgetPrompt(budget config.RunBudget) string {
+	if budget.MaxTokens <= 0 && budget.MaxCost <= 0 {
+		return ""
+	}
+	total := t.Total()
+	var builder strings.Builder
+	builder.WriteString("### BUDGET\n")
+	if budget.MaxTokens > 0 {
+		builder.WriteString(fmt.Sprintf("Tokens: used %d of %d, %d remaining\n",
+			total.Usage.TotalTokens, budget.MaxTokens, max(budget.MaxTokens-total.Usage.TotalTokens, 0)))
+	}
+	if budget.MaxCost > 0 {
+		builder.WriteString(fmt.Sprintf("Cost: used $%.4f of $%.2f, $%.4f remaining\n",
+			total.Cost, budget.MaxCost, max(budget.MaxCost-total.Cost, 0)))
+	}
+	builder.WriteString("Plan the remaining tasks to fit the budget, the run is stopped when it is used up.\n")
+	return builder.String()
+}
+
+// Summary formats the totals per role, model and task.
+func (t *Tracker) Summary() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("usage: %s\n", t.Total()))
+	writeTotals(&builder, "role ", t.ByRole())
+	writeTotals(&builder, "model ", t.ByModel())
+	writeTotals(&builder, "task #", t.ByTask())
+	return builder.String()
+}
+
+func writeTotals[K cmp.Ordered](builder *strings.Builder, kind string, totals map[K]Total) {
+	keys := make([]K, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		builder.WriteString(fmt.Sprintf("  %s%v: %s\n", kind, key, totals[key]))
+	}
+}
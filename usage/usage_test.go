@@ -0,0 +1,47 @@
+package usage
+
+import (
+	"multi-agent/config"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Add(Record{Agent: "orchestrator", Role: "orchestrator", Model: "a/x", Usage: openai.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}, Cost: 0.5, Calls: 2})
+	tracker.Add(Record{Agent: "explore#1", Role: "explore", Model: "a/x", Task: 1, TaskType: "explore", Usage: openai.Usage{PromptTokens: 200, CompletionTokens: 20, TotalTokens: 220}, Cost: 1, Calls: 3})
+	tracker.Add(Record{Agent: "explore#2", Role: "explore", Model: "b/y", Task: 2, TaskType: "explore", Usage: openai.Usage{PromptTokens: 300, CompletionTokens: 30, TotalTokens: 330}, Calls: 4})
+
+	total := tracker.Total()
+	if total.Usage.TotalTokens != 660 || total.Cost != 1.5 || total.Calls != 9 {
+		t.Errorf("unexpected total %+v", total)
+	}
+	if got := tracker.ByRole()["explore"]; got.Usage.TotalTokens != 550 || got.Runs != 2 {
+		t.Errorf("unexpected explore total %+v", got)
+	}
+	if got := tracker.ByModel()["a/x"]; got.Cost != 1.5 {
+		t.Errorf("unexpected model total %+v", got)
+	}
+	if got := tracker.ByTask(); len(got) != 2 || got[2].Usage.PromptTokens != 300 {
+		t.Errorf("unexpected task totals %+v", got)
+	}
+	if !strings.Contains(tracker.Summary(), "task #2: 4 calls") {
+		t.Errorf("unexpected summary:\n%s", tracker.Summary())
+	}
+
+	if tracker.BudgetPrompt(config.RunBudget{}) != "" {
+		t.Errorf("expect no budget prompt without budget")
+	}
+	prompt := tracker.BudgetPrompt(config.RunBudget{MaxTokens: 1000, MaxCost: 2})
+	if !strings.Contains(prompt, "340 remaining") || !strings.Contains(prompt, "$0.5000 remaining") {
+		t.Errorf("unexpected budget prompt:\n%s", prompt)
+	}
+	if err := tracker.Check(config.RunBudget{MaxTokens: 1000}); err != nil {
+		t.Errorf("expect budget left, got %v", err)
+	}
+	if err := tracker.Check(config.RunBudget{MaxCost: 1.5}); err == nil {
+		t.Errorf("expect cost budget exhausted")
+	}
+}